@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/blind-oracle/go-common/logger"
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/time/rate"
+)
+
+var (
+	metricHtpasswdReloadErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "cortex_tenant",
+		Name:      "htpasswd_reload_errors",
+		Help:      "The total number of failed htpasswd file reloads.",
+	})
+)
+
+const authFailureRateLimited = "rate_limited"
+
+// Users and their bcrypt hashes
+type htpasswd map[string][]byte
+
+// Authenticates the requests with HTTP basic auth against an htpasswd file
+type basicAuth struct {
+	file    string
+	users   atomic.Pointer[htpasswd]
+	watcher *fsnotify.Watcher
+
+	// Hashes of the credentials which were already verified, bcrypt is too slow to run it on every request
+	verified sync.Map
+
+	failures *failureLimiter
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+
+	logger.Logger
+}
+
+func newBasicAuth(c config) (*basicAuth, error) {
+	if c.Auth.Ingress.Basic.HtpasswdFile == "" {
+		return nil, nil
+	}
+
+	a := &basicAuth{
+		file:     c.Auth.Ingress.Basic.HtpasswdFile,
+		failures: newFailureLimiter(c.Auth.Ingress.Basic.MaxFailedAttempts, c.Auth.Ingress.Basic.FailedAttemptsPeriod),
+		stop:     make(chan struct{}),
+		Logger:   logger.NewSimpleLogger("basic-auth"),
+	}
+
+	if err := a.load(); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+func (a *basicAuth) load() error {
+	b, err := os.ReadFile(a.file)
+	if err != nil {
+		return errors.Wrap(err, "Unable to read htpasswd file")
+	}
+
+	users, err := parseHtpasswd(b)
+	if err != nil {
+		return errors.Wrap(err, "Unable to load htpasswd file")
+	}
+
+	a.users.Store(&users)
+	a.verified.Clear()
+	return nil
+}
+
+// Parses the `user:hash` lines, only bcrypt hashes are supported
+func parseHtpasswd(b []byte) (htpasswd, error) {
+	users := htpasswd{}
+
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("line %d: expecting user:hash", n)
+		}
+
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("line %d: user %s: only bcrypt hashes are supported", n, user)
+		}
+
+		users[user] = []byte(hash)
+	}
+
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(users) == 0 {
+		return nil, fmt.Errorf("no users found")
+	}
+
+	return users, nil
+}
+
+// Starts watching the file and cleaning up the failure limiters
+func (a *basicAuth) start() (err error) {
+	if a.watcher, err = fsnotify.NewWatcher(); err != nil {
+		return errors.Wrap(err, "Unable to create file watcher")
+	}
+
+	// The directory is watched to catch the atomic renames, same as for the tenant mapping
+	if err = a.watcher.Add(filepath.Dir(a.file)); err != nil {
+		return errors.Wrap(err, "Unable to watch htpasswd file")
+	}
+
+	a.wg.Add(2)
+	go func() {
+		defer a.wg.Done()
+
+		for {
+			select {
+			case ev, ok := <-a.watcher.Events:
+				if !ok {
+					return
+				}
+
+				if filepath.Clean(ev.Name) != filepath.Clean(a.file) || ev.Op == fsnotify.Chmod {
+					continue
+				}
+
+				if err := a.load(); err != nil {
+					metricHtpasswdReloadErrors.Inc()
+					a.Errorf("%s, keeping the previous users", err)
+				}
+			case err, ok := <-a.watcher.Errors:
+				if !ok {
+					return
+				}
+
+				a.Errorf("htpasswd file watcher error: %s", err)
+			}
+		}
+	}()
+
+	go func() {
+		defer a.wg.Done()
+
+		t := time.NewTicker(a.failures.period)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-t.C:
+				a.failures.cleanup()
+			case <-a.stop:
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (a *basicAuth) close() {
+	close(a.stop)
+
+	if a.watcher != nil {
+		a.watcher.Close()
+	}
+
+	a.wg.Wait()
+}
+
+// Returns the identity of the client by the base64-encoded `user:password`
+func (a *basicAuth) authenticate(credentials []byte) (*identity, string, error) {
+	decoded, err := base64.StdEncoding.DecodeString(string(credentials))
+	if err != nil {
+		return nil, authFailureInvalid, errors.Wrap(err, "Unable to decode basic auth credentials")
+	}
+
+	user, password, ok := strings.Cut(string(decoded), ":")
+	if !ok || user == "" {
+		return nil, authFailureInvalid, fmt.Errorf("malformed basic auth credentials")
+	}
+
+	hash, ok := (*a.users.Load())[user]
+	if !ok {
+		return nil, authFailureInvalid, fmt.Errorf("unknown user %s", user)
+	}
+
+	key := sha256.Sum256(append(hash, decoded...))
+	if _, ok := a.verified.Load(key); ok {
+		return &identity{name: user}, "", nil
+	}
+
+	if err = bcrypt.CompareHashAndPassword(hash, []byte(password)); err != nil {
+		return nil, authFailureInvalid, fmt.Errorf("wrong password for user %s", user)
+	}
+
+	a.verified.Store(key, struct{}{})
+	return &identity{name: user}, "", nil
+}
+
+// Limits the rate of the failed attempts per source IP
+type failureLimiter struct {
+	mtx      sync.Mutex
+	limiters map[string]*rate.Limiter
+
+	burst  int
+	limit  rate.Limit
+	period time.Duration
+}
+
+// Allows up to max failed attempts per period
+func newFailureLimiter(max int, period time.Duration) *failureLimiter {
+	return &failureLimiter{
+		limiters: map[string]*rate.Limiter{},
+		burst:    max,
+		limit:    rate.Every(period / time.Duration(max)),
+		period:   period,
+	}
+}
+
+// Whether the IP has used up its failed attempts
+func (l *failureLimiter) blocked(ip string) bool {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	lim, ok := l.limiters[ip]
+	return ok && lim.Tokens() < 1
+}
+
+func (l *failureLimiter) fail(ip string) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	lim, ok := l.limiters[ip]
+	if !ok {
+		lim = rate.NewLimiter(l.limit, l.burst)
+		l.limiters[ip] = lim
+	}
+
+	lim.Allow()
+}
+
+// Removes the limiters which are fully replenished
+func (l *failureLimiter) cleanup() {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	for ip, lim := range l.limiters {
+		if lim.Tokens() >= float64(l.burst) {
+			delete(l.limiters, ip)
+		}
+	}
+}
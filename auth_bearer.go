@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	fh "github.com/valyala/fasthttp"
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	metricAuthFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cortex_tenant",
+		Name:      "auth_failures",
+		Help:      "The total number of requests rejected due to missing or invalid credentials.",
+	}, []string{"reason"})
+)
+
+const (
+	authFailureMissing = "missing"
+	authFailureInvalid = "invalid"
+
+	userValueIdentity = "identity"
+)
+
+// Authenticated client
+type identity struct {
+	name string
+	// Used for all the timeseries and streams in the request
+	tenant string
+	// If not empty then only these tenants are accepted
+	allowed []string
+}
+
+// Entry of auth.ingress.bearer.tokens_file
+type bearerToken struct {
+	Token    string   `yaml:"token"`
+	Identity string   `yaml:"identity"`
+	Tenant   string   `yaml:"tenant"`
+	Tenants  []string `yaml:"tenants"`
+}
+
+// Authenticates the requests with static bearer tokens and/or JWTs
+type bearerAuth struct {
+	tokens map[string]*identity
+	jwt    *jwtVerifier
+}
+
+func newBearerAuth(c config) (*bearerAuth, error) {
+	if c.Auth.Ingress.Bearer.TokensFile == "" && c.Auth.Ingress.Bearer.JWT.JWKSFile == "" && c.Auth.Ingress.Bearer.JWT.JWKSURL == "" {
+		return nil, nil
+	}
+
+	a := &bearerAuth{}
+
+	if c.Auth.Ingress.Bearer.TokensFile != "" {
+		b, err := os.ReadFile(c.Auth.Ingress.Bearer.TokensFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "Unable to read bearer tokens file")
+		}
+
+		if a.tokens, err = parseBearerTokens(b); err != nil {
+			return nil, errors.Wrap(err, "Unable to load bearer tokens")
+		}
+	}
+
+	if c.Auth.Ingress.Bearer.JWT.JWKSFile != "" || c.Auth.Ingress.Bearer.JWT.JWKSURL != "" {
+		v, err := newJWTVerifier(c)
+		if err != nil {
+			return nil, err
+		}
+
+		a.jwt = v
+	}
+
+	return a, nil
+}
+
+func parseBearerTokens(b []byte) (map[string]*identity, error) {
+	var entries []bearerToken
+	if err := yaml.UnmarshalStrict(b, &entries); err != nil {
+		return nil, err
+	}
+
+	tokens := make(map[string]*identity, len(entries))
+	for i, e := range entries {
+		name := e.Identity
+		if name == "" {
+			name = strconv.Itoa(i)
+		}
+
+		if e.Token == "" {
+			return nil, fmt.Errorf("token %s: token is not specified", name)
+		}
+
+		if e.Tenant != "" && len(e.Tenants) > 0 {
+			return nil, fmt.Errorf("token %s: tenant and tenants are mutually exclusive", name)
+		}
+
+		if _, ok := tokens[e.Token]; ok {
+			return nil, fmt.Errorf("token %s: duplicate token", name)
+		}
+
+		tokens[e.Token] = &identity{name: name, tenant: e.Tenant, allowed: e.Tenants}
+	}
+
+	return tokens, nil
+}
+
+// Returns the identity of the client by the token
+func (a *bearerAuth) authenticate(token []byte) (*identity, string, error) {
+	if id, ok := a.tokens[string(token)]; ok {
+		return id, "", nil
+	}
+
+	if a.jwt == nil {
+		return nil, authFailureInvalid, fmt.Errorf("unknown bearer token")
+	}
+
+	id, err := a.jwt.verify(string(token))
+	if err != nil {
+		return nil, authFailureInvalid, err
+	}
+
+	return id, "", nil
+}
+
+// Authenticates the request if the bearer and/or basic auth is configured,
+// the scheme of the Authorization header selects which one is used.
+// Returns false if the request was rejected.
+func (p *processor) authenticate(ctx *fh.RequestCtx) bool {
+	if p.bearerAuth == nil && p.basicAuth == nil {
+		return true
+	}
+
+	var (
+		id     *identity
+		reason = authFailureMissing
+		err    = fmt.Errorf("no credentials")
+	)
+
+	scheme, credentials, _ := bytes.Cut(ctx.Request.Header.Peek(fh.HeaderAuthorization), []byte(" "))
+
+	switch {
+	case len(credentials) == 0:
+	case p.bearerAuth != nil && bytes.EqualFold(scheme, []byte("Bearer")):
+		id, reason, err = p.bearerAuth.authenticate(credentials)
+	case p.basicAuth != nil && bytes.EqualFold(scheme, []byte("Basic")):
+		ip := p.clientIP(ctx).String()
+		if p.basicAuth.failures.blocked(ip) {
+			metricAuthFailures.WithLabelValues(authFailureRateLimited).Inc()
+			ctx.Error("Too many failed authentication attempts", fh.StatusTooManyRequests)
+			return false
+		}
+
+		if id, reason, err = p.basicAuth.authenticate(credentials); err != nil {
+			p.basicAuth.failures.fail(ip)
+		}
+	}
+
+	if err != nil {
+		metricAuthFailures.WithLabelValues(reason).Inc()
+		p.Debugf("src=%s: authentication failed: %s", ctx.RemoteAddr(), err)
+
+		ctx.Error("Unauthorized", fh.StatusUnauthorized)
+		if p.bearerAuth != nil {
+			ctx.Response.Header.Add(fh.HeaderWWWAuthenticate, "Bearer")
+		}
+		if p.basicAuth != nil {
+			ctx.Response.Header.Add(fh.HeaderWWWAuthenticate, `Basic realm="cortex-tenant"`)
+		}
+
+		return false
+	}
+
+	ctx.SetUserValue(userValueIdentity, id)
+	return true
+}
+
+// Returns the identity authenticated by the bearer token or basic auth, if any
+func requestIdentity(ctx *fh.RequestCtx) *identity {
+	id, _ := ctx.UserValue(userValueIdentity).(*identity)
+	return id
+}
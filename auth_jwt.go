@@ -0,0 +1,372 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/blind-oracle/go-common/logger"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	fh "github.com/valyala/fasthttp"
+)
+
+var (
+	metricJWKSReloadErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "cortex_tenant",
+		Name:      "jwks_reload_errors",
+		Help:      "The total number of failed JWKS fetches.",
+	})
+)
+
+const jwksFetchTimeout = 10 * time.Second
+
+// Only the asymmetric algorithms, the keys come from the JWKS
+var jwtValidMethods = []string{
+	"RS256", "RS384", "RS512",
+	"PS256", "PS384", "PS512",
+	"ES256", "ES384", "ES512",
+	"EdDSA",
+}
+
+// Public keys by their key ID
+type jwks map[string]any
+
+// Verifies the JWTs with the keys from a local JWKS file or fetched periodically from a URL
+type jwtVerifier struct {
+	keys   atomic.Pointer[jwks]
+	parser *jwt.Parser
+
+	identityClaim string
+	tenantClaim   string
+	// Whether the tokens without the tenant claim are rejected, they're unrestricted otherwise
+	tenantRequired bool
+
+	url      string
+	interval time.Duration
+	cli      *fh.Client
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+
+	logger.Logger
+}
+
+func newJWTVerifier(c config) (*jwtVerifier, error) {
+	jc := c.Auth.Ingress.Bearer.JWT
+
+	opts := []jwt.ParserOption{
+		jwt.WithValidMethods(jwtValidMethods),
+		jwt.WithExpirationRequired(),
+	}
+
+	if jc.Issuer != "" {
+		opts = append(opts, jwt.WithIssuer(jc.Issuer))
+	}
+
+	if jc.Audience != "" {
+		opts = append(opts, jwt.WithAudience(jc.Audience))
+	}
+
+	v := &jwtVerifier{
+		parser:         jwt.NewParser(opts...),
+		identityClaim:  jc.IdentityClaim,
+		tenantClaim:    jc.TenantClaim,
+		tenantRequired: jc.TenantClaim != "",
+		url:            jc.JWKSURL,
+		interval:       jc.JWKSRefreshInterval,
+		stop:           make(chan struct{}),
+		Logger:         logger.NewSimpleLogger("jwt"),
+	}
+
+	if v.tenantClaim == "" {
+		v.tenantClaim = "tenant"
+	}
+
+	if jc.JWKSFile != "" {
+		b, err := os.ReadFile(jc.JWKSFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "Unable to read JWKS file")
+		}
+
+		keys, err := parseJWKS(b)
+		if err != nil {
+			return nil, errors.Wrap(err, "Unable to load JWKS file")
+		}
+
+		v.keys.Store(&keys)
+		return v, nil
+	}
+
+	v.cli = &fh.Client{
+		Name:          "cortex-tenant",
+		DialDualStack: c.EnableIPv6,
+	}
+
+	return v, nil
+}
+
+// Starts polling the JWKS URL
+func (v *jwtVerifier) start() {
+	if v.url == "" {
+		return
+	}
+
+	// Don't fail if the URL is unavailable on startup,
+	// the tokens are rejected until the first successful fetch
+	v.reload()
+
+	v.wg.Add(1)
+	go func() {
+		defer v.wg.Done()
+
+		t := time.NewTicker(v.interval)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-t.C:
+				v.reload()
+			case <-v.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (v *jwtVerifier) close() {
+	close(v.stop)
+	v.wg.Wait()
+}
+
+func (v *jwtVerifier) reload() {
+	if err := v.fetch(); err != nil {
+		metricJWKSReloadErrors.Inc()
+		v.Errorf("%s, keeping the previous keys", err)
+	}
+}
+
+func (v *jwtVerifier) fetch() error {
+	req := fh.AcquireRequest()
+	resp := fh.AcquireResponse()
+	defer func() {
+		fh.ReleaseRequest(req)
+		fh.ReleaseResponse(resp)
+	}()
+
+	req.SetRequestURI(v.url)
+	req.Header.Set("Accept", "application/json")
+
+	if err := v.cli.DoTimeout(req, resp, jwksFetchTimeout); err != nil {
+		return errors.Wrap(err, "Unable to fetch JWKS")
+	}
+
+	if resp.StatusCode() != fh.StatusOK {
+		return fmt.Errorf("unexpected HTTP code %d while fetching JWKS", resp.StatusCode())
+	}
+
+	keys, err := parseJWKS(resp.Body())
+	if err != nil {
+		return errors.Wrap(err, "Unable to load JWKS")
+	}
+
+	v.keys.Store(&keys)
+	return nil
+}
+
+// Returns the key to verify the token with. The key ID can be omitted if there's only one key.
+func (v *jwtVerifier) key(t *jwt.Token) (any, error) {
+	var keys jwks
+	if k := v.keys.Load(); k != nil {
+		keys = *k
+	}
+
+	kid, _ := t.Header["kid"].(string)
+	if kid == "" && len(keys) == 1 {
+		for _, k := range keys {
+			return k, nil
+		}
+	}
+
+	k, ok := keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key ID '%s'", kid)
+	}
+
+	return k, nil
+}
+
+// Verifies the token and returns the identity from its claims
+func (v *jwtVerifier) verify(token string) (*identity, error) {
+	claims := jwt.MapClaims{}
+	if _, err := v.parser.ParseWithClaims(token, claims, v.key); err != nil {
+		return nil, err
+	}
+
+	id := &identity{}
+	id.name, _ = claims[v.identityClaim].(string)
+
+	// Either a single tenant or the list of allowed ones
+	switch t := claims[v.tenantClaim].(type) {
+	case nil:
+		if v.tenantRequired {
+			return nil, fmt.Errorf("claim '%s' is missing", v.tenantClaim)
+		}
+	case string:
+		if t == "" {
+			return nil, fmt.Errorf("claim '%s' is empty", v.tenantClaim)
+		}
+
+		id.tenant = t
+	case []any:
+		for _, tenant := range t {
+			s, ok := tenant.(string)
+			if !ok || s == "" {
+				return nil, fmt.Errorf("claim '%s' must contain only non-empty strings", v.tenantClaim)
+			}
+
+			id.allowed = append(id.allowed, s)
+		}
+
+		if len(id.allowed) == 0 {
+			return nil, fmt.Errorf("claim '%s' is empty", v.tenantClaim)
+		}
+	default:
+		return nil, fmt.Errorf("claim '%s' must be a string or a list of strings", v.tenantClaim)
+	}
+
+	return id, nil
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// Parses the RSA, EC and Ed25519 public keys from a JWKS.
+// The keys of other types and the ones not meant for signing are skipped.
+func parseJWKS(b []byte) (jwks, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+
+	if err := json.Unmarshal(b, &set); err != nil {
+		return nil, errors.Wrap(err, "Unable to parse JSON")
+	}
+
+	keys := jwks{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, errors.Wrapf(err, "key '%s'", k.Kid)
+		}
+
+		if key != nil {
+			keys[k.Kid] = key
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no signing keys found")
+	}
+
+	return keys, nil
+}
+
+func (k jwk) publicKey() (any, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeJWKInt(k.N)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid modulus")
+		}
+
+		e, err := decodeJWKInt(k.E)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid exponent")
+		}
+
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("exponent is too large")
+		}
+
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+
+		x, err := decodeJWKInt(k.X)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid x coordinate")
+		}
+
+		y, err := decodeJWKInt(k.Y)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid y coordinate")
+		}
+
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("point is not on the curve")
+		}
+
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid Ed25519 public key")
+		}
+
+		return ed25519.PublicKey(x), nil
+	}
+
+	return nil, nil
+}
+
+func decodeJWKInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(b) == 0 {
+		return nil, fmt.Errorf("empty value")
+	}
+
+	return new(big.Int).SetBytes(b), nil
+}
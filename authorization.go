@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	fh "github.com/valyala/fasthttp"
+)
+
+var (
+	metricAuthorizationDenied = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cortex_tenant",
+		Name:      "authorization_denied",
+		Help:      "The total number of per-tenant writes denied to the client.",
+	}, []string{"identity", "action"})
+)
+
+// What to do with the tenants which the client is not allowed to write to
+const (
+	authorizationActionReject = "reject"
+	authorizationActionDrop   = "drop"
+)
+
+// Used in the metrics for the clients without an identity
+const identityAnonymous = "anonymous"
+
+type authorizationRuleConfig struct {
+	// Matches the client cert, bearer token or basic auth identity if set
+	Identity string `yaml:"identity"`
+	// Matches the client address if set
+	CIDRs []string `yaml:"cidrs"`
+	// Glob patterns of the tenants the client may write to
+	Tenants []string `yaml:"tenants"`
+}
+
+type authorizationRule struct {
+	identity string
+	nets     []*net.IPNet
+	tenants  []*regexp.Regexp
+}
+
+func newAuthorizationRules(c config) ([]*authorizationRule, error) {
+	rules := make([]*authorizationRule, 0, len(c.Authorization.Rules))
+
+	for i, rc := range c.Authorization.Rules {
+		nets, err := parseCIDRs(rc.CIDRs)
+		if err != nil {
+			return nil, errors.Wrapf(err, "authorization rule %d", i)
+		}
+
+		r := &authorizationRule{identity: rc.Identity, nets: nets}
+
+		if len(rc.Tenants) == 0 {
+			return nil, fmt.Errorf("authorization rule %d: tenants are not specified", i)
+		}
+
+		for _, t := range rc.Tenants {
+			r.tenants = append(r.tenants, globRegexp(t))
+		}
+
+		rules = append(rules, r)
+	}
+
+	return rules, nil
+}
+
+func (r *authorizationRule) matches(identity string, ip net.IP) bool {
+	if r.identity != "" && r.identity != identity {
+		return false
+	}
+
+	return len(r.nets) == 0 || containsIP(r.nets, ip)
+}
+
+func (r *authorizationRule) allows(tenant string) bool {
+	for _, re := range r.tenants {
+		if re.MatchString(tenant) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns the first rule matching the client, nil if none does
+func (p *processor) authorizationRule(ctx *fh.RequestCtx) *authorizationRule {
+	identity, ip := p.identityName(ctx), p.clientIP(ctx)
+
+	for _, r := range p.authorizationRules {
+		if r.matches(identity, ip) {
+			return r
+		}
+	}
+
+	return nil
+}
+
+// Checks the tenants of the request against the allowed ones of the client and the authorization rules.
+// The forbidden tenants are either removed from the map or the error is returned, depending on authorization.action.
+func (p *processor) authorize(ctx *fh.RequestCtx, src sourceTenant, m map[string]func() ([]byte, error)) error {
+	if len(src.allowed) == 0 && len(p.authorizationRules) == 0 {
+		return nil
+	}
+
+	rule := p.authorizationRule(ctx)
+
+	for tenant := range m {
+		if p.tenantAllowed(ctx, src, rule, tenant) {
+			continue
+		}
+
+		if p.cfg.Authorization.Action == authorizationActionReject {
+			return fmt.Errorf("tenant '%s' is not allowed for the client", tenant)
+		}
+
+		delete(m, tenant)
+	}
+
+	return nil
+}
+
+// Whether the client may write to the tenant, the denial is counted
+func (p *processor) tenantAllowed(ctx *fh.RequestCtx, src sourceTenant, rule *authorizationRule, tenant string) bool {
+	if src.allows(tenant) && (len(p.authorizationRules) == 0 || rule != nil && rule.allows(tenant)) {
+		return true
+	}
+
+	identity := p.identityName(ctx)
+	if identity == "" {
+		identity = identityAnonymous
+	}
+
+	metricAuthorizationDenied.WithLabelValues(identity, p.cfg.Authorization.Action).Inc()
+	p.Debugf("src=%s: tenant '%s' is not allowed for the client (%s)", logSource(ctx.RemoteAddr(), p.identityName(ctx)), tenant, p.cfg.Authorization.Action)
+
+	return false
+}
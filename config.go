@@ -8,6 +8,8 @@ import (
 
 	"github.com/caarlos0/env/v8"
 	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/relabel"
 	fhu "github.com/valyala/fasthttp/fasthttputil"
 	"gopkg.in/yaml.v2"
 )
@@ -18,9 +20,14 @@ type config struct {
 	ListenMetricsAddress string `yaml:"listen_metrics_address" env:"CT_LISTEN_METRICS_ADDRESS"`
 	MetricsIncludeTenant bool   `yaml:"metrics_include_tenant" env:"CT_METRICS_INCLUDE_TENANT"`
 
-	Target     string `env:"CT_TARGET"`
-	TargetLoki string `yaml:"target_loki" env:"CT_TARGET_LOKI"`
-	EnableIPv6 bool   `yaml:"enable_ipv6" env:"CT_ENABLE_IPV6"`
+	Target             string `env:"CT_TARGET"`
+	TargetLoki         string `yaml:"target_loki" env:"CT_TARGET_LOKI"`
+	TargetOTLP         string `yaml:"target_otlp" env:"CT_TARGET_OTLP"`
+	TargetLokiOTLP     string `yaml:"target_loki_otlp" env:"CT_TARGET_LOKI_OTLP"`
+	TargetTempo        string `yaml:"target_tempo" env:"CT_TARGET_TEMPO"`
+	TargetAlertmanager string `yaml:"target_alertmanager" env:"CT_TARGET_ALERTMANAGER"`
+	TargetPyroscope    string `yaml:"target_pyroscope" env:"CT_TARGET_PYROSCOPE"`
+	EnableIPv6         bool   `yaml:"enable_ipv6" env:"CT_ENABLE_IPV6"`
 
 	LogLevel          string        `yaml:"log_level" env:"CT_LOG_LEVEL"`
 	Timeout           time.Duration `env:"CT_TIMEOUT"`
@@ -44,21 +51,114 @@ type config struct {
 			TlsConfig struct {
 				CertFile string `yaml:"cert_file" env:"CT_TLS_CERT_FILE"`
 				KeyFile  string `yaml:"key_file" env:"CT_TLS_KEY_FILE"`
+
+				ClientCAFile string `yaml:"client_ca_file" env:"CT_TLS_CLIENT_CA_FILE"`
+				ClientAuth   string `yaml:"client_auth" env:"CT_TLS_CLIENT_AUTH"`
 			} `yaml:"tls_config"`
+			ClientCert struct {
+				Identity     string `yaml:"identity" env:"CT_AUTH_INGRESS_CLIENT_CERT_IDENTITY"`
+				SANURIPrefix string `yaml:"san_uri_prefix" env:"CT_AUTH_INGRESS_CLIENT_CERT_SAN_URI_PREFIX"`
+				TenantMode   string `yaml:"tenant_mode" env:"CT_AUTH_INGRESS_CLIENT_CERT_TENANT_MODE"`
+			} `yaml:"client_cert"`
+			Bearer struct {
+				// YAML list of {token, identity, tenant or tenants}
+				TokensFile string `yaml:"tokens_file" env:"CT_AUTH_INGRESS_BEARER_TOKENS_FILE"`
+				JWT        struct {
+					JWKSFile            string        `yaml:"jwks_file" env:"CT_AUTH_INGRESS_JWT_JWKS_FILE"`
+					JWKSURL             string        `yaml:"jwks_url" env:"CT_AUTH_INGRESS_JWT_JWKS_URL"`
+					JWKSRefreshInterval time.Duration `yaml:"jwks_refresh_interval" env:"CT_AUTH_INGRESS_JWT_JWKS_REFRESH_INTERVAL"`
+					Issuer              string        `yaml:"issuer" env:"CT_AUTH_INGRESS_JWT_ISSUER"`
+					Audience            string        `yaml:"audience" env:"CT_AUTH_INGRESS_JWT_AUDIENCE"`
+					IdentityClaim       string        `yaml:"identity_claim" env:"CT_AUTH_INGRESS_JWT_IDENTITY_CLAIM"`
+					TenantClaim         string        `yaml:"tenant_claim" env:"CT_AUTH_INGRESS_JWT_TENANT_CLAIM"`
+				} `yaml:"jwt"`
+			} `yaml:"bearer"`
+			Basic struct {
+				HtpasswdFile         string        `yaml:"htpasswd_file" env:"CT_AUTH_INGRESS_BASIC_HTPASSWD_FILE"`
+				MaxFailedAttempts    int           `yaml:"max_failed_attempts" env:"CT_AUTH_INGRESS_BASIC_MAX_FAILED_ATTEMPTS"`
+				FailedAttemptsPeriod time.Duration `yaml:"failed_attempts_period" env:"CT_AUTH_INGRESS_BASIC_FAILED_ATTEMPTS_PERIOD"`
+			} `yaml:"basic"`
 		}
 	}
 
 	Tenant struct {
 		Label              string   `env:"CT_TENANT_LABEL"`
 		LabelList          []string `yaml:"label_list" env:"CT_TENANT_LABEL_LIST" envSeparator:","`
+		AttributeList      []string `yaml:"attribute_list" env:"CT_TENANT_ATTRIBUTE_LIST" envSeparator:","`
 		Prefix             string   `yaml:"prefix" env:"CT_TENANT_PREFIX"`
 		PrefixPreferSource bool     `yaml:"prefix_prefer_source" env:"CT_TENANT_PREFIX_PREFER_SOURCE"`
 		LabelRemove        bool     `yaml:"label_remove" env:"CT_TENANT_LABEL_REMOVE"`
 		Header             string   `env:"CT_TENANT_HEADER"`
 		Default            string   `env:"CT_TENANT_DEFAULT"`
 		AcceptAll          bool     `yaml:"accept_all" env:"CT_TENANT_ACCEPT_ALL"`
+
+		Template        string            `yaml:"template" env:"CT_TENANT_TEMPLATE"`
+		Regex           map[string]string `yaml:"regex"`
+		URLMode         string            `yaml:"url_mode" env:"CT_TENANT_URL_MODE"`
+		InjectLabel     string            `yaml:"inject_label" env:"CT_TENANT_INJECT_LABEL"`
+		MappingFile     string            `yaml:"mapping_file" env:"CT_TENANT_MAPPING_FILE"`
+		MappingUnmapped string            `yaml:"mapping_unmapped" env:"CT_TENANT_MAPPING_UNMAPPED"`
+		MappingRemote   struct {
+			URL         string        `yaml:"url" env:"CT_TENANT_MAPPING_REMOTE_URL"`
+			Interval    time.Duration `yaml:"interval" env:"CT_TENANT_MAPPING_REMOTE_INTERVAL"`
+			Timeout     time.Duration `yaml:"timeout" env:"CT_TENANT_MAPPING_REMOTE_TIMEOUT"`
+			Username    string        `yaml:"username" env:"CT_TENANT_MAPPING_REMOTE_USERNAME"`
+			Password    string        `yaml:"password" env:"CT_TENANT_MAPPING_REMOTE_PASSWORD"`
+			BearerToken string        `yaml:"bearer_token" env:"CT_TENANT_MAPPING_REMOTE_BEARER_TOKEN"`
+		} `yaml:"mapping_remote"`
+		Kubernetes struct {
+			Kubeconfig         string        `yaml:"kubeconfig" env:"CT_TENANT_KUBERNETES_KUBECONFIG"`
+			NamespaceLabel     string        `yaml:"namespace_label" env:"CT_TENANT_KUBERNETES_NAMESPACE_LABEL"`
+			NamespaceAttribute string        `yaml:"namespace_attribute" env:"CT_TENANT_KUBERNETES_NAMESPACE_ATTRIBUTE"`
+			Annotation         string        `yaml:"annotation" env:"CT_TENANT_KUBERNETES_ANNOTATION"`
+			Label              string        `yaml:"label" env:"CT_TENANT_KUBERNETES_LABEL"`
+			ResyncPeriod       time.Duration `yaml:"resync_period" env:"CT_TENANT_KUBERNETES_RESYNC_PERIOD"`
+		} `yaml:"kubernetes"`
 	}
 
+	Elasticsearch struct {
+		TenantField    string   `yaml:"tenant_field" env:"CT_ELASTICSEARCH_TENANT_FIELD"`
+		MessageField   string   `yaml:"message_field" env:"CT_ELASTICSEARCH_MESSAGE_FIELD"`
+		TimestampField string   `yaml:"timestamp_field" env:"CT_ELASTICSEARCH_TIMESTAMP_FIELD"`
+		IndexLabel     string   `yaml:"index_label" env:"CT_ELASTICSEARCH_INDEX_LABEL"`
+		LabelFields    []string `yaml:"label_fields" env:"CT_ELASTICSEARCH_LABEL_FIELDS" envSeparator:","`
+		MetadataFields []string `yaml:"metadata_fields" env:"CT_ELASTICSEARCH_METADATA_FIELDS" envSeparator:","`
+	}
+
+	Splunk struct {
+		// HEC token to tenant, an empty tenant means that it's resolved from the labels
+		Tokens map[string]string `yaml:"tokens"`
+	}
+
+	Syslog struct {
+		BatchSize int                    `yaml:"batch_size" env:"CT_SYSLOG_BATCH_SIZE"`
+		BatchWait time.Duration          `yaml:"batch_wait" env:"CT_SYSLOG_BATCH_WAIT"`
+		Listeners []syslogListenerConfig `yaml:"listeners"`
+	}
+
+	// Applied to the timeseries and streams before the tenant lookup
+	RelabelConfigs []*relabel.Config `yaml:"relabel_configs"`
+
+	// Ordered rules which route the timeseries and streams to tenants by label matchers.
+	// If none of them matches then the tenant is extracted from the labels.
+	Routes []routeConfig `yaml:"routes"`
+
+	// Per-tenant settings applied after the tenant is resolved, keyed by the tenant (without the prefix)
+	Tenants map[string]tenantConfig `yaml:"tenants"`
+
+	// Which clients may write to which tenants, the first matching rule applies
+	Authorization struct {
+		Action string                    `yaml:"action" env:"CT_AUTHORIZATION_ACTION"`
+		Rules  []authorizationRuleConfig `yaml:"rules"`
+	} `yaml:"authorization"`
+
+	// Per-source default tenant and access control by the client address, the first matching network applies
+	SourceNetworks struct {
+		TrustedProxies []string              `yaml:"trusted_proxies" env:"CT_SOURCE_NETWORKS_TRUSTED_PROXIES" envSeparator:","`
+		DefaultAction  string                `yaml:"default_action" env:"CT_SOURCE_NETWORKS_DEFAULT_ACTION"`
+		Networks       []sourceNetworkConfig `yaml:"networks"`
+	} `yaml:"source_networks"`
+
 	pipeIn  *fhu.InmemoryListener
 	pipeOut *fhu.InmemoryListener
 }
@@ -129,6 +229,116 @@ func configLoad(file string) (*config, error) {
 		slices.Reverse(cfg.Tenant.LabelList)
 	}
 
+	// Default to the label list for OTLP attributes
+	if len(cfg.Tenant.AttributeList) == 0 {
+		cfg.Tenant.AttributeList = slices.Clone(cfg.Tenant.LabelList)
+	} else {
+		slices.Reverse(cfg.Tenant.AttributeList)
+	}
+
+	if cfg.Tenant.InjectLabel != "" && !model.LabelName(cfg.Tenant.InjectLabel).IsValid() {
+		return nil, fmt.Errorf("invalid tenant.inject_label value: %s", cfg.Tenant.InjectLabel)
+	}
+
+	if cfg.Tenant.InjectLabel != "" && cfg.Tenant.PrefixPreferSource {
+		return nil, fmt.Errorf("tenant.inject_label and tenant.prefix_prefer_source are mutually exclusive")
+	}
+
+	// The injected label would lack the prefix
+	if cfg.Tenant.InjectLabel != "" && cfg.Tenant.Prefix != "" {
+		return nil, fmt.Errorf("tenant.inject_label and tenant.prefix are mutually exclusive")
+	}
+
+	switch cfg.Tenant.URLMode {
+	case "":
+		cfg.Tenant.URLMode = urlModeDefault
+	case urlModeDefault, urlModeOverride:
+	default:
+		return nil, fmt.Errorf("unknown tenant.url_mode value: %s", cfg.Tenant.URLMode)
+	}
+
+	if cfg.Tenant.MappingUnmapped == "" {
+		cfg.Tenant.MappingUnmapped = mappingUnmappedPassthrough
+	}
+
+	if cfg.Tenant.MappingRemote.Interval == 0 {
+		cfg.Tenant.MappingRemote.Interval = time.Minute
+	}
+
+	if cfg.Tenant.MappingRemote.Timeout == 0 {
+		cfg.Tenant.MappingRemote.Timeout = 10 * time.Second
+	}
+
+	if cfg.Tenant.Kubernetes.NamespaceLabel == "" {
+		cfg.Tenant.Kubernetes.NamespaceLabel = "namespace"
+	}
+
+	if cfg.Tenant.Kubernetes.NamespaceAttribute == "" {
+		cfg.Tenant.Kubernetes.NamespaceAttribute = "k8s.namespace.name"
+	}
+
+	if cfg.Tenant.MappingFile != "" && cfg.Tenant.MappingRemote.URL != "" {
+		return nil, fmt.Errorf("tenant.mapping_file and tenant.mapping_remote.url are mutually exclusive")
+	}
+
+	if err := validateClientCertConfig(cfg); err != nil {
+		return nil, err
+	}
+
+	if cfg.Tenant.InjectLabel != "" && cfg.Auth.Ingress.ClientCert.TenantMode == identityTenantModePrefix {
+		return nil, fmt.Errorf("tenant.inject_label can't be used with the prefix auth.ingress.client_cert.tenant_mode")
+	}
+
+	if cfg.Auth.Ingress.Bearer.JWT.JWKSFile != "" && cfg.Auth.Ingress.Bearer.JWT.JWKSURL != "" {
+		return nil, fmt.Errorf("auth.ingress.bearer.jwt.jwks_file and jwks_url are mutually exclusive")
+	}
+
+	if cfg.Auth.Ingress.Bearer.JWT.JWKSRefreshInterval == 0 {
+		cfg.Auth.Ingress.Bearer.JWT.JWKSRefreshInterval = 5 * time.Minute
+	}
+
+	if cfg.Auth.Ingress.Bearer.JWT.IdentityClaim == "" {
+		cfg.Auth.Ingress.Bearer.JWT.IdentityClaim = "sub"
+	}
+
+	if cfg.Auth.Ingress.Basic.MaxFailedAttempts == 0 {
+		cfg.Auth.Ingress.Basic.MaxFailedAttempts = 5
+	} else if cfg.Auth.Ingress.Basic.MaxFailedAttempts < 0 {
+		return nil, fmt.Errorf("auth.ingress.basic.max_failed_attempts must be positive")
+	}
+
+	if cfg.Auth.Ingress.Basic.FailedAttemptsPeriod == 0 {
+		cfg.Auth.Ingress.Basic.FailedAttemptsPeriod = time.Minute
+	}
+
+	switch cfg.Authorization.Action {
+	case "":
+		cfg.Authorization.Action = authorizationActionReject
+	case authorizationActionReject, authorizationActionDrop:
+	default:
+		return nil, fmt.Errorf("unknown authorization.action value: %s", cfg.Authorization.Action)
+	}
+
+	for _, rc := range cfg.Routes {
+		// Would be counted together with the timeseries not matched by any route
+		if rc.Name == routeDefault {
+			return nil, fmt.Errorf("route name '%s' is reserved", routeDefault)
+		}
+	}
+
+	// The rules are checked against the tenants without the prefix, which would be chosen by the client
+	if len(cfg.Authorization.Rules) > 0 && cfg.Tenant.PrefixPreferSource {
+		return nil, fmt.Errorf("authorization.rules and tenant.prefix_prefer_source are mutually exclusive")
+	}
+
+	switch cfg.SourceNetworks.DefaultAction {
+	case "":
+		cfg.SourceNetworks.DefaultAction = sourceNetworkActionAllow
+	case sourceNetworkActionAllow, sourceNetworkActionDeny:
+	default:
+		return nil, fmt.Errorf("unknown source_networks.default_action value: %s", cfg.SourceNetworks.DefaultAction)
+	}
+
 	if cfg.Auth.Egress.Username != "" {
 		if cfg.Auth.Egress.Password == "" {
 			return nil, fmt.Errorf("egress auth user specified, but the password is not")
@@ -139,5 +349,21 @@ func configLoad(file string) (*config, error) {
 		cfg.MaxConnsPerHost = 64
 	}
 
+	if cfg.Elasticsearch.MessageField == "" {
+		cfg.Elasticsearch.MessageField = "message"
+	}
+
+	if cfg.Elasticsearch.TimestampField == "" {
+		cfg.Elasticsearch.TimestampField = "@timestamp"
+	}
+
+	if cfg.Syslog.BatchSize == 0 {
+		cfg.Syslog.BatchSize = 1000
+	}
+
+	if cfg.Syslog.BatchWait == 0 {
+		cfg.Syslog.BatchWait = time.Second
+	}
+
 	return cfg, nil
 }
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	fh "github.com/valyala/fasthttp"
+)
+
+var (
+	metricAlertsBatchesReceived = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "cortex_tenant",
+		Name:      "alerts_batches_received",
+		Help:      "The total number of alerts batches received.",
+	})
+	metricAlertsBatchesReceivedBytes = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "cortex_tenant",
+		Name:      "alerts_batches_received_bytes",
+		Help:      "Size in bytes of alerts batches received.",
+		Buckets:   []float64{0.5, 1, 10, 25, 100, 250, 500, 1000, 5000, 10000, 30000, 300000, 600000, 1800000, 3600000},
+	})
+	metricAlertsReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cortex_tenant",
+		Name:      "alerts_received",
+		Help:      "The total number of alerts received.",
+	}, []string{"tenant"})
+	metricAlertsRequestDurationMilliseconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "cortex_tenant",
+		Name:      "alerts_request_duration_milliseconds",
+		Help:      "HTTP write request duration for tenant-specific alerts in milliseconds, filtered by response code.",
+		Buckets:   []float64{0.5, 1, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000, 30000, 60000, 1800000, 3600000},
+	},
+		[]string{"code", "tenant"},
+	)
+	metricAlertsRequestErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cortex_tenant",
+		Name:      "alerts_request_errors",
+		Help:      "The total number of tenant-specific alerts writes that yielded errors.",
+	}, []string{"tenant"})
+	metricAlertsRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cortex_tenant",
+		Name:      "alerts_requests",
+		Help:      "The total number of tenant-specific alerts writes.",
+	}, []string{"tenant"})
+)
+
+var alertsRequestMetrics = requestMetrics{
+	requests: metricAlertsRequests,
+	errors:   metricAlertsRequestErrors,
+	duration: metricAlertsRequestDurationMilliseconds,
+}
+
+var formatAlertmanager = format{contentType: "application/json"}
+
+// Alertmanager API v2 postable alert. Only the labels are decoded,
+// the rest of the fields are passed through as is.
+type alert map[string]json.RawMessage
+
+func (p *processor) handleAlerts(ctx *fh.RequestCtx) {
+	metricAlertsBatchesReceivedBytes.Observe(float64(ctx.Request.Header.ContentLength()))
+	metricAlertsBatchesReceived.Inc()
+
+	if p.cfg.TargetAlertmanager == "" {
+		ctx.Error("Alertmanager target is not configured", fh.StatusNotFound)
+		return
+	}
+
+	var alertsIn []alert
+	if err := json.Unmarshal(ctx.Request.Body(), &alertsIn); err != nil {
+		ctx.Error(errors.Wrap(err, "Unable to unmarshal JSON").Error(), fh.StatusBadRequest)
+		return
+	}
+
+	if len(alertsIn) == 0 {
+		ctx.Error("No alerts found in the request", fh.StatusBadRequest)
+		return
+	}
+
+	tenantPrefix := p.tenantPrefix(ctx)
+	src := p.sourceTenant(ctx)
+	clientIP := ctx.RemoteAddr()
+	reqID, _ := uuid.NewRandom()
+
+	m, err := p.createAlertsRequests(alertsIn, src)
+	if err != nil {
+		ctx.Error(err.Error(), tenantErrorCode(err))
+		return
+	}
+
+	if err = p.authorize(ctx, src, m); err != nil {
+		ctx.Error(err.Error(), fh.StatusForbidden)
+		return
+	}
+
+	results := p.dispatch(p.cfg.TargetAlertmanager, formatAlertmanager, clientIP, reqID, tenantPrefix, m)
+	p.handleResults(ctx, clientIP, reqID, results, alertsRequestMetrics)
+}
+
+func (p *processor) createAlertsRequests(alertsIn []alert, src sourceTenant) (map[string]func() ([]byte, error), error) {
+	// Group alerts by tenant
+	m := map[string][]alert{}
+
+	for i, a := range alertsIn {
+		tenant := src.tenant
+		if !src.override {
+			var err error
+			if tenant, err = p.processAlertDefault(a, src); err != nil {
+				return nil, fmt.Errorf("alert %d: %w", i, err)
+			}
+		}
+
+		m[tenant] = append(m[tenant], a)
+	}
+
+	// Marshal results
+	resM := make(map[string]func() ([]byte, error), len(m))
+	for tenant, alerts := range m {
+		if p.cfg.MetricsIncludeTenant {
+			metricAlertsReceived.WithLabelValues(tenant).Add(float64(len(alerts)))
+		} else {
+			metricAlertsReceived.WithLabelValues("").Add(float64(len(alerts)))
+		}
+
+		resM[tenant] = func() ([]byte, error) {
+			return json.Marshal(alerts)
+		}
+	}
+
+	return resM, nil
+}
+
+func (p *processor) processAlert(a alert) (tenant string, err error) {
+	return p.processAlertDefault(a, sourceTenant{})
+}
+
+// Same as processAlert, but falls back to the default tenant of the source
+func (p *processor) processAlertDefault(a alert, src sourceTenant) (tenant string, err error) {
+	labels := map[string]string{}
+	if raw, ok := a["labels"]; ok {
+		if err = json.Unmarshal(raw, &labels); err != nil {
+			return "", errors.Wrap(err, "Unable to unmarshal labels")
+		}
+	}
+
+	var used []string
+	if tenant, used, err = p.resolveTenant(func(name string) string {
+		return labels[name]
+	}, src); err != nil {
+		return "", err
+	}
+
+	if p.cfg.Tenant.LabelRemove && len(used) > 0 {
+		for _, l := range used {
+			delete(labels, l)
+		}
+
+		if a["labels"], err = json.Marshal(labels); err != nil {
+			return "", err
+		}
+	}
+
+	return
+}
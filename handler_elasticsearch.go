@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/grafana/loki/v3/pkg/logproto"
+	"github.com/prometheus/prometheus/model/labels"
+	fh "github.com/valyala/fasthttp"
+)
+
+// Single item of the ES bulk response
+type esBulkItem struct {
+	Index  string       `json:"_index,omitempty"`
+	ID     string       `json:"_id,omitempty"`
+	Status int          `json:"status"`
+	Error  *esBulkError `json:"error,omitempty"`
+	action string       // index or create
+	stream int          // Index of the stream in the push request, -1 if the item failed already
+}
+
+type esBulkError struct {
+	Type   string `json:"type"`
+	Reason string `json:"reason"`
+}
+
+type esBulkResponse struct {
+	Took   int64                   `json:"took"`
+	Errors bool                    `json:"errors"`
+	Items  []map[string]esBulkItem `json:"items"`
+}
+
+func (p *processor) handleElasticsearchBulk(ctx *fh.RequestCtx) {
+	start := time.Now()
+
+	metricStreamsBatchesReceivedBytes.Observe(float64(ctx.Request.Header.ContentLength()))
+	metricStreamsBatchesReceived.Inc()
+
+	body := ctx.Request.Body()
+	if bytes.Equal(ctx.Request.Header.ContentEncoding(), []byte("gzip")) {
+		var err error
+		if body, err = ctx.Request.BodyGunzip(); err != nil {
+			esError(ctx, fh.StatusBadRequest, "parse_exception", err.Error())
+			return
+		}
+	}
+
+	wrReqIn, fieldTenants, items, err := p.esBulkToPushRequest(body, start)
+	if err != nil {
+		esError(ctx, fh.StatusBadRequest, "illegal_argument_exception", err.Error())
+		return
+	}
+
+	if len(items) == 0 {
+		esError(ctx, fh.StatusBadRequest, "action_request_validation_exception", "no requests added")
+		return
+	}
+
+	// Resolve the tenants of every stream once, they're needed to report the per-item status
+	tenantPrefix := p.tenantPrefix(ctx)
+	src := p.sourceTenant(ctx)
+	streamTenants := make([][]string, len(wrReqIn.Streams))
+	reqs := map[string]*logproto.PushRequest{}
+
+	for i, s := range wrReqIn.Streams {
+		keep, err := relabelStream(&s, p.relabel)
+		if err == nil && keep {
+			streamSrc := src
+			// The tenant of the document is used as is unless the client is pinned to its own
+			if fieldTenants[i] != "" && !src.override {
+				streamSrc.tenant, streamSrc.override = fieldTenants[i], true
+			}
+
+			streamTenants[i], err = p.streamTenants(nil, &s, streamSrc)
+		}
+
+		if err != nil {
+			// The clients retry the items failed with 503
+			code, typ := tenantErrorCode(err), "mapper_parsing_exception"
+			if code == fh.StatusServiceUnavailable {
+				typ = "unavailable_shards_exception"
+			}
+
+			for j := range items {
+				if items[j].stream == i {
+					items[j].Status, items[j].Error = code, &esBulkError{typ, err.Error()}
+					items[j].stream = -1
+				}
+			}
+
+			continue
+		}
+
+		p.addPushStream(reqs, streamTenants[i], s)
+	}
+
+	tenantResults := map[string]result{}
+	denied := map[string]bool{}
+	if len(reqs) > 0 {
+		clientIP := ctx.RemoteAddr()
+		reqID, _ := uuid.NewRandom()
+
+		m, err := p.marshalPushRequests(reqs)
+		if err != nil {
+			esError(ctx, fh.StatusBadRequest, "illegal_argument_exception", err.Error())
+			return
+		}
+
+		for tenant := range m {
+			denied[tenant] = true
+		}
+
+		if err = p.authorize(ctx, src, m); err != nil {
+			esError(ctx, fh.StatusForbidden, "security_exception", err.Error())
+			return
+		}
+
+		// Only the tenants dropped by the authorization are left
+		for tenant := range m {
+			delete(denied, tenant)
+		}
+
+		results := p.dispatch(p.cfg.TargetLoki, formatLokiPush, clientIP, reqID, tenantPrefix, m)
+		p.recordResults(clientIP, reqID, p.identityName(ctx), results, streamsRequestMetrics)
+
+		for _, r := range results {
+			tenantResults[r.tenant] = r
+		}
+	}
+
+	resp := esBulkResponse{Items: make([]map[string]esBulkItem, len(items))}
+	for i, it := range items {
+		if it.stream != -1 {
+			it.Status = fh.StatusCreated
+
+			// The stream fails if any of its tenants does, the ones dropped by the relabeling have no result
+			for _, tenant := range streamTenants[it.stream] {
+				r, ok := tenantResults[tenantPrefix+tenant]
+
+				switch {
+				case p.cfg.Tenant.AcceptAll:
+				case denied[tenant]:
+					it.Status, it.Error = fh.StatusForbidden, &esBulkError{"security_exception", fmt.Sprintf("tenant '%s' is not allowed for the client", tenant)}
+				case !ok:
+				case r.err != nil:
+					it.Status, it.Error = fh.StatusInternalServerError, &esBulkError{"exception", r.err.Error()}
+				case r.code < 200 || r.code >= 300:
+					it.Status, it.Error = r.code, &esBulkError{"exception", string(r.body)}
+				}
+
+				if it.Error != nil {
+					break
+				}
+			}
+		}
+
+		if it.Error != nil {
+			resp.Errors = true
+		}
+
+		resp.Items[i] = map[string]esBulkItem{it.action: it}
+	}
+
+	resp.Took = time.Since(start).Milliseconds()
+
+	b, _ := json.Marshal(resp)
+	ctx.SetContentType("application/json")
+	ctx.SetBody(b)
+}
+
+// Parses the NDJSON bulk request into Loki streams, also returns the tenant field value of every stream.
+// Only the index and create actions are supported, other actions are reported as failed items.
+func (p *processor) esBulkToPushRequest(body []byte, now time.Time) (*logproto.PushRequest, []string, []esBulkItem, error) {
+	cfg := p.cfg.Elasticsearch
+	sb := newStreamsBuilder()
+	var (
+		items        []esBulkItem
+		fieldTenants []string
+	)
+
+	sc := bufio.NewScanner(bytes.NewReader(body))
+	sc.Buffer(nil, p.srv.MaxRequestBodySize)
+
+	for sc.Scan() {
+		line := bytes.TrimSpace(sc.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		var action map[string]struct {
+			Index string `json:"_index"`
+			ID    string `json:"_id"`
+		}
+
+		if err := json.Unmarshal(line, &action); err != nil || len(action) != 1 {
+			return nil, nil, nil, fmt.Errorf("malformed action/metadata line [%d]", len(items)+1)
+		}
+
+		var it esBulkItem
+		for k, v := range action {
+			it = esBulkItem{Index: v.Index, ID: v.ID, action: k, stream: -1}
+		}
+
+		switch it.action {
+		case "delete":
+			it.Status, it.Error = fh.StatusBadRequest, &esBulkError{"illegal_argument_exception", "delete action is not supported"}
+			items = append(items, it)
+			continue
+		case "index", "create", "update":
+		default:
+			return nil, nil, nil, fmt.Errorf("unknown action [%s]", it.action)
+		}
+
+		if !sc.Scan() {
+			return nil, nil, nil, fmt.Errorf("action [%s] is missing the source", it.action)
+		}
+
+		if it.action == "update" {
+			it.Status, it.Error = fh.StatusBadRequest, &esBulkError{"illegal_argument_exception", "update action is not supported"}
+			items = append(items, it)
+			continue
+		}
+
+		var doc map[string]any
+		if err := json.Unmarshal(sc.Bytes(), &doc); err != nil {
+			it.Status, it.Error = fh.StatusBadRequest, &esBulkError{"mapper_parsing_exception", err.Error()}
+			items = append(items, it)
+			continue
+		}
+
+		lbls, tenant, entry, err := p.esDocToEntry(doc, now)
+		if err != nil {
+			it.Status, it.Error = fh.StatusBadRequest, &esBulkError{"mapper_parsing_exception", err.Error()}
+			items = append(items, it)
+			continue
+		}
+
+		if cfg.IndexLabel != "" && it.Index != "" {
+			b := labels.NewBuilder(lbls)
+			b.Set(cfg.IndexLabel, it.Index)
+			lbls = b.Labels()
+		}
+
+		it.stream = sb.addTenant(tenant, lbls, entry)
+		if it.stream == len(fieldTenants) {
+			fieldTenants = append(fieldTenants, tenant)
+		}
+
+		items = append(items, it)
+	}
+
+	if err := sc.Err(); err != nil {
+		return nil, nil, nil, err
+	}
+
+	return sb.req, fieldTenants, items, nil
+}
+
+// Converts the document into stream labels, the tenant field value and a log entry
+func (p *processor) esDocToEntry(doc map[string]any, now time.Time) (lbls labels.Labels, tenant string, entry logproto.Entry, err error) {
+	cfg := p.cfg.Elasticsearch
+	entry = logproto.Entry{Timestamp: now}
+	b := labels.NewBuilder(labels.EmptyLabels())
+
+	if cfg.TenantField != "" {
+		tenant, _ = esField(doc, cfg.TenantField)
+	}
+
+	for _, f := range cfg.LabelFields {
+		if v, ok := esField(doc, f); ok {
+			b.Set(sanitizeLabelName(f), v)
+		}
+	}
+
+	for _, f := range cfg.MetadataFields {
+		if v, ok := esField(doc, f); ok {
+			entry.StructuredMetadata = append(entry.StructuredMetadata, logproto.LabelAdapter{Name: sanitizeLabelName(f), Value: v})
+		}
+	}
+
+	if v, ok := esField(doc, cfg.TimestampField); ok {
+		ts, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return labels.EmptyLabels(), "", entry, fmt.Errorf("failed to parse field [%s]: %w", cfg.TimestampField, err)
+		}
+
+		entry.Timestamp = ts
+	}
+
+	if v, ok := esField(doc, cfg.MessageField); ok {
+		entry.Line = v
+	} else {
+		// Keep the whole document if there's no message field
+		line, err := json.Marshal(doc)
+		if err != nil {
+			return labels.EmptyLabels(), "", entry, err
+		}
+
+		entry.Line = string(line)
+	}
+
+	if b.Labels().IsEmpty() {
+		// Loki requires at least one label
+		b.Set("job", "elasticsearch")
+	}
+
+	return b.Labels(), tenant, entry, nil
+}
+
+// Looks up the field by its name or by a dotted path into nested objects.
+// Non-string values are JSON-encoded.
+func esField(doc map[string]any, name string) (string, bool) {
+	v, ok := doc[name]
+	if !ok {
+		path := strings.Split(name, ".")
+		v = doc
+
+		for _, k := range path {
+			obj, isObj := v.(map[string]any)
+			if !isObj {
+				return "", false
+			}
+
+			if v, ok = obj[k]; !ok {
+				return "", false
+			}
+		}
+	}
+
+	switch v := v.(type) {
+	case nil:
+		return "", false
+	case string:
+		return v, v != ""
+	default:
+		b, err := json.Marshal(v)
+		return string(b), err == nil
+	}
+}
+
+// Writes an error in the format used by Elasticsearch
+func esError(ctx *fh.RequestCtx, code int, typ, reason string) {
+	b, _ := json.Marshal(map[string]any{
+		"error":  esBulkError{Type: typ, Reason: reason},
+		"status": code,
+	})
+
+	ctx.SetStatusCode(code)
+	ctx.SetContentType("application/json")
+	ctx.SetBody(b)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/textparse"
+	"github.com/prometheus/prometheus/prompb"
+	fh "github.com/valyala/fasthttp"
+)
+
+func (p *processor) handleImport(ctx *fh.RequestCtx) {
+	metricTimeseriesBatchesReceivedBytes.Observe(float64(ctx.Request.Header.ContentLength()))
+	metricTimeseriesBatchesReceived.Inc()
+
+	extraLabels, err := parseExtraLabels(ctx)
+	if err != nil {
+		ctx.Error(err.Error(), fh.StatusBadRequest)
+		return
+	}
+
+	body := ctx.Request.Body()
+	if bytes.Equal(ctx.Request.Header.ContentEncoding(), []byte("gzip")) {
+		if body, err = ctx.Request.BodyGunzip(); err != nil {
+			ctx.Error(err.Error(), fh.StatusBadRequest)
+			return
+		}
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(string(ctx.Request.Header.ContentType()))
+
+	wrReqIn, err := parseExposition(body, mediaType, extraLabels, time.Now())
+	if err != nil {
+		ctx.Error(err.Error(), fh.StatusBadRequest)
+		return
+	}
+
+	if len(wrReqIn.Timeseries) == 0 {
+		ctx.Error("No timeseries found in the request", fh.StatusBadRequest)
+		return
+	}
+
+	tenantPrefix := p.tenantPrefix(ctx)
+	src := p.sourceTenant(ctx)
+	clientIP := ctx.RemoteAddr()
+	reqID, _ := uuid.NewRandom()
+
+	m, err := p.createWriteRequests(wrReqIn, src)
+	if err != nil {
+		ctx.Error(err.Error(), tenantErrorCode(err))
+		return
+	}
+
+	if err = p.authorize(ctx, src, m); err != nil {
+		ctx.Error(err.Error(), fh.StatusForbidden)
+		return
+	}
+
+	results := p.dispatch(p.cfg.Target, formatPromWrite, clientIP, reqID, tenantPrefix, m)
+	p.handleResults(ctx, clientIP, reqID, results, timeseriesRequestMetrics)
+}
+
+// Parses the `extra_label=name=value` query parameters
+func parseExtraLabels(ctx *fh.RequestCtx) (labels.Labels, error) {
+	b := labels.NewBuilder(labels.EmptyLabels())
+
+	for _, v := range ctx.QueryArgs().PeekMulti("extra_label") {
+		name, value, ok := strings.Cut(string(v), "=")
+		if !ok || name == "" {
+			return labels.EmptyLabels(), fmt.Errorf("invalid extra_label %q, must be in name=value format", v)
+		}
+
+		b.Set(name, value)
+	}
+
+	return b.Labels(), nil
+}
+
+// Parses the Prometheus text or OpenMetrics exposition into a write request.
+// Samples without a timestamp get the current time.
+func parseExposition(body []byte, mediaType string, extraLabels labels.Labels, now time.Time) (*prompb.WriteRequest, error) {
+	var parser textparse.Parser
+	if mediaType == "application/openmetrics-text" {
+		// The format requires the terminator, but it's easy to omit when pushing by hand
+		if !bytes.HasSuffix(bytes.TrimRight(body, "\n"), []byte("# EOF")) {
+			body = append(append([]byte{}, body...), []byte("# EOF\n")...)
+		}
+
+		parser = textparse.NewOpenMetricsParser(body, labels.NewSymbolTable())
+	} else {
+		parser = textparse.NewPromParser(body, labels.NewSymbolTable())
+	}
+
+	wrReq := &prompb.WriteRequest{}
+	var lbls labels.Labels
+
+	for {
+		entry, err := parser.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse exposition: %w", err)
+		}
+
+		if entry != textparse.EntrySeries {
+			continue
+		}
+
+		_, ts, v := parser.Series()
+		parser.Metric(&lbls)
+
+		sample := prompb.Sample{Value: v, Timestamp: now.UnixMilli()}
+		if ts != nil {
+			sample.Timestamp = *ts
+		}
+
+		b := labels.NewBuilder(lbls)
+		extraLabels.Range(func(l labels.Label) {
+			b.Set(l.Name, l.Value)
+		})
+
+		var pbLabels []prompb.Label
+		b.Labels().Range(func(l labels.Label) {
+			pbLabels = append(pbLabels, prompb.Label{Name: l.Name, Value: l.Value})
+		})
+
+		wrReq.Timeseries = append(wrReq.Timeseries, prompb.TimeSeries{
+			Labels:  pbLabels,
+			Samples: []prompb.Sample{sample},
+		})
+	}
+
+	return wrReq, nil
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/prometheus/prometheus/prompb"
+	fh "github.com/valyala/fasthttp"
+)
+
+// Multipliers to convert the timestamp of a given precision into nanoseconds
+var influxPrecisions = map[string]int64{
+	"":   1,
+	"n":  1,
+	"ns": 1,
+	"u":  int64(time.Microsecond),
+	"us": int64(time.Microsecond),
+	"ms": int64(time.Millisecond),
+	"s":  int64(time.Second),
+	"m":  int64(time.Minute),
+	"h":  int64(time.Hour),
+}
+
+type influxField struct {
+	key   string
+	value float64
+}
+
+type influxPoint struct {
+	measurement string
+	tags        []prompb.Label
+	fields      []influxField
+	timestamp   int64 // Nanoseconds, zero if not specified
+}
+
+func (p *processor) handleInflux(ctx *fh.RequestCtx) {
+	metricTimeseriesBatchesReceivedBytes.Observe(float64(ctx.Request.Header.ContentLength()))
+	metricTimeseriesBatchesReceived.Inc()
+
+	v2 := bytes.Equal(ctx.Path(), []byte("/api/v2/write"))
+
+	precision, ok := influxPrecisions[string(ctx.QueryArgs().Peek("precision"))]
+	if !ok {
+		influxError(ctx, v2, fh.StatusBadRequest, fmt.Sprintf("invalid precision %q", ctx.QueryArgs().Peek("precision")))
+		return
+	}
+
+	body := ctx.Request.Body()
+	if bytes.Equal(ctx.Request.Header.ContentEncoding(), []byte("gzip")) {
+		var err error
+		if body, err = ctx.Request.BodyGunzip(); err != nil {
+			influxError(ctx, v2, fh.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	wrReqIn, parseErrs := influxToWriteRequest(body, precision, time.Now())
+	if len(wrReqIn.Timeseries) == 0 {
+		if len(parseErrs) > 0 {
+			influxError(ctx, v2, fh.StatusBadRequest, strings.Join(parseErrs, "\n"))
+			return
+		}
+
+		ctx.SetStatusCode(fh.StatusNoContent)
+		return
+	}
+
+	tenantPrefix := p.tenantPrefix(ctx)
+	src := p.sourceTenant(ctx)
+	clientIP := ctx.RemoteAddr()
+	reqID, _ := uuid.NewRandom()
+
+	m, err := p.createWriteRequests(wrReqIn, src)
+	if err != nil {
+		influxError(ctx, v2, tenantErrorCode(err), err.Error())
+		return
+	}
+
+	if err = p.authorize(ctx, src, m); err != nil {
+		influxError(ctx, v2, fh.StatusForbidden, err.Error())
+		return
+	}
+
+	results := p.dispatch(p.cfg.Target, formatPromWrite, clientIP, reqID, tenantPrefix, m)
+	if !p.handleResults(ctx, clientIP, reqID, results, timeseriesRequestMetrics) {
+		return
+	}
+
+	if ctx.Response.StatusCode() >= 300 {
+		return
+	}
+
+	// Valid lines were written, report the rest as a partial write
+	if len(parseErrs) > 0 {
+		influxError(ctx, v2, fh.StatusBadRequest, "partial write: "+strings.Join(parseErrs, "\n"))
+		return
+	}
+
+	ctx.ResetBody()
+	ctx.SetStatusCode(fh.StatusNoContent)
+}
+
+// Writes an error in the format used by InfluxDB 1.x or 2.x
+func influxError(ctx *fh.RequestCtx, v2 bool, code int, msg string) {
+	var resp any = map[string]string{"error": msg}
+	if v2 {
+		resp = map[string]string{"code": "invalid", "message": msg}
+	}
+
+	b, _ := json.Marshal(resp)
+	ctx.SetStatusCode(code)
+	ctx.SetContentType("application/json")
+	ctx.SetBody(b)
+}
+
+// Converts the line protocol into a write request, each numeric field becomes
+// a separate `measurement_field` timeseries with tags as labels.
+// String fields are skipped. Returns the errors for the lines that failed to parse.
+func influxToWriteRequest(body []byte, precision int64, now time.Time) (*prompb.WriteRequest, []string) {
+	wrReq := &prompb.WriteRequest{}
+	var errs []string
+
+	for n, line := range bytes.Split(body, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		pt, err := parseInfluxLine(string(line))
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("line %d: unable to parse '%s': %s", n+1, line, err))
+			continue
+		}
+
+		ts := now.UnixMilli()
+		if pt.timestamp != 0 {
+			// Would overflow when converted to nanoseconds
+			if pt.timestamp > math.MaxInt64/precision || pt.timestamp < math.MinInt64/precision {
+				errs = append(errs, fmt.Sprintf("line %d: unable to parse '%s': timestamp %d is out of range", n+1, line, pt.timestamp))
+				continue
+			}
+
+			ts = pt.timestamp * precision / int64(time.Millisecond)
+		}
+
+		for _, f := range pt.fields {
+			labels := make([]prompb.Label, 0, len(pt.tags)+1)
+			labels = append(labels, prompb.Label{
+				Name:  "__name__",
+				Value: sanitizeMetricName(pt.measurement + "_" + f.key),
+			})
+			labels = append(labels, pt.tags...)
+
+			sort.Slice(labels, func(i, j int) bool {
+				return labels[i].Name < labels[j].Name
+			})
+
+			wrReq.Timeseries = append(wrReq.Timeseries, prompb.TimeSeries{
+				Labels:  labels,
+				Samples: []prompb.Sample{{Value: f.value, Timestamp: ts}},
+			})
+		}
+	}
+
+	return wrReq, errs
+}
+
+// Parses a single line in the format:
+// measurement[,tag=value...] field=value[,field=value...] [timestamp]
+func parseInfluxLine(line string) (pt influxPoint, err error) {
+	keyEnd := indexUnescaped(line, ' ', false)
+	if keyEnd == -1 {
+		return pt, fmt.Errorf("missing fields")
+	}
+
+	key, rest := line[:keyEnd], strings.TrimLeft(line[keyEnd+1:], " ")
+
+	fieldsEnd := indexUnescaped(rest, ' ', true)
+	fields, timestamp := rest, ""
+	if fieldsEnd != -1 {
+		fields, timestamp = rest[:fieldsEnd], strings.TrimSpace(rest[fieldsEnd+1:])
+	}
+
+	keyParts := splitUnescaped(key, ',', false)
+	if pt.measurement = unescapeInflux(keyParts[0]); pt.measurement == "" {
+		return pt, fmt.Errorf("missing measurement")
+	}
+
+	for _, tag := range keyParts[1:] {
+		i := indexUnescaped(tag, '=', false)
+		if i == -1 {
+			return pt, fmt.Errorf("missing tag value")
+		}
+
+		name := sanitizeLabelName(unescapeInflux(tag[:i]))
+		// Would clash with the metric name built from the measurement and the field
+		if name == "__name__" {
+			return pt, fmt.Errorf("tag name __name__ is reserved")
+		}
+
+		pt.tags = append(pt.tags, prompb.Label{
+			Name:  name,
+			Value: unescapeInflux(tag[i+1:]),
+		})
+	}
+
+	if fields == "" {
+		return pt, fmt.Errorf("missing fields")
+	}
+
+	for _, field := range splitUnescaped(fields, ',', true) {
+		i := indexUnescaped(field, '=', false)
+		if i == -1 {
+			return pt, fmt.Errorf("missing field value")
+		}
+
+		v, numeric, err := parseInfluxFieldValue(field[i+1:])
+		if err != nil {
+			return pt, fmt.Errorf("invalid field %s: %w", field[:i], err)
+		}
+
+		if !numeric {
+			continue
+		}
+
+		pt.fields = append(pt.fields, influxField{
+			key:   unescapeInflux(field[:i]),
+			value: v,
+		})
+	}
+
+	if timestamp != "" {
+		if pt.timestamp, err = strconv.ParseInt(timestamp, 10, 64); err != nil {
+			return pt, fmt.Errorf("invalid timestamp %s", timestamp)
+		}
+	}
+
+	return pt, nil
+}
+
+// Parses the field value, returns false if it's a string
+func parseInfluxFieldValue(v string) (float64, bool, error) {
+	switch {
+	case v == "":
+		return 0, false, fmt.Errorf("empty value")
+	case v[0] == '"':
+		if len(v) < 2 || v[len(v)-1] != '"' {
+			return 0, false, fmt.Errorf("unterminated string")
+		}
+
+		return 0, false, nil
+	}
+
+	switch v {
+	case "t", "T", "true", "True", "TRUE":
+		return 1, true, nil
+	case "f", "F", "false", "False", "FALSE":
+		return 0, true, nil
+	}
+
+	switch v[len(v)-1] {
+	case 'i':
+		n, err := strconv.ParseInt(v[:len(v)-1], 10, 64)
+		return float64(n), true, err
+	case 'u':
+		n, err := strconv.ParseUint(v[:len(v)-1], 10, 64)
+		return float64(n), true, err
+	}
+
+	f, err := strconv.ParseFloat(v, 64)
+	if err == nil && (math.IsNaN(f) || math.IsInf(f, 0)) {
+		return 0, false, fmt.Errorf("invalid number %s", v)
+	}
+
+	return f, true, err
+}
+
+// Returns the index of the first occurrence of sep which is not escaped
+// with a backslash and, if quotes is true, is not inside a double-quoted string
+func indexUnescaped(s string, sep byte, quotes bool) int {
+	inQuote := false
+
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\':
+			i++
+		case quotes && c == '"':
+			inQuote = !inQuote
+		case c == sep && !inQuote:
+			return i
+		}
+	}
+
+	return -1
+}
+
+func splitUnescaped(s string, sep byte, quotes bool) (parts []string) {
+	for {
+		i := indexUnescaped(s, sep, quotes)
+		if i == -1 {
+			return append(parts, s)
+		}
+
+		parts = append(parts, s[:i])
+		s = s[i+1:]
+	}
+}
+
+var influxUnescaper = strings.NewReplacer(`\,`, `,`, `\=`, `=`, `\ `, ` `, `\"`, `"`, `\\`, `\`)
+
+func unescapeInflux(s string) string {
+	return influxUnescaper.Replace(s)
+}
+
+// Replaces the characters not allowed in Prometheus metric names with underscores
+func sanitizeMetricName(s string) string {
+	return sanitizeName(s, true)
+}
+
+// Replaces the characters not allowed in Prometheus label names with underscores
+func sanitizeLabelName(s string) string {
+	return sanitizeName(s, false)
+}
+
+func sanitizeName(s string, colons bool) string {
+	b := []byte(s)
+
+	for i, c := range b {
+		valid := c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') ||
+			(colons && c == ':') || (i > 0 && c >= '0' && c <= '9')
+
+		if !valid {
+			b[i] = '_'
+		}
+	}
+
+	return string(b)
+}
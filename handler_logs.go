@@ -3,7 +3,6 @@ package main
 import (
 	"bytes"
 	"fmt"
-	"strconv"
 	"strings"
 
 	"github.com/gogo/protobuf/proto"
@@ -11,10 +10,10 @@ import (
 	"github.com/google/uuid"
 	"github.com/grafana/loki/v3/pkg/logproto"
 	lokiunmarshal "github.com/grafana/loki/v3/pkg/util/unmarshal"
-	me "github.com/hashicorp/go-multierror"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/promql/parser"
 	fh "github.com/valyala/fasthttp"
 )
@@ -56,6 +55,12 @@ var (
 	}, []string{"tenant"})
 )
 
+var streamsRequestMetrics = requestMetrics{
+	requests: metricStreamsRequests,
+	errors:   metricStreamsRequestErrors,
+	duration: metricStreamsRequestDurationMilliseconds,
+}
+
 func (p *processor) handleLogs(ctx *fh.RequestCtx) {
 	metricStreamsBatchesReceivedBytes.Observe(float64(ctx.Request.Header.ContentLength()))
 	metricStreamsBatchesReceived.Inc()
@@ -82,15 +87,8 @@ func (p *processor) handleLogs(ctx *fh.RequestCtx) {
 		return
 	}
 
-	tenantPrefix := p.cfg.Tenant.Prefix
-
-	if p.cfg.Tenant.PrefixPreferSource {
-		sourceTenantPrefix := string(ctx.Request.Header.Peek(p.cfg.Tenant.Header))
-		if sourceTenantPrefix != "" {
-			tenantPrefix = sourceTenantPrefix + "-"
-		}
-	}
-
+	tenantPrefix := p.tenantPrefix(ctx)
+	src := p.sourceTenant(ctx)
 	clientIP := ctx.RemoteAddr()
 	reqID, _ := uuid.NewRandom()
 
@@ -99,72 +97,50 @@ func (p *processor) handleLogs(ctx *fh.RequestCtx) {
 		return
 	}
 
-	m, err := p.createPushRequests(wrReqIn)
+	m, err := p.createPushRequests(wrReqIn, src)
 	if err != nil {
-		ctx.Error(err.Error(), fh.StatusBadRequest)
+		ctx.Error(err.Error(), tenantErrorCode(err))
 		return
 	}
 
-	metricTenant := ""
-	var errs *me.Error
-	results := p.dispatch(p.cfg.TargetLoki, clientIP, reqID, tenantPrefix, m)
-
-	code, body := 0, []byte("Ok")
-
-	// Return 204 regardless of errors if AcceptAll is enabled
-	if p.cfg.Tenant.AcceptAll {
-		code, body = 204, nil
-		goto out
+	if err = p.authorize(ctx, src, m); err != nil {
+		ctx.Error(err.Error(), fh.StatusForbidden)
+		return
 	}
 
-	for _, r := range results {
-		if p.cfg.MetricsIncludeTenant {
-			metricTenant = r.tenant
-		}
+	results := p.dispatch(p.cfg.TargetLoki, formatLokiPush, clientIP, reqID, tenantPrefix, m)
+	p.handleResults(ctx, clientIP, reqID, results, streamsRequestMetrics)
+}
 
-		metricStreamsRequests.WithLabelValues(metricTenant).Inc()
+func (p *processor) createPushRequests(wrReqIn *logproto.PushRequest, src sourceTenant) (map[string]func() ([]byte, error), error) {
+	// Create per-tenant push requests
+	m := map[string]*logproto.PushRequest{}
 
-		if r.err != nil {
-			metricStreamsRequestErrors.WithLabelValues(metricTenant).Inc()
-			errs = me.Append(errs, r.err)
-			p.Errorf("src=%s %s", clientIP, r.err)
-			continue
-		}
+	var tenants []string
 
-		if r.code < 200 || r.code >= 300 {
-			if p.cfg.LogResponseErrors {
-				p.Errorf("src=%s req_id=%s HTTP code %d (%s)", clientIP, reqID, r.code, string(r.body))
-			}
+	for _, s := range wrReqIn.Streams {
+		keep, err := relabelStream(&s, p.relabel)
+		if err != nil {
+			return nil, err
 		}
 
-		if r.code > code {
-			code, body = r.code, r.body
+		if !keep {
+			continue
 		}
 
-		metricStreamsRequestDurationMilliseconds.WithLabelValues(strconv.Itoa(r.code), metricTenant).Observe(r.duration)
-	}
+		if tenants, err = p.streamTenants(tenants[:0], &s, src); err != nil {
+			return nil, err
+		}
 
-	if errs.ErrorOrNil() != nil {
-		ctx.Error(errs.Error(), fh.StatusInternalServerError)
-		return
+		p.addPushStream(m, tenants, s)
 	}
 
-out:
-	// Pass back max status code from upstream response
-	ctx.SetBody(body)
-	ctx.SetStatusCode(code)
+	return p.marshalPushRequests(m)
 }
 
-func (p *processor) createPushRequests(wrReqIn *logproto.PushRequest) (map[string]func() ([]byte, error), error) {
-	// Create per-tenant push requests
-	m := map[string]*logproto.PushRequest{}
-
-	for _, s := range wrReqIn.Streams {
-		tenant, err := p.processStream(&s)
-		if err != nil {
-			return nil, err
-		}
-
+// Adds the stream to the push requests of the tenants
+func (p *processor) addPushStream(m map[string]*logproto.PushRequest, tenants []string, s logproto.Stream) {
+	for _, tenant := range tenants {
 		if p.cfg.MetricsIncludeTenant {
 			metricStreamsReceived.WithLabelValues(tenant).Inc()
 		} else {
@@ -179,10 +155,20 @@ func (p *processor) createPushRequests(wrReqIn *logproto.PushRequest) (map[strin
 
 		wrReqOut.Streams = append(wrReqOut.Streams, s)
 	}
+}
 
-	// Marshal results
+// Applies the per-tenant rules and marshals the push requests, the tenants without streams left are skipped
+func (p *processor) marshalPushRequests(m map[string]*logproto.PushRequest) (map[string]func() ([]byte, error), error) {
 	resM := make(map[string]func() ([]byte, error), len(m))
 	for tenant, wrReqOut := range m {
+		if err := p.tenantRelabelPush(tenant, wrReqOut); err != nil {
+			return nil, err
+		}
+
+		if len(wrReqOut.Streams) == 0 {
+			continue
+		}
+
 		resM[tenant] = func() ([]byte, error) {
 			return p.marshalLokiPush(wrReqOut)
 		}
@@ -218,21 +204,49 @@ func (p *processor) unmarshalLokiPushJson(b []byte) (*logproto.PushRequest, erro
 }
 
 func (p *processor) processStream(s *logproto.Stream) (tenant string, err error) {
-	labels, err := streamLabels(s)
-	if err != nil {
-		return "", err
+	return p.processStreamDefault(s, sourceTenant{})
+}
+
+// Returns the tenants of the stream from the routes or, if none matched, from the labels
+func (p *processor) streamTenants(tenants []string, s *logproto.Stream, src sourceTenant) ([]string, error) {
+	if src.override {
+		return append(tenants, src.tenant), nil
 	}
-	tenant = findMatchingLabelValue(labels, p.cfg.Tenant.LabelList)
-	if tenant != "" {
-		return
+
+	if len(p.routes) > 0 {
+		labels, err := streamLabels(s)
+		if err != nil {
+			return nil, err
+		}
+
+		tenants = p.routeTenants(tenants, func(name string) string {
+			return findMatchingLabelValue(labels, []string{name})
+		})
+
+		if len(tenants) > 0 {
+			return tenants, nil
+		}
 	}
 
-	// Fallback to default tenant if configured
-	if p.cfg.Tenant.Default == "" {
-		return "", fmt.Errorf("label(s): {'%s'} not found, actual values: %v", strings.Join(p.cfg.Tenant.LabelList, "','"), labels)
+	tenant, err := p.processStreamDefault(s, src)
+	if err != nil {
+		return nil, err
 	}
 
-	return p.cfg.Tenant.Default, nil
+	return append(tenants, tenant), nil
+}
+
+// Same as processStream, but falls back to the default tenant of the source
+func (p *processor) processStreamDefault(s *logproto.Stream, src sourceTenant) (tenant string, err error) {
+	labels, err := streamLabels(s)
+	if err != nil {
+		return "", err
+	}
+
+	tenant, _, err = p.resolveTenant(func(name string) string {
+		return findMatchingLabelValue(labels, []string{name})
+	}, src)
+	return
 }
 
 func findMatchingLabelValue(labels []logproto.LabelAdapter, configuredLabels []string) string {
@@ -300,3 +314,36 @@ func decodeRequestBodyAndContentType(ctx *fh.RequestCtx) (body []byte, contentTy
 	}
 	return body, contentTypeStr, nil
 }
+
+// Groups entries into streams by their labels
+type streamsBuilder struct {
+	req     *logproto.PushRequest
+	streams map[string]int
+}
+
+func newStreamsBuilder() *streamsBuilder {
+	return &streamsBuilder{
+		req:     &logproto.PushRequest{},
+		streams: map[string]int{},
+	}
+}
+
+// Returns the index of the stream the entry was added to
+func (b *streamsBuilder) add(lbls labels.Labels, e logproto.Entry) int {
+	return b.addTenant("", lbls, e)
+}
+
+// Same as add but the streams with the same labels of different tenants are kept apart
+func (b *streamsBuilder) addTenant(tenant string, lbls labels.Labels, e logproto.Entry) int {
+	key := tenant + "\xff" + lbls.String()
+
+	idx, ok := b.streams[key]
+	if !ok {
+		idx = len(b.req.Streams)
+		b.streams[key] = idx
+		b.req.Streams = append(b.req.Streams, logproto.Stream{Labels: lbls.String()})
+	}
+
+	b.req.Streams[idx].Entries = append(b.req.Streams[idx].Entries, e)
+	return idx
+}
@@ -2,13 +2,12 @@ package main
 
 import (
 	"fmt"
-	"strconv"
-	"strings"
+	"mime"
+	"slices"
 
 	"github.com/gogo/protobuf/proto"
 	"github.com/golang/snappy"
 	"github.com/google/uuid"
-	me "github.com/hashicorp/go-multierror"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
@@ -53,35 +52,54 @@ var (
 	}, []string{"tenant"})
 )
 
+var timeseriesRequestMetrics = requestMetrics{
+	requests: metricTimeseriesRequests,
+	errors:   metricTimeseriesRequestErrors,
+	duration: metricTimeseriesRequestDurationMilliseconds,
+}
+
 func (p *processor) handleMetrics(ctx *fh.RequestCtx) {
 	metricTimeseriesBatchesReceivedBytes.Observe(float64(ctx.Request.Header.ContentLength()))
 	metricTimeseriesBatchesReceived.Inc()
-	wrReqIn, err := p.unmarshalPromWrite(ctx.Request.Body())
+
+	protoMsg, err := remoteWriteProto(ctx)
 	if err != nil {
-		ctx.Error(err.Error(), fh.StatusBadRequest)
+		ctx.Error(err.Error(), fh.StatusUnsupportedMediaType)
 		return
 	}
 
-	tenantPrefix := p.cfg.Tenant.Prefix
+	if protoMsg == remoteWriteProtoV2 {
+		p.handleMetricsV2(ctx)
+		return
+	}
 
-	if p.cfg.Tenant.PrefixPreferSource {
-		sourceTenantPrefix := string(ctx.Request.Header.Peek(p.cfg.Tenant.Header))
-		if sourceTenantPrefix != "" {
-			tenantPrefix = sourceTenantPrefix + "-"
-		}
+	wrReqIn, err := p.unmarshalPromWrite(ctx.Request.Body())
+	if err != nil {
+		ctx.Error(err.Error(), fh.StatusBadRequest)
+		return
 	}
 
+	tenantPrefix := p.tenantPrefix(ctx)
+	src := p.sourceTenant(ctx)
 	clientIP := ctx.RemoteAddr()
 	reqID, _ := uuid.NewRandom()
 
 	if len(wrReqIn.Timeseries) == 0 {
 		// If there's metadata - just accept the request and drop it
 		if len(wrReqIn.Metadata) > 0 {
-			if p.cfg.Metadata && p.cfg.Tenant.Default != "" {
-				r := p.send(p.cfg.Target, clientIP, reqID, tenantPrefix+p.cfg.Tenant.Default, wrReqIn.Marshal)
+			if defaultTenant := p.sourceDefaultTenant(src); p.cfg.Metadata && defaultTenant != "" {
+				if !p.tenantAllowed(ctx, src, p.authorizationRule(ctx), defaultTenant) {
+					if p.cfg.Authorization.Action == authorizationActionReject {
+						ctx.Error(fmt.Sprintf("tenant '%s' is not allowed for the client", defaultTenant), fh.StatusForbidden)
+					}
+
+					return
+				}
+
+				r := p.send(p.cfg.Target, formatPromWrite, clientIP, reqID, tenantPrefix+defaultTenant, wrReqIn.Marshal)
 				if r.err != nil {
 					ctx.Error(r.err.Error(), fh.StatusInternalServerError)
-					p.Errorf("src=%s req_id=%s: unable to proxy metadata: %s", clientIP, reqID, r.err)
+					p.Errorf("src=%s req_id=%s: unable to proxy metadata: %s", logSource(clientIP, p.identityName(ctx)), reqID, r.err)
 					return
 				}
 				ctx.SetStatusCode(r.code)
@@ -95,90 +113,84 @@ func (p *processor) handleMetrics(ctx *fh.RequestCtx) {
 		return
 	}
 
-	m, err := p.createWriteRequests(wrReqIn)
+	m, err := p.createWriteRequests(wrReqIn, src)
 	if err != nil {
-		ctx.Error(err.Error(), fh.StatusBadRequest)
+		ctx.Error(err.Error(), tenantErrorCode(err))
 		return
 	}
 
-	metricTenant := ""
-	var errs *me.Error
-	results := p.dispatch(p.cfg.Target, clientIP, reqID, tenantPrefix, m)
-
-	code, body := 0, []byte("Ok")
-
-	// Return 204 regardless of errors if AcceptAll is enabled
-	if p.cfg.Tenant.AcceptAll {
-		code, body = 204, nil
-		goto out
+	if err = p.authorize(ctx, src, m); err != nil {
+		ctx.Error(err.Error(), fh.StatusForbidden)
+		return
 	}
 
-	for _, r := range results {
-		if p.cfg.MetricsIncludeTenant {
-			metricTenant = r.tenant
-		}
-
-		metricTimeseriesRequests.WithLabelValues(metricTenant).Inc()
-
-		if r.err != nil {
-			metricTimeseriesRequestErrors.WithLabelValues(metricTenant).Inc()
-			errs = me.Append(errs, r.err)
-			p.Errorf("src=%s %s", clientIP, r.err)
-			continue
-		}
-
-		if r.code < 200 || r.code >= 300 {
-			if p.cfg.LogResponseErrors {
-				p.Errorf("src=%s req_id=%s HTTP code %d (%s)", clientIP, reqID, r.code, string(r.body))
-			}
-		}
-
-		if r.code > code {
-			code, body = r.code, r.body
-		}
+	results := p.dispatch(p.cfg.Target, formatPromWrite, clientIP, reqID, tenantPrefix, m)
+	p.handleResults(ctx, clientIP, reqID, results, timeseriesRequestMetrics)
+}
 
-		metricTimeseriesRequestDurationMilliseconds.WithLabelValues(strconv.Itoa(r.code), metricTenant).Observe(r.duration)
+// Returns the protobuf message name of the remote write request
+// as negotiated by the Content-Type header.
+// Anything but an explicit proto parameter is treated as 1.0 for compatibility
+// with older senders that don't set the Content-Type properly.
+func remoteWriteProto(ctx *fh.RequestCtx) (string, error) {
+	_, params, err := mime.ParseMediaType(string(ctx.Request.Header.ContentType()))
+	if err != nil {
+		return remoteWriteProtoV1, nil
 	}
 
-	if errs.ErrorOrNil() != nil {
-		ctx.Error(errs.Error(), fh.StatusInternalServerError)
-		return
+	switch params["proto"] {
+	case "", remoteWriteProtoV1:
+		return remoteWriteProtoV1, nil
+	case remoteWriteProtoV2:
+		return remoteWriteProtoV2, nil
 	}
 
-out:
-	// Pass back max status code from upstream response
-	ctx.SetBody(body)
-	ctx.SetStatusCode(code)
+	return "", fmt.Errorf("unsupported remote write protobuf message %s", params["proto"])
 }
 
-func (p *processor) createWriteRequests(wrReqIn *prompb.WriteRequest) (map[string]func() ([]byte, error), error) {
+func (p *processor) createWriteRequests(wrReqIn *prompb.WriteRequest, src sourceTenant) (map[string]func() ([]byte, error), error) {
 	// Create per-tenant write requests
 	m := map[string]*prompb.WriteRequest{}
 
+	var (
+		tenants []string
+		err     error
+	)
+
 	for _, ts := range wrReqIn.Timeseries {
-		tenant, err := p.processTimeseries(&ts)
-		if err != nil {
-			return nil, err
+		if !relabelTimeseries(&ts, p.relabel) {
+			continue
 		}
 
-		if p.cfg.MetricsIncludeTenant {
-			metricTimeseriesReceived.WithLabelValues(tenant).Inc()
-		} else {
-			metricTimeseriesReceived.WithLabelValues("").Inc()
+		if tenants, err = p.timeseriesTenants(tenants[:0], &ts, src); err != nil {
+			return nil, err
 		}
 
-		wrReqOut, ok := m[tenant]
-		if !ok {
-			wrReqOut = &prompb.WriteRequest{}
-			m[tenant] = wrReqOut
-		}
+		for _, tenant := range tenants {
+			if p.cfg.MetricsIncludeTenant {
+				metricTimeseriesReceived.WithLabelValues(tenant).Inc()
+			} else {
+				metricTimeseriesReceived.WithLabelValues("").Inc()
+			}
+
+			wrReqOut, ok := m[tenant]
+			if !ok {
+				wrReqOut = &prompb.WriteRequest{}
+				m[tenant] = wrReqOut
+			}
 
-		wrReqOut.Timeseries = append(wrReqOut.Timeseries, ts)
+			wrReqOut.Timeseries = append(wrReqOut.Timeseries, ts)
+		}
 	}
 
 	// Marshal results
 	resM := make(map[string]func() ([]byte, error), len(m))
 	for tenant, wrReqOut := range m {
+		p.tenantRelabelWrite(tenant, wrReqOut)
+		if len(wrReqOut.Timeseries) == 0 {
+			continue
+		}
+
 		resM[tenant] = func() ([]byte, error) { // func so err results can be collected in send/dispatch per tenant
 			return p.marshalPromWrite(wrReqOut)
 		}
@@ -217,33 +229,63 @@ func removeOrdered(slice []prompb.Label, s int) []prompb.Label {
 	return append(slice[:s], slice[s+1:]...)
 }
 
-func (p *processor) processTimeseries(ts *prompb.TimeSeries) (tenant string, err error) {
-	idx := 0
-
-outer:
-	for i, l := range ts.Labels {
-		for _, configuredLabel := range p.cfg.Tenant.LabelList {
-			if l.Name == configuredLabel {
-				tenant, idx = l.Value, i
-				break outer // LabelList is reversed so last entry from config is still preferred
-			}
+// Returns the tenants of the timeseries from the routes or, if none matched, from the labels
+func (p *processor) timeseriesTenants(tenants []string, ts *prompb.TimeSeries, src sourceTenant) ([]string, error) {
+	if src.override {
+		return append(tenants, src.tenant), nil
+	}
+
+	if len(p.routes) > 0 {
+		tenants = p.routeTenants(tenants, func(name string) string {
+			return promLabelValue(ts.Labels, name)
+		})
+
+		if len(tenants) > 0 {
+			return tenants, nil
 		}
 	}
 
-	if tenant == "" {
-		if p.cfg.Tenant.Default == "" {
-			return "", fmt.Errorf("label(s): {'%s'} not found", strings.Join(p.cfg.Tenant.LabelList, "','"))
+	tenant, err := p.processTimeseriesDefault(ts, src)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(tenants, tenant), nil
+}
+
+func promLabelValue(lbls []prompb.Label, name string) string {
+	for _, l := range lbls {
+		if l.Name == name {
+			return l.Value
 		}
+	}
 
-		return p.cfg.Tenant.Default, nil
+	return ""
+}
+
+func (p *processor) processTimeseries(ts *prompb.TimeSeries) (tenant string, err error) {
+	return p.processTimeseriesDefault(ts, sourceTenant{})
+}
+
+// Same as processTimeseries, but falls back to the default tenant of the source
+func (p *processor) processTimeseriesDefault(ts *prompb.TimeSeries, src sourceTenant) (tenant string, err error) {
+	tenant, used, err := p.resolveTenant(func(name string) string {
+		return promLabelValue(ts.Labels, name)
+	}, src)
+	if err != nil {
+		return "", err
 	}
 
 	if p.cfg.Tenant.LabelRemove {
-		// Order is important. See:
-		// https://github.com/thanos-io/thanos/issues/6452
-		// https://github.com/prometheus/prometheus/issues/11505
-		ts.Labels = removeOrdered(ts.Labels, idx)
+		for _, name := range used {
+			if idx := slices.IndexFunc(ts.Labels, func(l prompb.Label) bool { return l.Name == name }); idx != -1 {
+				// Order is important. See:
+				// https://github.com/thanos-io/thanos/issues/6452
+				// https://github.com/prometheus/prometheus/issues/11505
+				ts.Labels = removeOrdered(ts.Labels, idx)
+			}
+		}
 	}
 
-	return
+	return tenant, nil
 }
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	writev2 "github.com/prometheus/prometheus/prompb/io/prometheus/write/v2"
+	fh "github.com/valyala/fasthttp"
+)
+
+const (
+	remoteWriteProtoV1 = "prometheus.WriteRequest"
+	remoteWriteProtoV2 = "io.prometheus.write.v2.Request"
+)
+
+// Response headers which report the amount of data written by the receiver.
+// Those are summed up across all tenants.
+var remoteWriteWrittenHeaders = []string{
+	"X-Prometheus-Remote-Write-Samples-Written",
+	"X-Prometheus-Remote-Write-Histograms-Written",
+	"X-Prometheus-Remote-Write-Exemplars-Written",
+}
+
+func (p *processor) handleMetricsV2(ctx *fh.RequestCtx) {
+	wrReqIn, err := p.unmarshalPromWriteV2(ctx.Request.Body())
+	if err != nil {
+		ctx.Error(err.Error(), fh.StatusBadRequest)
+		return
+	}
+
+	if len(wrReqIn.Timeseries) == 0 {
+		ctx.Error("No timeseries found in the request", fh.StatusBadRequest)
+		return
+	}
+
+	tenantPrefix := p.tenantPrefix(ctx)
+	src := p.sourceTenant(ctx)
+	clientIP := ctx.RemoteAddr()
+	reqID, _ := uuid.NewRandom()
+
+	m, err := p.createWriteRequestsV2(wrReqIn, src)
+	if err != nil {
+		ctx.Error(err.Error(), tenantErrorCode(err))
+		return
+	}
+
+	if err = p.authorize(ctx, src, m); err != nil {
+		ctx.Error(err.Error(), fh.StatusForbidden)
+		return
+	}
+
+	results := p.dispatch(p.cfg.Target, formatPromWriteV2, clientIP, reqID, tenantPrefix, m)
+	if !p.handleResults(ctx, clientIP, reqID, results, timeseriesRequestMetrics) {
+		return
+	}
+
+	setWrittenHeaders(ctx, results)
+}
+
+// Sums up the written stats reported by the upstream for each tenant
+func setWrittenHeaders(ctx *fh.RequestCtx, results []result) {
+	for _, h := range remoteWriteWrittenHeaders {
+		total, found := 0, false
+
+		for _, r := range results {
+			v, ok := r.headers[h]
+			if !ok {
+				continue
+			}
+
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				continue
+			}
+
+			total += n
+			found = true
+		}
+
+		if found {
+			ctx.Response.Header.Set(h, strconv.Itoa(total))
+		}
+	}
+}
+
+func (p *processor) createWriteRequestsV2(wrReqIn *writev2.Request, src sourceTenant) (map[string]func() ([]byte, error), error) {
+	// Create per-tenant write requests, each with its own compact symbols table
+	m := map[string]*writev2.Request{}
+	tables := map[string]*writev2.SymbolsTable{}
+	st := newSymbolsInterner(&wrReqIn.Symbols)
+
+	var tenants []string
+
+	for _, ts := range wrReqIn.Timeseries {
+		keep, err := relabelTimeseriesV2(&ts, st, p.relabel)
+		if err != nil {
+			return nil, err
+		}
+
+		if !keep {
+			continue
+		}
+
+		if tenants, err = p.timeseriesTenantsV2(tenants[:0], &ts, wrReqIn.Symbols, src); err != nil {
+			return nil, err
+		}
+
+		for _, tenant := range tenants {
+			if p.cfg.MetricsIncludeTenant {
+				metricTimeseriesReceived.WithLabelValues(tenant).Inc()
+			} else {
+				metricTimeseriesReceived.WithLabelValues("").Inc()
+			}
+
+			// Copy since the per-tenant rules replace the label references
+			tts := ts
+
+			if r, ok := p.tenantRules[tenant]; ok {
+				if keep, err = relabelTimeseriesV2(&tts, st, r); err != nil {
+					return nil, err
+				}
+
+				if !keep {
+					continue
+				}
+			}
+
+			if p.cfg.Tenant.InjectLabel != "" {
+				// Interned before passing the symbols since that might extend them
+				nameRef, valueRef := st.ref(p.cfg.Tenant.InjectLabel), st.ref(tenant)
+				if tts.LabelsRefs, err = injectLabelV2(tts.LabelsRefs, wrReqIn.Symbols, nameRef, valueRef); err != nil {
+					return nil, err
+				}
+			}
+
+			wrReqOut, ok := m[tenant]
+			if !ok {
+				st := writev2.NewSymbolTable()
+				tables[tenant] = &st
+
+				wrReqOut = &writev2.Request{}
+				m[tenant] = wrReqOut
+			}
+
+			tsOut, err := resymbolizeTimeseries(tts, wrReqIn.Symbols, tables[tenant])
+			if err != nil {
+				return nil, err
+			}
+
+			wrReqOut.Timeseries = append(wrReqOut.Timeseries, tsOut)
+		}
+	}
+
+	// Marshal results
+	resM := make(map[string]func() ([]byte, error), len(m))
+	for tenant, wrReqOut := range m {
+		wrReqOut.Symbols = tables[tenant].Symbols()
+		resM[tenant] = func() ([]byte, error) {
+			return p.marshalPromWriteV2(wrReqOut)
+		}
+	}
+
+	return resM, nil
+}
+
+// Rewrites all symbol references of the timeseries (labels, exemplars and metadata)
+// from the original symbols to the given per-tenant symbols table.
+// Samples and native histograms do not reference symbols and are kept as is.
+func resymbolizeTimeseries(ts writev2.TimeSeries, symbols []string, st *writev2.SymbolsTable) (writev2.TimeSeries, error) {
+	var err error
+
+	if ts.LabelsRefs, err = resymbolizeRefs(ts.LabelsRefs, symbols, st); err != nil {
+		return ts, errors.Wrap(err, "invalid timeseries labels")
+	}
+
+	exemplars := make([]writev2.Exemplar, len(ts.Exemplars))
+	for i, e := range ts.Exemplars {
+		if e.LabelsRefs, err = resymbolizeRefs(e.LabelsRefs, symbols, st); err != nil {
+			return ts, errors.Wrap(err, "invalid exemplar labels")
+		}
+
+		exemplars[i] = e
+	}
+	ts.Exemplars = exemplars
+
+	if ts.Metadata.HelpRef, err = resymbolizeRef(ts.Metadata.HelpRef, symbols, st); err != nil {
+		return ts, errors.Wrap(err, "invalid metadata help")
+	}
+
+	if ts.Metadata.UnitRef, err = resymbolizeRef(ts.Metadata.UnitRef, symbols, st); err != nil {
+		return ts, errors.Wrap(err, "invalid metadata unit")
+	}
+
+	return ts, nil
+}
+
+func resymbolizeRefs(refs []uint32, symbols []string, st *writev2.SymbolsTable) ([]uint32, error) {
+	out := make([]uint32, len(refs))
+
+	for i, ref := range refs {
+		r, err := resymbolizeRef(ref, symbols, st)
+		if err != nil {
+			return nil, err
+		}
+
+		out[i] = r
+	}
+
+	return out, nil
+}
+
+func resymbolizeRef(ref uint32, symbols []string, st *writev2.SymbolsTable) (uint32, error) {
+	if int(ref) >= len(symbols) {
+		return 0, fmt.Errorf("symbol reference %d is out of range (%d symbols)", ref, len(symbols))
+	}
+
+	return st.Symbolize(symbols[ref]), nil
+}
+
+func (p *processor) unmarshalPromWriteV2(b []byte) (*writev2.Request, error) {
+	decoded, err := snappy.Decode(nil, b)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to unpack Snappy")
+	}
+
+	req := &writev2.Request{}
+	if err = proto.Unmarshal(decoded, req); err != nil {
+		return nil, errors.Wrap(err, "Unable to unmarshal protobuf")
+	}
+
+	return req, nil
+}
+
+func (p *processor) marshalPromWriteV2(wr *writev2.Request) (bufOut []byte, err error) {
+	b := make([]byte, wr.Size())
+
+	// Marshal to Protobuf
+	if _, err = wr.MarshalTo(b); err != nil {
+		return
+	}
+
+	// Compress with Snappy
+	return snappy.Encode(nil, b), nil
+}
+
+// Returns the tenants of the timeseries from the routes or, if none matched, from the labels
+func (p *processor) timeseriesTenantsV2(tenants []string, ts *writev2.TimeSeries, symbols []string, src sourceTenant) ([]string, error) {
+	if src.override {
+		return append(tenants, src.tenant), nil
+	}
+
+	if len(p.routes) > 0 {
+		tenants = p.routeTenants(tenants, func(name string) string {
+			// References are not validated yet
+			for i := 0; i+1 < len(ts.LabelsRefs); i += 2 {
+				nameRef, valueRef := ts.LabelsRefs[i], ts.LabelsRefs[i+1]
+				if int(nameRef) < len(symbols) && int(valueRef) < len(symbols) && symbols[nameRef] == name {
+					return symbols[valueRef]
+				}
+			}
+
+			return ""
+		})
+
+		if len(tenants) > 0 {
+			return tenants, nil
+		}
+	}
+
+	tenant, err := p.processTimeseriesV2Default(ts, symbols, src)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(tenants, tenant), nil
+}
+
+func (p *processor) processTimeseriesV2(ts *writev2.TimeSeries, symbols []string) (tenant string, err error) {
+	return p.processTimeseriesV2Default(ts, symbols, sourceTenant{})
+}
+
+// Same as processTimeseriesV2, but falls back to the default tenant of the source
+func (p *processor) processTimeseriesV2Default(ts *writev2.TimeSeries, symbols []string, src sourceTenant) (tenant string, err error) {
+	if len(ts.LabelsRefs)%2 != 0 {
+		return "", fmt.Errorf("odd number of label references: %d", len(ts.LabelsRefs))
+	}
+
+	for _, ref := range ts.LabelsRefs {
+		if int(ref) >= len(symbols) {
+			return "", fmt.Errorf("label reference is out of range (%d symbols)", len(symbols))
+		}
+	}
+
+	tenant, used, err := p.resolveTenant(func(name string) string {
+		for i := 0; i < len(ts.LabelsRefs); i += 2 {
+			if symbols[ts.LabelsRefs[i]] == name {
+				return symbols[ts.LabelsRefs[i+1]]
+			}
+		}
+
+		return ""
+	}, src)
+	if err != nil {
+		return "", err
+	}
+
+	if p.cfg.Tenant.LabelRemove && len(used) > 0 {
+		refs := ts.LabelsRefs[:0]
+		for i := 0; i < len(ts.LabelsRefs); i += 2 {
+			if !slices.Contains(used, symbols[ts.LabelsRefs[i]]) {
+				refs = append(refs, ts.LabelsRefs[i], ts.LabelsRefs[i+1])
+			}
+		}
+
+		ts.LabelsRefs = refs
+	}
+
+	return tenant, nil
+}
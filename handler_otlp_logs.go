@@ -0,0 +1,88 @@
+package main
+
+import (
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	fh "github.com/valyala/fasthttp"
+	"go.opentelemetry.io/collector/pdata/plog"
+	"go.opentelemetry.io/collector/pdata/plog/plogotlp"
+)
+
+func (p *processor) handleOTLPLogs(ctx *fh.RequestCtx) {
+	metricStreamsBatchesReceivedBytes.Observe(float64(ctx.Request.Header.ContentLength()))
+	metricStreamsBatchesReceived.Inc()
+
+	if p.cfg.TargetLokiOTLP == "" {
+		ctx.Error("OTLP logs target is not configured", fh.StatusNotFound)
+		return
+	}
+
+	body, isJSON, err := decodeOTLPBody(ctx)
+	if err != nil {
+		ctx.Error(err.Error(), fh.StatusBadRequest)
+		return
+	}
+
+	reqIn, err := p.unmarshalOTLPLogs(body, isJSON)
+	if err != nil {
+		ctx.Error(err.Error(), fh.StatusBadRequest)
+		return
+	}
+
+	if reqIn.Logs().ResourceLogs().Len() == 0 {
+		ctx.Error("No logs found in the request", fh.StatusBadRequest)
+		return
+	}
+
+	tenantPrefix := p.tenantPrefix(ctx)
+	src := p.sourceTenant(ctx)
+	clientIP := ctx.RemoteAddr()
+	reqID, _ := uuid.NewRandom()
+
+	m, err := p.createOTLPLogsRequests(reqIn, src)
+	if err != nil {
+		ctx.Error(err.Error(), tenantErrorCode(err))
+		return
+	}
+
+	if err = p.authorize(ctx, src, m); err != nil {
+		ctx.Error(err.Error(), fh.StatusForbidden)
+		return
+	}
+
+	results := p.dispatch(p.cfg.TargetLokiOTLP, formatOTLP, clientIP, reqID, tenantPrefix, m)
+	p.handleResults(ctx, clientIP, reqID, results, streamsRequestMetrics)
+}
+
+var otlpLogsSignal = otlpSignal[plog.Logs, plog.ResourceLogs, plog.ScopeLogs]{
+	new:       plog.NewLogs,
+	resources: func(ld plog.Logs) otlpSlice[plog.ResourceLogs] { return ld.ResourceLogs() },
+	scopes:    func(r plog.ResourceLogs) otlpSlice[plog.ScopeLogs] { return r.ScopeLogs() },
+	count:     func(ld plog.Logs) int { return ld.LogRecordCount() },
+	marshal: func(ld plog.Logs) ([]byte, error) {
+		return plogotlp.NewExportRequestFromLogs(ld).MarshalProto()
+	},
+	received: metricStreamsReceived,
+}
+
+func (p *processor) createOTLPLogsRequests(reqIn plogotlp.ExportRequest, src sourceTenant) (map[string]func() ([]byte, error), error) {
+	return createOTLPRequests(p, reqIn.Logs(), otlpLogsSignal, src)
+}
+
+func (p *processor) unmarshalOTLPLogs(b []byte, isJSON bool) (plogotlp.ExportRequest, error) {
+	req := plogotlp.NewExportRequest()
+
+	if isJSON {
+		if err := req.UnmarshalJSON(b); err != nil {
+			return req, errors.Wrap(err, "Unable to unmarshal JSON")
+		}
+
+		return req, nil
+	}
+
+	if err := req.UnmarshalProto(b); err != nil {
+		return req, errors.Wrap(err, "Unable to unmarshal protobuf")
+	}
+
+	return req, nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	fh "github.com/valyala/fasthttp"
+	"go.opentelemetry.io/collector/pdata/pmetric"
+	"go.opentelemetry.io/collector/pdata/pmetric/pmetricotlp"
+)
+
+func (p *processor) handleOTLPMetrics(ctx *fh.RequestCtx) {
+	metricTimeseriesBatchesReceivedBytes.Observe(float64(ctx.Request.Header.ContentLength()))
+	metricTimeseriesBatchesReceived.Inc()
+
+	if p.cfg.TargetOTLP == "" {
+		ctx.Error("OTLP metrics target is not configured", fh.StatusNotFound)
+		return
+	}
+
+	body, isJSON, err := decodeOTLPBody(ctx)
+	if err != nil {
+		ctx.Error(err.Error(), fh.StatusBadRequest)
+		return
+	}
+
+	reqIn, err := p.unmarshalOTLPMetrics(body, isJSON)
+	if err != nil {
+		ctx.Error(err.Error(), fh.StatusBadRequest)
+		return
+	}
+
+	if reqIn.Metrics().ResourceMetrics().Len() == 0 {
+		ctx.Error("No metrics found in the request", fh.StatusBadRequest)
+		return
+	}
+
+	tenantPrefix := p.tenantPrefix(ctx)
+	src := p.sourceTenant(ctx)
+	clientIP := ctx.RemoteAddr()
+	reqID, _ := uuid.NewRandom()
+
+	m, err := p.createOTLPMetricsRequests(reqIn, src)
+	if err != nil {
+		ctx.Error(err.Error(), tenantErrorCode(err))
+		return
+	}
+
+	if err = p.authorize(ctx, src, m); err != nil {
+		ctx.Error(err.Error(), fh.StatusForbidden)
+		return
+	}
+
+	results := p.dispatch(p.cfg.TargetOTLP, formatOTLP, clientIP, reqID, tenantPrefix, m)
+	p.handleResults(ctx, clientIP, reqID, results, timeseriesRequestMetrics)
+}
+
+var otlpMetricsSignal = otlpSignal[pmetric.Metrics, pmetric.ResourceMetrics, pmetric.ScopeMetrics]{
+	new:       pmetric.NewMetrics,
+	resources: func(md pmetric.Metrics) otlpSlice[pmetric.ResourceMetrics] { return md.ResourceMetrics() },
+	scopes:    func(r pmetric.ResourceMetrics) otlpSlice[pmetric.ScopeMetrics] { return r.ScopeMetrics() },
+	count:     func(md pmetric.Metrics) int { return md.DataPointCount() },
+	marshal: func(md pmetric.Metrics) ([]byte, error) {
+		return pmetricotlp.NewExportRequestFromMetrics(md).MarshalProto()
+	},
+	received: metricTimeseriesReceived,
+}
+
+func (p *processor) createOTLPMetricsRequests(reqIn pmetricotlp.ExportRequest, src sourceTenant) (map[string]func() ([]byte, error), error) {
+	return createOTLPRequests(p, reqIn.Metrics(), otlpMetricsSignal, src)
+}
+
+func (p *processor) unmarshalOTLPMetrics(b []byte, isJSON bool) (pmetricotlp.ExportRequest, error) {
+	req := pmetricotlp.NewExportRequest()
+
+	if isJSON {
+		if err := req.UnmarshalJSON(b); err != nil {
+			return req, errors.Wrap(err, "Unable to unmarshal JSON")
+		}
+
+		return req, nil
+	}
+
+	if err := req.UnmarshalProto(b); err != nil {
+		return req, errors.Wrap(err, "Unable to unmarshal protobuf")
+	}
+
+	return req, nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	fh "github.com/valyala/fasthttp"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+	"go.opentelemetry.io/collector/pdata/ptrace/ptraceotlp"
+)
+
+var (
+	metricSpansBatchesReceived = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "cortex_tenant",
+		Name:      "spans_batches_received",
+		Help:      "The total number of spans batches received.",
+	})
+	metricSpansBatchesReceivedBytes = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "cortex_tenant",
+		Name:      "spans_batches_received_bytes",
+		Help:      "Size in bytes of spans batches received.",
+		Buckets:   []float64{0.5, 1, 10, 25, 100, 250, 500, 1000, 5000, 10000, 30000, 300000, 600000, 1800000, 3600000},
+	})
+	metricSpansReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cortex_tenant",
+		Name:      "spans_received",
+		Help:      "The total number of spans received.",
+	}, []string{"tenant"})
+	metricSpansRequestDurationMilliseconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "cortex_tenant",
+		Name:      "spans_request_duration_milliseconds",
+		Help:      "HTTP write request duration for tenant-specific spans in milliseconds, filtered by response code.",
+		Buckets:   []float64{0.5, 1, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000, 30000, 60000, 1800000, 3600000},
+	},
+		[]string{"code", "tenant"},
+	)
+	metricSpansRequestErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cortex_tenant",
+		Name:      "spans_request_errors",
+		Help:      "The total number of tenant-specific spans writes that yielded errors.",
+	}, []string{"tenant"})
+	metricSpansRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cortex_tenant",
+		Name:      "spans_requests",
+		Help:      "The total number of tenant-specific spans writes.",
+	}, []string{"tenant"})
+)
+
+var spansRequestMetrics = requestMetrics{
+	requests: metricSpansRequests,
+	errors:   metricSpansRequestErrors,
+	duration: metricSpansRequestDurationMilliseconds,
+}
+
+func (p *processor) handleOTLPTraces(ctx *fh.RequestCtx) {
+	metricSpansBatchesReceivedBytes.Observe(float64(ctx.Request.Header.ContentLength()))
+	metricSpansBatchesReceived.Inc()
+
+	if p.cfg.TargetTempo == "" {
+		ctx.Error("OTLP traces target is not configured", fh.StatusNotFound)
+		return
+	}
+
+	body, isJSON, err := decodeOTLPBody(ctx)
+	if err != nil {
+		ctx.Error(err.Error(), fh.StatusBadRequest)
+		return
+	}
+
+	reqIn, err := p.unmarshalOTLPTraces(body, isJSON)
+	if err != nil {
+		ctx.Error(err.Error(), fh.StatusBadRequest)
+		return
+	}
+
+	if reqIn.Traces().ResourceSpans().Len() == 0 {
+		ctx.Error("No spans found in the request", fh.StatusBadRequest)
+		return
+	}
+
+	tenantPrefix := p.tenantPrefix(ctx)
+	src := p.sourceTenant(ctx)
+	clientIP := ctx.RemoteAddr()
+	reqID, _ := uuid.NewRandom()
+
+	m, err := p.createOTLPTracesRequests(reqIn, src)
+	if err != nil {
+		ctx.Error(err.Error(), tenantErrorCode(err))
+		return
+	}
+
+	if err = p.authorize(ctx, src, m); err != nil {
+		ctx.Error(err.Error(), fh.StatusForbidden)
+		return
+	}
+
+	results := p.dispatch(p.cfg.TargetTempo, formatOTLP, clientIP, reqID, tenantPrefix, m)
+	p.handleResults(ctx, clientIP, reqID, results, spansRequestMetrics)
+}
+
+var otlpTracesSignal = otlpSignal[ptrace.Traces, ptrace.ResourceSpans, ptrace.ScopeSpans]{
+	new:       ptrace.NewTraces,
+	resources: func(td ptrace.Traces) otlpSlice[ptrace.ResourceSpans] { return td.ResourceSpans() },
+	scopes:    func(r ptrace.ResourceSpans) otlpSlice[ptrace.ScopeSpans] { return r.ScopeSpans() },
+	count:     func(td ptrace.Traces) int { return td.SpanCount() },
+	marshal: func(td ptrace.Traces) ([]byte, error) {
+		return ptraceotlp.NewExportRequestFromTraces(td).MarshalProto()
+	},
+	received: metricSpansReceived,
+}
+
+func (p *processor) createOTLPTracesRequests(reqIn ptraceotlp.ExportRequest, src sourceTenant) (map[string]func() ([]byte, error), error) {
+	return createOTLPRequests(p, reqIn.Traces(), otlpTracesSignal, src)
+}
+
+func (p *processor) unmarshalOTLPTraces(b []byte, isJSON bool) (ptraceotlp.ExportRequest, error) {
+	req := ptraceotlp.NewExportRequest()
+
+	if isJSON {
+		if err := req.UnmarshalJSON(b); err != nil {
+			return req, errors.Wrap(err, "Unable to unmarshal JSON")
+		}
+
+		return req, nil
+	}
+
+	if err := req.UnmarshalProto(b); err != nil {
+		return req, errors.Wrap(err, "Unable to unmarshal protobuf")
+	}
+
+	return req, nil
+}
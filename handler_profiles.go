@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"sort"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/prompb"
+	fh "github.com/valyala/fasthttp"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+var (
+	metricProfilesBatchesReceived = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "cortex_tenant",
+		Name:      "profiles_batches_received",
+		Help:      "The total number of profiles batches received.",
+	})
+	metricProfilesBatchesReceivedBytes = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "cortex_tenant",
+		Name:      "profiles_batches_received_bytes",
+		Help:      "Size in bytes of profiles batches received.",
+		Buckets:   []float64{0.5, 1, 10, 25, 100, 250, 500, 1000, 5000, 10000, 30000, 300000, 600000, 1800000, 3600000},
+	})
+	metricProfilesReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cortex_tenant",
+		Name:      "profiles_received",
+		Help:      "The total number of profiles received.",
+	}, []string{"tenant"})
+	metricProfilesRequestDurationMilliseconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "cortex_tenant",
+		Name:      "profiles_request_duration_milliseconds",
+		Help:      "HTTP write request duration for tenant-specific profiles in milliseconds, filtered by response code.",
+		Buckets:   []float64{0.5, 1, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000, 30000, 60000, 1800000, 3600000},
+	},
+		[]string{"code", "tenant"},
+	)
+	metricProfilesRequestErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cortex_tenant",
+		Name:      "profiles_request_errors",
+		Help:      "The total number of tenant-specific profiles writes that yielded errors.",
+	}, []string{"tenant"})
+	metricProfilesRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cortex_tenant",
+		Name:      "profiles_requests",
+		Help:      "The total number of tenant-specific profiles writes.",
+	}, []string{"tenant"})
+)
+
+var profilesRequestMetrics = requestMetrics{
+	requests: metricProfilesRequests,
+	errors:   metricProfilesRequestErrors,
+	duration: metricProfilesRequestDurationMilliseconds,
+}
+
+const (
+	pyroscopePushPath   = "/push.v1.PusherService/Push"
+	pyroscopeIngestPath = "/ingest"
+)
+
+var formatPyroscopePush = format{contentType: "application/proto"}
+
+// Series of the push.v1.PushRequest message. The samples are kept
+// in their wire encoding since they're forwarded untouched.
+type profileSeries struct {
+	labels  []prompb.Label
+	samples [][]byte
+}
+
+// Handles the Phlare/Pyroscope push API (Connect unary call with protobuf encoding)
+func (p *processor) handleProfilesPush(ctx *fh.RequestCtx) {
+	metricProfilesBatchesReceivedBytes.Observe(float64(ctx.Request.Header.ContentLength()))
+	metricProfilesBatchesReceived.Inc()
+
+	if p.cfg.TargetPyroscope == "" {
+		ctx.Error("Pyroscope target is not configured", fh.StatusNotFound)
+		return
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(string(ctx.Request.Header.ContentType()))
+	if mediaType != formatPyroscopePush.contentType {
+		ctx.Error(fmt.Sprintf("Unsupported Content-Type %q", mediaType), fh.StatusUnsupportedMediaType)
+		return
+	}
+
+	body := ctx.Request.Body()
+	if bytes.Equal(ctx.Request.Header.ContentEncoding(), []byte("gzip")) {
+		var err error
+		if body, err = ctx.Request.BodyGunzip(); err != nil {
+			ctx.Error(err.Error(), fh.StatusBadRequest)
+			return
+		}
+	}
+
+	seriesIn, err := unmarshalPyroscopePush(body)
+	if err != nil {
+		ctx.Error(err.Error(), fh.StatusBadRequest)
+		return
+	}
+
+	if len(seriesIn) == 0 {
+		ctx.Error("No profiles found in the request", fh.StatusBadRequest)
+		return
+	}
+
+	tenantPrefix := p.tenantPrefix(ctx)
+	src := p.sourceTenant(ctx)
+	clientIP := ctx.RemoteAddr()
+	reqID, _ := uuid.NewRandom()
+
+	m, err := p.createProfilesPushRequests(seriesIn, src)
+	if err != nil {
+		ctx.Error(err.Error(), tenantErrorCode(err))
+		return
+	}
+
+	if err = p.authorize(ctx, src, m); err != nil {
+		ctx.Error(err.Error(), fh.StatusForbidden)
+		return
+	}
+
+	target := strings.TrimSuffix(p.cfg.TargetPyroscope, "/") + pyroscopePushPath
+	results := p.dispatch(target, formatPyroscopePush, clientIP, reqID, tenantPrefix, m)
+	p.handleResults(ctx, clientIP, reqID, results, profilesRequestMetrics)
+}
+
+// Handles the legacy Pyroscope ingestion API where the labels
+// are passed in the `name` query parameter as `app.name{label=value,...}`
+func (p *processor) handleProfilesIngest(ctx *fh.RequestCtx) {
+	metricProfilesBatchesReceivedBytes.Observe(float64(ctx.Request.Header.ContentLength()))
+	metricProfilesBatchesReceived.Inc()
+
+	if p.cfg.TargetPyroscope == "" {
+		ctx.Error("Pyroscope target is not configured", fh.StatusNotFound)
+		return
+	}
+
+	lbls, err := parsePyroscopeName(string(ctx.QueryArgs().Peek("name")))
+	if err != nil {
+		ctx.Error(err.Error(), fh.StatusBadRequest)
+		return
+	}
+
+	src := p.sourceTenant(ctx)
+	ts := &prompb.TimeSeries{Labels: lbls}
+	tenant, err := p.profileTenant(ts, src)
+	if err != nil {
+		ctx.Error(err.Error(), tenantErrorCode(err))
+		return
+	}
+
+	if !p.tenantAllowed(ctx, src, p.authorizationRule(ctx), tenant) {
+		if p.cfg.Authorization.Action == authorizationActionReject {
+			ctx.Error(fmt.Sprintf("tenant '%s' is not allowed for the client", tenant), fh.StatusForbidden)
+		}
+
+		return
+	}
+
+	if p.cfg.MetricsIncludeTenant {
+		metricProfilesReceived.WithLabelValues(tenant).Inc()
+	} else {
+		metricProfilesReceived.WithLabelValues("").Inc()
+	}
+
+	args := fh.AcquireArgs()
+	defer fh.ReleaseArgs(args)
+	ctx.QueryArgs().CopyTo(args)
+	args.Set("name", formatPyroscopeName(ts.Labels))
+
+	// The body is passed through as is, it might be a multipart form
+	f := format{
+		contentType:     string(ctx.Request.Header.ContentType()),
+		contentEncoding: string(ctx.Request.Header.ContentEncoding()),
+	}
+
+	clientIP := ctx.RemoteAddr()
+	reqID, _ := uuid.NewRandom()
+	target := strings.TrimSuffix(p.cfg.TargetPyroscope, "/") + pyroscopeIngestPath + "?" + args.String()
+
+	r := p.send(target, f, clientIP, reqID, p.tenantPrefix(ctx)+tenant, func() ([]byte, error) {
+		return ctx.Request.Body(), nil
+	})
+
+	p.handleResults(ctx, clientIP, reqID, []result{r}, profilesRequestMetrics)
+}
+
+func (p *processor) createProfilesPushRequests(seriesIn []profileSeries, src sourceTenant) (map[string]func() ([]byte, error), error) {
+	// Create per-tenant series
+	m := map[string][]profileSeries{}
+
+	for _, s := range seriesIn {
+		ts := &prompb.TimeSeries{Labels: s.labels}
+
+		tenant, err := p.profileTenant(ts, src)
+		if err != nil {
+			return nil, err
+		}
+
+		s.labels = ts.Labels
+		m[tenant] = append(m[tenant], s)
+	}
+
+	// Marshal results
+	resM := make(map[string]func() ([]byte, error), len(m))
+	for tenant, series := range m {
+		profiles := 0
+		for _, s := range series {
+			profiles += len(s.samples)
+		}
+
+		if p.cfg.MetricsIncludeTenant {
+			metricProfilesReceived.WithLabelValues(tenant).Add(float64(profiles))
+		} else {
+			metricProfilesReceived.WithLabelValues("").Add(float64(profiles))
+		}
+
+		resM[tenant] = func() ([]byte, error) {
+			return marshalPyroscopePush(series), nil
+		}
+	}
+
+	return resM, nil
+}
+
+// Returns the tenant of the profile series from its labels unless the source overrides it
+func (p *processor) profileTenant(ts *prompb.TimeSeries, src sourceTenant) (string, error) {
+	if src.override {
+		return src.tenant, nil
+	}
+
+	return p.processTimeseriesDefault(ts, src)
+}
+
+// Parses `app.name{label=value,...}` into labels with the application name
+// stored in `__name__`
+func parsePyroscopeName(name string) ([]prompb.Label, error) {
+	app, rest, hasLabels := strings.Cut(name, "{")
+	if app == "" {
+		return nil, fmt.Errorf("invalid application name %q", name)
+	}
+
+	lbls := []prompb.Label{{Name: "__name__", Value: app}}
+	if !hasLabels {
+		return lbls, nil
+	}
+
+	rest, ok := strings.CutSuffix(rest, "}")
+	if !ok {
+		return nil, fmt.Errorf("invalid application name %q: missing closing brace", name)
+	}
+
+	for _, kv := range strings.Split(rest, ",") {
+		if kv = strings.TrimSpace(kv); kv == "" {
+			continue
+		}
+
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid application name %q: label %q has no value", name, kv)
+		}
+
+		lbls = append(lbls, prompb.Label{Name: strings.TrimSpace(k), Value: strings.TrimSpace(v)})
+	}
+
+	return lbls, nil
+}
+
+// Formats the labels back into `app.name{label=value,...}`
+func formatPyroscopeName(lbls []prompb.Label) string {
+	var app string
+	var pairs []string
+
+	for _, l := range lbls {
+		if l.Name == "__name__" {
+			app = l.Value
+			continue
+		}
+
+		pairs = append(pairs, l.Name+"="+l.Value)
+	}
+
+	sort.Strings(pairs)
+	return app + "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Decodes the push.v1.PushRequest message:
+//
+//	message PushRequest { repeated RawProfileSeries series = 1; }
+//	message RawProfileSeries { repeated LabelPair labels = 1; repeated RawSample samples = 2; }
+//	message LabelPair { string name = 1; string value = 2; }
+func unmarshalPyroscopePush(b []byte) (series []profileSeries, err error) {
+	err = walkProtoMessage(b, func(num protowire.Number, v []byte) error {
+		if num != 1 {
+			return nil
+		}
+
+		var s profileSeries
+		err := walkProtoMessage(v, func(num protowire.Number, v []byte) error {
+			switch num {
+			case 1:
+				var l prompb.Label
+				err := walkProtoMessage(v, func(num protowire.Number, v []byte) error {
+					switch num {
+					case 1:
+						l.Name = string(v)
+					case 2:
+						l.Value = string(v)
+					}
+
+					return nil
+				})
+
+				s.labels = append(s.labels, l)
+				return err
+
+			case 2:
+				s.samples = append(s.samples, v)
+			}
+
+			return nil
+		})
+
+		series = append(series, s)
+		return err
+	})
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to unmarshal protobuf")
+	}
+
+	return
+}
+
+func marshalPyroscopePush(series []profileSeries) (b []byte) {
+	for _, s := range series {
+		var sb []byte
+
+		for _, l := range s.labels {
+			var lb []byte
+			lb = protowire.AppendTag(lb, 1, protowire.BytesType)
+			lb = protowire.AppendString(lb, l.Name)
+			lb = protowire.AppendTag(lb, 2, protowire.BytesType)
+			lb = protowire.AppendString(lb, l.Value)
+
+			sb = protowire.AppendTag(sb, 1, protowire.BytesType)
+			sb = protowire.AppendBytes(sb, lb)
+		}
+
+		for _, sample := range s.samples {
+			sb = protowire.AppendTag(sb, 2, protowire.BytesType)
+			sb = protowire.AppendBytes(sb, sample)
+		}
+
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, sb)
+	}
+
+	return
+}
+
+// Calls fn for every length-delimited field of the message, other fields are skipped
+func walkProtoMessage(b []byte, fn func(num protowire.Number, v []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		if typ != protowire.BytesType {
+			if n = protowire.ConsumeFieldValue(num, typ, b); n < 0 {
+				return protowire.ParseError(n)
+			}
+			b = b[n:]
+			continue
+		}
+
+		v, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		if err := fn(num, v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/grafana/loki/v3/pkg/logproto"
+	"github.com/prometheus/prometheus/model/labels"
+	fh "github.com/valyala/fasthttp"
+)
+
+// HEC response codes, see
+// https://docs.splunk.com/Documentation/Splunk/latest/Data/TroubleshootHTTPEventCollector#Possible_error_codes
+const (
+	hecCodeSuccess         = 0
+	hecCodeTokenRequired   = 2
+	hecCodeInvalidAuth     = 3
+	hecCodeInvalidToken    = 4
+	hecCodeNoData          = 5
+	hecCodeInvalidFormat   = 6
+	hecCodeInternalError   = 8
+	hecCodeServerBusy      = 9
+	hecCodeEventRequired   = 12
+	hecCodeEventBlank      = 13
+	hecAuthorizationScheme = "Splunk "
+)
+
+// Event sent to the HEC event endpoint
+type hecEvent struct {
+	Time       json.Number     `json:"time"`
+	Host       string          `json:"host"`
+	Source     string          `json:"source"`
+	SourceType string          `json:"sourcetype"`
+	Index      string          `json:"index"`
+	Event      json.RawMessage `json:"event"`
+	Fields     map[string]any  `json:"fields"`
+}
+
+type hecError struct {
+	status int
+	code   int
+	text   string
+}
+
+func (p *processor) handleSplunkEvent(ctx *fh.RequestCtx) {
+	p.handleSplunk(ctx, false)
+}
+
+func (p *processor) handleSplunkRaw(ctx *fh.RequestCtx) {
+	p.handleSplunk(ctx, true)
+}
+
+func (p *processor) handleSplunk(ctx *fh.RequestCtx, raw bool) {
+	metricStreamsBatchesReceivedBytes.Observe(float64(ctx.Request.Header.ContentLength()))
+	metricStreamsBatchesReceived.Inc()
+
+	if len(p.cfg.Splunk.Tokens) == 0 {
+		ctx.Error("Splunk HEC tokens are not configured", fh.StatusNotFound)
+		return
+	}
+
+	if hErr := p.splunkAuthenticate(ctx); hErr != nil {
+		hecRespond(ctx, hErr.status, hErr.code, hErr.text)
+		return
+	}
+
+	body := ctx.Request.Body()
+	if bytes.Equal(ctx.Request.Header.ContentEncoding(), []byte("gzip")) {
+		var err error
+		if body, err = ctx.Request.BodyGunzip(); err != nil {
+			hecRespond(ctx, fh.StatusBadRequest, hecCodeInvalidFormat, "Invalid data format")
+			return
+		}
+	}
+
+	now := time.Now()
+
+	var (
+		wrReqIn *logproto.PushRequest
+		hErr    *hecError
+	)
+
+	if raw {
+		wrReqIn = splunkRawToPushRequest(body, ctx.QueryArgs(), now)
+	} else {
+		if wrReqIn, hErr = splunkEventsToPushRequest(body, now); hErr != nil {
+			hecRespond(ctx, hErr.status, hErr.code, hErr.text)
+			return
+		}
+	}
+
+	if len(wrReqIn.Streams) == 0 {
+		hecRespond(ctx, fh.StatusBadRequest, hecCodeNoData, "No data")
+		return
+	}
+
+	tenantPrefix := p.tenantPrefix(ctx)
+	src := p.sourceTenant(ctx)
+	clientIP := ctx.RemoteAddr()
+	reqID, _ := uuid.NewRandom()
+
+	// The tenant of the token overrides the one from the labels
+	m, err := p.createPushRequests(wrReqIn, src)
+	if err != nil {
+		if code := tenantErrorCode(err); code != fh.StatusBadRequest {
+			hecRespond(ctx, code, hecCodeServerBusy, err.Error())
+			return
+		}
+
+		hecRespond(ctx, fh.StatusBadRequest, hecCodeInvalidFormat, err.Error())
+		return
+	}
+
+	if err = p.authorize(ctx, src, m); err != nil {
+		hecRespond(ctx, fh.StatusForbidden, hecCodeInvalidAuth, err.Error())
+		return
+	}
+
+	results := p.dispatch(p.cfg.TargetLoki, formatLokiPush, clientIP, reqID, tenantPrefix, m)
+
+	if p.cfg.Tenant.AcceptAll {
+		hecRespond(ctx, fh.StatusOK, hecCodeSuccess, "Success")
+		return
+	}
+
+	p.recordResults(clientIP, reqID, p.identityName(ctx), results, streamsRequestMetrics)
+
+	// Report the tenants which failed so that the sender retries the whole batch
+	var failed []string
+	code := 0
+	for _, r := range results {
+		switch {
+		case r.err != nil:
+			failed = append(failed, fmt.Sprintf("%s: %s", r.tenant, r.err))
+			code = max(code, fh.StatusInternalServerError)
+		case r.code < 200 || r.code >= 300:
+			failed = append(failed, fmt.Sprintf("%s: HTTP code %d (%s)", r.tenant, r.code, r.body))
+			code = max(code, r.code)
+		}
+	}
+
+	if len(failed) > 0 {
+		sort.Strings(failed)
+
+		// Only server errors make senders retry
+		if code < 500 && code != fh.StatusTooManyRequests {
+			code = fh.StatusServiceUnavailable
+		}
+
+		hecRespond(ctx, code, hecCodeInternalError, "Failed to push to tenant(s): "+strings.Join(failed, "; "))
+		return
+	}
+
+	hecRespond(ctx, fh.StatusOK, hecCodeSuccess, "Success")
+}
+
+// Checks the HEC token, the client gets the identity of the token along with the tenant mapped to it
+func (p *processor) splunkAuthenticate(ctx *fh.RequestCtx) *hecError {
+	auth := string(ctx.Request.Header.Peek("Authorization"))
+	if auth == "" {
+		return &hecError{fh.StatusUnauthorized, hecCodeTokenRequired, "Token is required"}
+	}
+
+	token, ok := strings.CutPrefix(auth, hecAuthorizationScheme)
+	if !ok {
+		return &hecError{fh.StatusUnauthorized, hecCodeInvalidAuth, "Invalid authorization"}
+	}
+
+	// Compare against all the tokens in constant time to not leak them through the timing
+	tenant, found := "", false
+	for t, tt := range p.cfg.Splunk.Tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+			tenant, found = tt, true
+		}
+	}
+
+	if !found {
+		return &hecError{fh.StatusForbidden, hecCodeInvalidToken, "Invalid token"}
+	}
+
+	ctx.SetUserValue(userValueIdentity, &identity{name: splunkIdentity(token), tenant: tenant})
+	return nil
+}
+
+// Name of the HEC token identity, the token itself is not exposed in the metrics and logs
+func splunkIdentity(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return "splunk-" + hex.EncodeToString(h[:4])
+}
+
+// Parses the concatenated JSON events
+func splunkEventsToPushRequest(body []byte, now time.Time) (*logproto.PushRequest, *hecError) {
+	b := newStreamsBuilder()
+
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+
+	for {
+		var ev hecEvent
+		if err := dec.Decode(&ev); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, &hecError{fh.StatusBadRequest, hecCodeInvalidFormat, "Invalid data format"}
+		}
+
+		if len(ev.Event) == 0 {
+			return nil, &hecError{fh.StatusBadRequest, hecCodeEventRequired, "Event field is required"}
+		}
+
+		entry := logproto.Entry{Timestamp: now}
+
+		var line string
+		if err := json.Unmarshal(ev.Event, &line); err != nil {
+			// Non-string events are kept as JSON
+			line = string(ev.Event)
+		}
+
+		if line == "" {
+			return nil, &hecError{fh.StatusBadRequest, hecCodeEventBlank, "Event field cannot be blank"}
+		}
+
+		entry.Line = line
+
+		if ev.Time != "" {
+			ts, err := ev.Time.Float64()
+			if err != nil {
+				return nil, &hecError{fh.StatusBadRequest, hecCodeInvalidFormat, "Invalid data format"}
+			}
+
+			sec, frac := math.Modf(ts)
+			entry.Timestamp = time.Unix(int64(sec), int64(frac*1e9))
+		}
+
+		for k, v := range ev.Fields {
+			value, ok := v.(string)
+			if !ok {
+				enc, _ := json.Marshal(v)
+				value = string(enc)
+			}
+
+			entry.StructuredMetadata = append(entry.StructuredMetadata, logproto.LabelAdapter{Name: sanitizeLabelName(k), Value: value})
+		}
+
+		sort.Slice(entry.StructuredMetadata, func(i, j int) bool {
+			return entry.StructuredMetadata[i].Name < entry.StructuredMetadata[j].Name
+		})
+
+		b.add(splunkLabels(ev.Host, ev.Source, ev.SourceType, ev.Index), entry)
+	}
+
+	return b.req, nil
+}
+
+// Each non-empty line of the body becomes an entry, the metadata is passed in the query
+func splunkRawToPushRequest(body []byte, args *fh.Args, now time.Time) *logproto.PushRequest {
+	b := newStreamsBuilder()
+	lbls := splunkLabels(
+		string(args.Peek("host")),
+		string(args.Peek("source")),
+		string(args.Peek("sourcetype")),
+		string(args.Peek("index")),
+	)
+
+	for _, line := range bytes.Split(body, []byte("\n")) {
+		if line = bytes.TrimRight(line, "\r"); len(line) == 0 {
+			continue
+		}
+
+		b.add(lbls, logproto.Entry{Timestamp: now, Line: string(line)})
+	}
+
+	return b.req
+}
+
+func splunkLabels(host, source, sourceType, index string) labels.Labels {
+	b := labels.NewScratchBuilder(4)
+	for _, l := range []labels.Label{
+		{Name: "host", Value: host},
+		{Name: "index", Value: index},
+		{Name: "source", Value: source},
+		{Name: "sourcetype", Value: sourceType},
+	} {
+		if l.Value != "" {
+			b.Add(l.Name, l.Value)
+		}
+	}
+
+	if lbls := b.Labels(); !lbls.IsEmpty() {
+		return lbls
+	}
+
+	// Loki requires at least one label
+	return labels.FromStrings("job", "splunk")
+}
+
+func hecRespond(ctx *fh.RequestCtx, status, code int, text string) {
+	b, _ := json.Marshal(map[string]any{"text": text, "code": code})
+	ctx.SetStatusCode(status)
+	ctx.SetContentType("application/json")
+	ctx.SetBody(b)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/grafana/loki/v3/pkg/logproto"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+	writev2 "github.com/prometheus/prometheus/prompb/io/prometheus/write/v2"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// Sets the label of the timeseries, overriding the existing value.
+// The labels are copied since they might be shared with the other tenants' timeseries,
+// and sorted if they were not since that's required by the remote write spec.
+func injectLabel(ts *prompb.TimeSeries, name, value string) {
+	lbls := make([]prompb.Label, 0, len(ts.Labels)+1)
+	lbls = append(lbls, ts.Labels...)
+
+	cmpLabels := func(a, b prompb.Label) int { return cmp.Compare(a.Name, b.Name) }
+	if !slices.IsSortedFunc(lbls, cmpLabels) {
+		slices.SortFunc(lbls, cmpLabels)
+	}
+
+	i, found := slices.BinarySearchFunc(lbls, name, func(l prompb.Label, name string) int {
+		return cmp.Compare(l.Name, name)
+	})
+
+	if found {
+		lbls[i].Value = value
+	} else {
+		lbls = slices.Insert(lbls, i, prompb.Label{Name: name, Value: value})
+	}
+
+	ts.Labels = lbls
+}
+
+// Same as injectLabel, but for the remote write 2.0 label references
+func injectLabelV2(refs []uint32, symbols []string, nameRef, valueRef uint32) ([]uint32, error) {
+	if len(refs)%2 != 0 {
+		return nil, fmt.Errorf("odd number of label references: %d", len(refs))
+	}
+
+	pairs := make([][2]uint32, 0, len(refs)/2+1)
+	for i := 0; i < len(refs); i += 2 {
+		if int(refs[i]) >= len(symbols) || int(refs[i+1]) >= len(symbols) {
+			return nil, fmt.Errorf("label reference is out of range (%d symbols)", len(symbols))
+		}
+
+		pairs = append(pairs, [2]uint32{refs[i], refs[i+1]})
+	}
+
+	cmpPairs := func(a, b [2]uint32) int { return cmp.Compare(symbols[a[0]], symbols[b[0]]) }
+	if !slices.IsSortedFunc(pairs, cmpPairs) {
+		slices.SortFunc(pairs, cmpPairs)
+	}
+
+	i, found := slices.BinarySearchFunc(pairs, symbols[nameRef], func(p [2]uint32, name string) int {
+		return cmp.Compare(symbols[p[0]], name)
+	})
+
+	if found {
+		pairs[i][1] = valueRef
+	} else {
+		pairs = slices.Insert(pairs, i, [2]uint32{nameRef, valueRef})
+	}
+
+	out := make([]uint32, 0, len(pairs)*2)
+	for _, p := range pairs {
+		out = append(out, p[0], p[1])
+	}
+
+	return out, nil
+}
+
+// Sets the label of the stream, the label string is re-rendered in the canonical sorted form
+func injectStreamLabel(s *logproto.Stream, name, value string) error {
+	lbls, err := parser.ParseMetric(s.Labels)
+	if err != nil {
+		return fmt.Errorf("unable to parse stream labels: %w", err)
+	}
+
+	b := labels.NewBuilder(lbls)
+	b.Set(name, value)
+	s.Labels = b.Labels().String()
+
+	return nil
+}
+
+// Merges the snappy-compressed remote write 1.0 or Loki push requests into one.
+// Concatenated protobuf messages are decoded as a single one with the repeated fields appended.
+func mergeSnappyProto(bodies [][]byte) ([]byte, error) {
+	var buf []byte
+	for _, b := range bodies {
+		decoded, err := snappy.Decode(nil, b)
+		if err != nil {
+			return nil, errors.Wrap(err, "Unable to unpack Snappy")
+		}
+
+		buf = append(buf, decoded...)
+	}
+
+	return snappy.Encode(nil, buf), nil
+}
+
+// Merges the remote write 2.0 requests into one, the timeseries are moved to a common symbols table
+func mergePromWriteV2(bodies [][]byte) ([]byte, error) {
+	st := writev2.NewSymbolTable()
+	wrReqOut := &writev2.Request{}
+
+	for _, b := range bodies {
+		decoded, err := snappy.Decode(nil, b)
+		if err != nil {
+			return nil, errors.Wrap(err, "Unable to unpack Snappy")
+		}
+
+		wrReq := &writev2.Request{}
+		if err = proto.Unmarshal(decoded, wrReq); err != nil {
+			return nil, errors.Wrap(err, "Unable to unmarshal protobuf")
+		}
+
+		for _, ts := range wrReq.Timeseries {
+			tsOut, err := resymbolizeTimeseries(ts, wrReq.Symbols, &st)
+			if err != nil {
+				return nil, err
+			}
+
+			wrReqOut.Timeseries = append(wrReqOut.Timeseries, tsOut)
+		}
+	}
+
+	wrReqOut.Symbols = st.Symbols()
+
+	buf := make([]byte, wrReqOut.Size())
+	if _, err := wrReqOut.MarshalTo(buf); err != nil {
+		return nil, err
+	}
+
+	return snappy.Encode(nil, buf), nil
+}
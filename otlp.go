@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	fh "github.com/valyala/fasthttp"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+)
+
+// OTLP payloads are always forwarded as uncompressed protobuf
+var formatOTLP = format{
+	contentType: "application/x-protobuf",
+}
+
+// Decodes the OTLP/HTTP request body.
+// Returns true if the body is JSON-encoded and false if it's protobuf.
+func decodeOTLPBody(ctx *fh.RequestCtx) (body []byte, isJSON bool, err error) {
+	contentType := string(ctx.Request.Header.ContentType())
+
+	switch {
+	case strings.HasPrefix(contentType, "application/x-protobuf"):
+	case strings.HasPrefix(contentType, "application/json"):
+		isJSON = true
+	default:
+		return nil, false, fmt.Errorf("unsupported Content-Type %s, must be application/x-protobuf or application/json", contentType)
+	}
+
+	switch encoding := string(ctx.Request.Header.ContentEncoding()); encoding {
+	case "", "identity":
+		body = ctx.Request.Body()
+	case "gzip":
+		if body, err = ctx.Request.BodyGunzip(); err != nil {
+			return nil, false, err
+		}
+	default:
+		return nil, false, fmt.Errorf("unsupported Content-Encoding %s, must be gzip", encoding)
+	}
+
+	return body, isJSON, nil
+}
+
+// Slice of the OTLP resources or scopes
+type otlpSlice[E any] interface {
+	Len() int
+	At(i int) E
+	AppendEmpty() E
+}
+
+type otlpResource interface {
+	Resource() pcommon.Resource
+	SchemaUrl() string
+	SetSchemaUrl(v string)
+}
+
+type otlpScope[S any] interface {
+	Scope() pcommon.InstrumentationScope
+	CopyTo(dest S)
+}
+
+// Accessors of the signal-specific pdata types, all of them consist of resources which contain scopes
+type otlpSignal[T any, R otlpResource, S otlpScope[S]] struct {
+	new       func() T
+	resources func(T) otlpSlice[R]
+	scopes    func(R) otlpSlice[S]
+	// Number of the data points, log records or spans
+	count    func(T) int
+	marshal  func(T) ([]byte, error)
+	received *prometheus.CounterVec
+}
+
+// Creates per-tenant export requests.
+// Resources are split by scope if the scopes belong to different tenants.
+func createOTLPRequests[T any, R otlpResource, S otlpScope[S]](p *processor, in T, sig otlpSignal[T, R, S], src sourceTenant) (map[string]func() ([]byte, error), error) {
+	m := map[string]T{}
+
+	rs := sig.resources(in)
+	for i := 0; i < rs.Len(); i++ {
+		r := rs.At(i)
+		rOut := map[string]R{}
+
+		ss := sig.scopes(r)
+		for j := 0; j < ss.Len(); j++ {
+			s := ss.At(j)
+
+			tenant, key, inScope, err := p.processOTLPAttributes(r.Resource().Attributes(), s.Scope().Attributes(), src)
+			if err != nil {
+				return nil, err
+			}
+
+			out, ok := m[tenant]
+			if !ok {
+				out = sig.new()
+				m[tenant] = out
+			}
+
+			rTenant, ok := rOut[tenant]
+			if !ok {
+				rTenant = sig.resources(out).AppendEmpty()
+				r.Resource().CopyTo(rTenant.Resource())
+				rTenant.SetSchemaUrl(r.SchemaUrl())
+				rOut[tenant] = rTenant
+
+				if p.cfg.Tenant.LabelRemove && key != "" && !inScope {
+					rTenant.Resource().Attributes().Remove(key)
+				}
+			}
+
+			sTenant := sig.scopes(rTenant).AppendEmpty()
+			s.CopyTo(sTenant)
+
+			if p.cfg.Tenant.LabelRemove && key != "" && inScope {
+				sTenant.Scope().Attributes().Remove(key)
+			}
+		}
+	}
+
+	// Marshal results
+	resM := make(map[string]func() ([]byte, error), len(m))
+	for tenant, out := range m {
+		if p.cfg.MetricsIncludeTenant {
+			sig.received.WithLabelValues(tenant).Add(float64(sig.count(out)))
+		} else {
+			sig.received.WithLabelValues("").Add(float64(sig.count(out)))
+		}
+
+		resM[tenant] = func() ([]byte, error) {
+			return sig.marshal(out)
+		}
+	}
+
+	return resM, nil
+}
+
+// Resolves the tenant from the resource and scope attributes the same way as from the labels.
+// Scope attributes take precedence over the resource ones.
+// Returns the attribute key the tenant was found in (empty if it's not derived from the attributes)
+// and whether it was found in the scope attributes.
+func (p *processor) processOTLPAttributes(resource, scope pcommon.Map, src sourceTenant) (tenant, key string, inScope bool, err error) {
+	if src.override {
+		return src.tenant, "", false, nil
+	}
+
+	attrs := resource
+	if k, _ := findMatchingAttribute(scope, p.cfg.Tenant.AttributeList); k != "" {
+		attrs, inScope = scope, true
+	}
+
+	tenant, used, err := p.resolveTenantBy(p.attributeTemplate, func(name string) string {
+		if v, ok := attrs.Get(name); ok {
+			return v.AsString()
+		}
+
+		return ""
+	}, src)
+	if err != nil {
+		return "", "", false, err
+	}
+
+	if len(used) == 0 {
+		return tenant, "", false, nil
+	}
+
+	return tenant, used[0], inScope, nil
+}
+
+// Returns the first non-empty attribute from the given list
+func findMatchingAttribute(attrs pcommon.Map, names []string) (key, value string) {
+	for _, name := range names {
+		v, ok := attrs.Get(name)
+		if !ok {
+			continue
+		}
+
+		if value = v.AsString(); value != "" {
+			return name, value
+		}
+	}
+
+	return "", ""
+}
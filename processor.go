@@ -7,7 +7,11 @@ import (
 	"encoding/base64"
 	"fmt"
 	"io/ioutil"
+	"maps"
 	"net"
+	"os"
+	"slices"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -15,18 +19,63 @@ import (
 	"github.com/blind-oracle/go-common/logger"
 	"github.com/dyson/certman"
 	"github.com/google/uuid"
+	me "github.com/hashicorp/go-multierror"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
 	fh "github.com/valyala/fasthttp"
 )
 
 type result struct {
 	code     int
 	body     []byte
+	headers  map[string]string
 	duration float64
 	tenant   string
 	err      error
 }
 
+// Describes the wire format of the outgoing request body
+type format struct {
+	contentType     string
+	contentEncoding string
+	rwVersion       string
+	// Whether the tenant is injected as a label instead of the header if tenant.inject_label is set
+	injectable bool
+	// Merges the requests of several tenants into one for the single-tenant target in the inject mode
+	merge func(bodies [][]byte) ([]byte, error)
+}
+
+var (
+	formatPromWrite = format{
+		contentType:     "application/x-protobuf",
+		contentEncoding: "snappy",
+		rwVersion:       "0.1.0",
+		injectable:      true,
+		merge:           mergeSnappyProto,
+	}
+	formatPromWriteV2 = format{
+		contentType:     "application/x-protobuf;proto=" + remoteWriteProtoV2,
+		contentEncoding: "snappy",
+		rwVersion:       "2.0.0",
+		injectable:      true,
+		merge:           mergePromWriteV2,
+	}
+	formatLokiPush = format{
+		contentType:     "application/x-protobuf",
+		contentEncoding: "snappy",
+		rwVersion:       "0.1.0",
+		injectable:      true,
+		merge:           mergeSnappyProto,
+	}
+)
+
+// Upstream request metrics of a specific signal type
+type requestMetrics struct {
+	requests *prometheus.CounterVec
+	errors   *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+}
+
 type processor struct {
 	cfg config
 
@@ -40,6 +89,25 @@ type processor struct {
 	auth struct {
 		egressHeader []byte
 	}
+
+	bearerAuth         *bearerAuth
+	basicAuth          *basicAuth
+	authorizationRules []*authorizationRule
+	sourceNetworks     *sourceNetworks
+
+	tenantTemplate *tenantTemplate
+	// Picks the tenant from the OTLP attributes
+	attributeTemplate *tenantTemplate
+	tenantMapper      *tenantMapper
+
+	namespaceResolver *namespaceResolver
+
+	relabel     relabelRules
+	tenantRules map[string]relabelRules
+	routes      []*route
+
+	syslog          *syslogBatcher
+	syslogListeners []*syslogListener
 }
 
 func newProcessor(c config) (*processor, error) {
@@ -85,6 +153,56 @@ func newProcessor(c config) (*processor, error) {
 		p.cli.TLSConfig.RootCAs = caCertPool
 	}
 
+	tt, err := newTenantTemplate(c)
+	if err != nil {
+		return nil, err
+	}
+	p.tenantTemplate = tt
+	p.attributeTemplate = &tenantTemplate{
+		labelList:      c.Tenant.AttributeList,
+		kind:           "attribute",
+		namespaceLabel: c.Tenant.Kubernetes.NamespaceAttribute,
+	}
+
+	if p.tenantMapper, err = newTenantMapper(c, p.cli.TLSConfig); err != nil {
+		return nil, err
+	}
+
+	if p.namespaceResolver, err = newNamespaceResolver(c); err != nil {
+		return nil, err
+	}
+
+	if p.relabel, err = newRelabelRules(nil, c.RelabelConfigs); err != nil {
+		return nil, err
+	}
+
+	if p.routes, err = newRoutes(c); err != nil {
+		return nil, err
+	}
+
+	p.tenantRules = map[string]relabelRules{}
+	for tenant, tc := range c.Tenants {
+		if p.tenantRules[tenant], err = newRelabelRules(tc.ExternalLabels, tc.RelabelConfigs); err != nil {
+			return nil, errors.Wrapf(err, "tenant %s", tenant)
+		}
+	}
+
+	if p.bearerAuth, err = newBearerAuth(c); err != nil {
+		return nil, err
+	}
+
+	if p.basicAuth, err = newBasicAuth(c); err != nil {
+		return nil, err
+	}
+
+	if p.authorizationRules, err = newAuthorizationRules(c); err != nil {
+		return nil, err
+	}
+
+	if p.sourceNetworks, err = newSourceNetworks(c); err != nil {
+		return nil, err
+	}
+
 	if c.Auth.Egress.Username != "" {
 		authString := []byte(fmt.Sprintf("%s:%s", c.Auth.Egress.Username, c.Auth.Egress.Password))
 		p.auth.egressHeader = []byte("Basic " + base64.StdEncoding.EncodeToString(authString))
@@ -104,6 +222,37 @@ func newProcessor(c config) (*processor, error) {
 		}
 
 		p.srv.TLSConfig.GetCertificate = cm.GetCertificate
+
+		if caFile := c.Auth.Ingress.TlsConfig.ClientCAFile; caFile != "" {
+			caCert, err := os.ReadFile(caFile)
+			if err != nil {
+				return nil, errors.Wrap(err, "Unable to load client CA file")
+			}
+
+			caCertPool := x509.NewCertPool()
+			if !caCertPool.AppendCertsFromPEM(caCert) {
+				return nil, fmt.Errorf("no certificates found in the client CA file %s", caFile)
+			}
+
+			p.srv.TLSConfig.ClientCAs = caCertPool
+			p.srv.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+			if c.Auth.Ingress.TlsConfig.ClientAuth == clientAuthVerifyIfGiven {
+				p.srv.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+			}
+		}
+	}
+
+	for _, lc := range c.Syslog.Listeners {
+		l, err := newSyslogListener(p, lc)
+		if err != nil {
+			return nil, err
+		}
+
+		p.syslogListeners = append(p.syslogListeners, l)
+	}
+
+	if len(p.syslogListeners) > 0 {
+		p.syslog = newSyslogBatcher(p)
 	}
 
 	// For testing
@@ -135,6 +284,37 @@ func (p *processor) run() (err error) {
 		// overriden the static behaviour with CertMan in the processor setup.
 		go p.srv.ServeTLS(l, "", "")
 	}
+
+	if p.tenantMapper != nil {
+		if err = p.tenantMapper.start(); err != nil {
+			return
+		}
+	}
+
+	if p.namespaceResolver != nil {
+		p.namespaceResolver.start()
+	}
+
+	if p.bearerAuth != nil && p.bearerAuth.jwt != nil {
+		p.bearerAuth.jwt.start()
+	}
+
+	if p.basicAuth != nil {
+		if err = p.basicAuth.start(); err != nil {
+			return
+		}
+	}
+
+	if p.syslog != nil {
+		go p.syslog.run()
+	}
+
+	for _, sl := range p.syslogListeners {
+		if err = sl.run(); err != nil {
+			return errors.Wrap(err, "Unable to start syslog listener")
+		}
+	}
+
 	return
 }
 
@@ -147,6 +327,15 @@ func (p *processor) handle(ctx *fh.RequestCtx) {
 		return
 	}
 
+	if !p.checkSourceNetwork(ctx) {
+		return
+	}
+
+	// Splunk HEC endpoints are authenticated with their own tokens
+	if !bytes.HasPrefix(ctx.Path(), []byte("/services/collector")) && !p.authenticate(ctx) {
+		return
+	}
+
 	if !bytes.Equal(ctx.Request.Header.Method(), []byte("POST")) {
 		ctx.Error("Expecting POST", fh.StatusBadRequest)
 		return
@@ -162,10 +351,82 @@ func (p *processor) handle(ctx *fh.RequestCtx) {
 		return
 	}
 
+	if tenant, ok := pathTenant(ctx.Path(), "/push/"); ok {
+		ctx.SetUserValue(userValueTenant, tenant)
+		p.handleMetrics(ctx)
+		return
+	}
+
+	if tenant, ok := pathTenant(ctx.Path(), "/loki/push/"); ok {
+		ctx.SetUserValue(userValueTenant, tenant)
+		p.handleLogs(ctx)
+		return
+	}
+
+	if bytes.Equal(ctx.Path(), []byte("/otlp/v1/metrics")) {
+		p.handleOTLPMetrics(ctx)
+		return
+	}
+
+	if bytes.Equal(ctx.Path(), []byte("/otlp/v1/logs")) {
+		p.handleOTLPLogs(ctx)
+		return
+	}
+
+	if bytes.Equal(ctx.Path(), []byte("/otlp/v1/traces")) {
+		p.handleOTLPTraces(ctx)
+		return
+	}
+
+	if bytes.Equal(ctx.Path(), []byte("/api/v2/write")) || bytes.Equal(ctx.Path(), []byte("/write")) {
+		p.handleInflux(ctx)
+		return
+	}
+
+	if bytes.Equal(ctx.Path(), []byte("/api/v1/import/prometheus")) {
+		p.handleImport(ctx)
+		return
+	}
+
+	if bytes.Equal(ctx.Path(), []byte("/api/v2/alerts")) {
+		p.handleAlerts(ctx)
+		return
+	}
+
+	if bytes.Equal(ctx.Path(), []byte(pyroscopePushPath)) {
+		p.handleProfilesPush(ctx)
+		return
+	}
+
+	if bytes.Equal(ctx.Path(), []byte(pyroscopeIngestPath)) {
+		p.handleProfilesIngest(ctx)
+		return
+	}
+
+	if bytes.Equal(ctx.Path(), []byte("/_bulk")) {
+		p.handleElasticsearchBulk(ctx)
+		return
+	}
+
+	if bytes.Equal(ctx.Path(), []byte("/services/collector/event")) || bytes.Equal(ctx.Path(), []byte("/services/collector")) {
+		p.handleSplunkEvent(ctx)
+		return
+	}
+
+	if bytes.Equal(ctx.Path(), []byte("/services/collector/raw")) {
+		p.handleSplunkRaw(ctx)
+		return
+	}
+
 	ctx.SetStatusCode(fh.StatusNotFound)
 }
 
-func (p *processor) dispatch(target string, clientIP net.Addr, reqID uuid.UUID, tenantPrefix string, m map[string]func() ([]byte, error)) (res []result) {
+func (p *processor) dispatch(target string, f format, clientIP net.Addr, reqID uuid.UUID, tenantPrefix string, m map[string]func() ([]byte, error)) (res []result) {
+	// The single-tenant target gets all the tenants in one request
+	if p.cfg.Tenant.InjectLabel != "" && f.injectable && len(m) > 1 {
+		return p.dispatchMerged(target, f, clientIP, reqID, tenantPrefix, m)
+	}
+
 	var wg sync.WaitGroup
 	res = make([]result, len(m))
 
@@ -176,7 +437,7 @@ func (p *processor) dispatch(target string, clientIP net.Addr, reqID uuid.UUID,
 		go func(idx int, tenant string, bodyFunc func() ([]byte, error)) {
 			defer wg.Done()
 
-			r := p.send(target, clientIP, reqID, tenant, bodyFunc)
+			r := p.send(target, f, clientIP, reqID, tenant, bodyFunc)
 			res[idx] = r
 		}(i, tenantPrefix+tenant, bodyFunc)
 
@@ -187,7 +448,34 @@ func (p *processor) dispatch(target string, clientIP net.Addr, reqID uuid.UUID,
 	return
 }
 
-func (p *processor) send(target string, clientIP net.Addr, reqID uuid.UUID, tenant string, bodyFunc func() ([]byte, error)) (r result) {
+// Sends the requests of all the tenants merged into one, its result is reported for each of them
+func (p *processor) dispatchMerged(target string, f format, clientIP net.Addr, reqID uuid.UUID, tenantPrefix string, m map[string]func() ([]byte, error)) []result {
+	tenants := slices.Sorted(maps.Keys(m))
+
+	r := p.send(target, f, clientIP, reqID, "", func() ([]byte, error) {
+		bodies := make([][]byte, 0, len(tenants))
+		for _, tenant := range tenants {
+			b, err := m[tenant]()
+			if err != nil {
+				return nil, err
+			}
+
+			bodies = append(bodies, b)
+		}
+
+		return f.merge(bodies)
+	})
+
+	res := make([]result, len(tenants))
+	for i, tenant := range tenants {
+		res[i] = r
+		res[i].tenant = tenantPrefix + tenant
+	}
+
+	return res
+}
+
+func (p *processor) send(target string, f format, clientIP net.Addr, reqID uuid.UUID, tenant string, bodyFunc func() ([]byte, error)) (r result) {
 	start := time.Now()
 	r.tenant = tenant
 
@@ -205,7 +493,7 @@ func (p *processor) send(target string, clientIP net.Addr, reqID uuid.UUID, tena
 		return
 	}
 
-	p.fillRequestHeaders(clientIP, reqID, tenant, req)
+	p.fillRequestHeaders(f, clientIP, reqID, tenant, req)
 
 	if p.auth.egressHeader != nil {
 		req.Header.SetBytesV("Authorization", p.auth.egressHeader)
@@ -223,19 +511,120 @@ func (p *processor) send(target string, clientIP net.Addr, reqID uuid.UUID, tena
 	r.code = resp.Header.StatusCode()
 	r.body = make([]byte, len(resp.Body()))
 	copy(r.body, resp.Body())
+	r.headers = map[string]string{}
+	resp.Header.VisitAll(func(k, v []byte) {
+		r.headers[string(k)] = string(v)
+	})
 	r.duration = time.Since(start).Seconds() / 1000
 
 	return
 }
 
 func (p *processor) fillRequestHeaders(
-	clientIP net.Addr, reqID uuid.UUID, tenant string, req *fh.Request) {
-	req.Header.Set("Content-Encoding", "snappy")
-	req.Header.Set("Content-Type", "application/x-protobuf")
-	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	f format, clientIP net.Addr, reqID uuid.UUID, tenant string, req *fh.Request) {
+	if f.contentEncoding != "" {
+		req.Header.Set("Content-Encoding", f.contentEncoding)
+	}
+	req.Header.Set("Content-Type", f.contentType)
+	if f.rwVersion != "" {
+		req.Header.Set("X-Prometheus-Remote-Write-Version", f.rwVersion)
+	}
 	req.Header.Set("X-Cortex-Tenant-Client", clientIP.String())
 	req.Header.Set("X-Cortex-Tenant-ReqID", reqID.String())
-	req.Header.Set(p.cfg.Tenant.Header, tenant)
+
+	// The single-tenant target gets the tenant as a label
+	if p.cfg.Tenant.InjectLabel == "" || !f.injectable {
+		req.Header.Set(p.cfg.Tenant.Header, tenant)
+	}
+}
+
+// Returns the prefix to prepend to the tenants of the request
+func (p *processor) tenantPrefix(ctx *fh.RequestCtx) string {
+	if p.cfg.Auth.Ingress.ClientCert.TenantMode == identityTenantModePrefix {
+		if ids := p.clientCertIdentities(ctx); len(ids) > 0 {
+			return ids[0] + "-"
+		}
+	}
+
+	if p.cfg.Tenant.PrefixPreferSource {
+		sourceTenantPrefix := string(ctx.Request.Header.Peek(p.cfg.Tenant.Header))
+		if sourceTenantPrefix != "" {
+			return sourceTenantPrefix + "-"
+		}
+	}
+
+	return p.cfg.Tenant.Prefix
+}
+
+// Aggregates the per-tenant upstream results into a response.
+// Returns true if the request was handled without errors.
+func (p *processor) handleResults(ctx *fh.RequestCtx, clientIP net.Addr, reqID uuid.UUID, results []result, rm requestMetrics) bool {
+	// Return 204 regardless of errors if AcceptAll is enabled
+	if p.cfg.Tenant.AcceptAll {
+		ctx.SetBody(nil)
+		ctx.SetStatusCode(204)
+		return true
+	}
+
+	code, body, err := p.recordResults(clientIP, reqID, p.identityName(ctx), results, rm)
+	if err != nil {
+		ctx.Error(err.Error(), fh.StatusInternalServerError)
+		return false
+	}
+
+	// Pass back max status code from upstream response
+	ctx.SetBody(body)
+	ctx.SetStatusCode(code)
+	return true
+}
+
+// Updates the request metrics and logs the failures.
+// Returns the max status code with its body and the combined send errors.
+func (p *processor) recordResults(clientIP net.Addr, reqID uuid.UUID, identity string, results []result, rm requestMetrics) (code int, body []byte, err error) {
+	metricTenant := ""
+	var errs *me.Error
+
+	src := logSource(clientIP, identity)
+
+	body = []byte("Ok")
+
+	for _, r := range results {
+		if p.cfg.MetricsIncludeTenant {
+			metricTenant = r.tenant
+		}
+
+		rm.requests.WithLabelValues(metricTenant).Inc()
+
+		if r.err != nil {
+			rm.errors.WithLabelValues(metricTenant).Inc()
+			errs = me.Append(errs, r.err)
+			p.Errorf("src=%s req_id=%s %s", src, reqID, r.err)
+			continue
+		}
+
+		if r.code < 200 || r.code >= 300 {
+			if p.cfg.LogResponseErrors {
+				p.Errorf("src=%s req_id=%s HTTP code %d (%s)", src, reqID, r.code, string(r.body))
+			}
+		}
+
+		if r.code > code {
+			code, body = r.code, r.body
+		}
+
+		rm.duration.WithLabelValues(strconv.Itoa(r.code), metricTenant).Observe(r.duration)
+	}
+
+	return code, body, errs.ErrorOrNil()
+}
+
+// Formats the client address and the identity, if any, for the logs
+func logSource(clientIP net.Addr, identity string) string {
+	if identity == "" {
+		return clientIP.String()
+	}
+
+	return clientIP.String() + " identity=" + identity
 }
 
 func (p *processor) close() (err error) {
@@ -244,5 +633,29 @@ func (p *processor) close() (err error) {
 	// Let healthcheck detect that we're offline
 	time.Sleep(p.cfg.TimeoutShutdown)
 	// Shutdown
+	for _, sl := range p.syslogListeners {
+		sl.close()
+	}
+
+	if p.syslog != nil {
+		p.syslog.close()
+	}
+
+	if p.tenantMapper != nil {
+		p.tenantMapper.close()
+	}
+
+	if p.namespaceResolver != nil {
+		p.namespaceResolver.close()
+	}
+
+	if p.bearerAuth != nil && p.bearerAuth.jwt != nil {
+		p.bearerAuth.jwt.close()
+	}
+
+	if p.basicAuth != nil {
+		p.basicAuth.close()
+	}
+
 	return p.srv.Shutdown()
 }
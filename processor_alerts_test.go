@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	fh "github.com/valyala/fasthttp"
+	fhu "github.com/valyala/fasthttp/fasthttputil"
+)
+
+const testAlerts = `[
+	{"labels": {"alertname": "A", "__tenant__": "foobar"}, "annotations": {"summary": "a"}, "startsAt": "2024-01-01T00:00:00Z"},
+	{"labels": {"alertname": "B", "__tenant__": "foobaz"}},
+	{"labels": {"alertname": "C", "__tenant__": "foobar"}},
+	{"labels": {"alertname": "D"}}
+]`
+
+func Test_createAlertsRequests(t *testing.T) {
+	cfg, err := getConfig(testConfig)
+	require.NoError(t, err)
+	cfg.Tenant.LabelRemove = true
+
+	p, err := newProcessor(*cfg)
+	require.NoError(t, err)
+
+	var alertsIn []alert
+	require.NoError(t, json.Unmarshal([]byte(testAlerts), &alertsIn))
+
+	m, err := p.createAlertsRequests(alertsIn, sourceTenant{})
+	require.NoError(t, err)
+	require.Len(t, m, 3)
+
+	buf, err := m["foobar"]()
+	require.NoError(t, err)
+	assert.JSONEq(t, `[
+		{"labels": {"alertname": "A"}, "annotations": {"summary": "a"}, "startsAt": "2024-01-01T00:00:00Z"},
+		{"labels": {"alertname": "C"}}
+	]`, string(buf))
+
+	buf, err = m["default"]()
+	require.NoError(t, err)
+	assert.JSONEq(t, `[{"labels": {"alertname": "D"}}]`, string(buf))
+
+	// No default tenant
+	cfg.Tenant.Default = ""
+	p, err = newProcessor(*cfg)
+	require.NoError(t, err)
+
+	require.NoError(t, json.Unmarshal([]byte(testAlerts), &alertsIn))
+	_, err = p.createAlertsRequests(alertsIn, sourceTenant{})
+	assert.ErrorContains(t, err, "alert 3")
+}
+
+func Test_handle_alerts(t *testing.T) {
+	cfg, err := getConfig(testConfig)
+	require.NoError(t, err)
+
+	cfg.pipeIn = fhu.NewInmemoryListener()
+	cfg.pipeOut = fhu.NewInmemoryListener()
+
+	// Disabled without a target
+	p, err := newProcessor(*cfg)
+	require.NoError(t, err)
+
+	ctx := &fh.RequestCtx{}
+	ctx.Request.Header.SetMethod("POST")
+	ctx.Request.SetRequestURI("/api/v2/alerts")
+	ctx.Request.SetBodyString(testAlerts)
+
+	p.handle(ctx)
+	assert.Equal(t, 404, ctx.Response.StatusCode())
+
+	cfg.TargetAlertmanager = "http://127.0.0.1/alertmanager/api/v2/alerts"
+
+	p, err = newProcessor(*cfg)
+	require.NoError(t, err)
+	runProcessor(t, p)
+
+	tenants := make(chan string, 3)
+	s := &fh.Server{
+		Handler: func(ctx *fh.RequestCtx) {
+			var alerts []alert
+			if err := json.Unmarshal(ctx.Request.Body(), &alerts); err != nil {
+				ctx.Error(err.Error(), fh.StatusBadRequest)
+				return
+			}
+
+			tenants <- string(ctx.Request.Header.Peek("X-Scope-OrgID"))
+		},
+	}
+	go s.Serve(cfg.pipeOut)
+
+	c := &fh.Client{
+		Dial: func(a string) (net.Conn, error) {
+			return cfg.pipeIn.Dial()
+		},
+	}
+
+	req := fh.AcquireRequest()
+	resp := fh.AcquireResponse()
+
+	req.Header.SetMethod("POST")
+	req.SetRequestURI("http://127.0.0.1/api/v2/alerts")
+	req.Header.SetContentType("application/json")
+	req.SetBodyString(testAlerts)
+
+	require.NoError(t, c.Do(req, resp))
+	assert.Equal(t, 200, resp.StatusCode())
+	assert.ElementsMatch(t, []string{"foobar", "foobaz", "default"}, []string{<-tenants, <-tenants, <-tenants})
+
+	// Broken body
+	req.SetBodyString("{")
+	resp.Reset()
+
+	require.NoError(t, c.Do(req, resp))
+	assert.Equal(t, 400, resp.StatusCode())
+}
@@ -0,0 +1,697 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	fh "github.com/valyala/fasthttp"
+	fhu "github.com/valyala/fasthttp/fasthttputil"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const testBearerTokens = `
+- token: token-a
+  identity: team-a
+  tenant: team-a
+- token: token-ci
+  identity: ci
+  tenants: [foobar, default]
+- token: token-any
+`
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// Generates the RSA, EC and Ed25519 keys and the JWKS with their public parts
+func generateJWKS(t *testing.T) (map[string]any, []byte) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	edPub, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	b, err := json.Marshal(map[string]any{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "rsa", "use": "sig", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+		{"kty": "EC", "kid": "ec", "crv": "P-256", "x": b64(ecKey.X.Bytes()), "y": b64(ecKey.Y.Bytes())},
+		{"kty": "OKP", "kid": "ed", "crv": "Ed25519", "x": b64(edPub)},
+		{"kty": "RSA", "kid": "enc", "use": "enc", "n": "foo", "e": "bar"},
+	}})
+	require.NoError(t, err)
+
+	return map[string]any{"rsa": rsaKey, "ec": ecKey, "ed": edKey}, b
+}
+
+func signJWT(t *testing.T, method jwt.SigningMethod, kid string, key any, claims jwt.MapClaims) string {
+	tok := jwt.NewWithClaims(method, claims)
+	tok.Header["kid"] = kid
+
+	s, err := tok.SignedString(key)
+	require.NoError(t, err)
+
+	return s
+}
+
+func Test_parseJWKS(t *testing.T) {
+	_, b := generateJWKS(t)
+
+	keys, err := parseJWKS(b)
+	require.NoError(t, err)
+	assert.Len(t, keys, 3)
+	assert.IsType(t, &rsa.PublicKey{}, keys["rsa"])
+	assert.IsType(t, &ecdsa.PublicKey{}, keys["ec"])
+	assert.IsType(t, ed25519.PublicKey{}, keys["ed"])
+
+	for _, s := range []string{
+		`foo`,
+		`{"keys": []}`,
+		`{"keys": [{"kty": "RSA", "kid": "foo", "n": "", "e": "AQAB"}]}`,
+		`{"keys": [{"kty": "EC", "kid": "foo", "crv": "P-256", "x": "AQAB", "y": "AQAB"}]}`,
+		`{"keys": [{"kty": "EC", "kid": "foo", "crv": "P-224", "x": "AQAB", "y": "AQAB"}]}`,
+		`{"keys": [{"kty": "OKP", "kid": "foo", "crv": "Ed25519", "x": "AQAB"}]}`,
+	} {
+		_, err = parseJWKS([]byte(s))
+		assert.Error(t, err, s)
+	}
+}
+
+func Test_parseBearerTokens(t *testing.T) {
+	tokens, err := parseBearerTokens([]byte(testBearerTokens))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]*identity{
+		"token-a":   {name: "team-a", tenant: "team-a"},
+		"token-ci":  {name: "ci", allowed: []string{"foobar", "default"}},
+		"token-any": {name: "2"},
+	}, tokens)
+
+	for _, s := range []string{
+		`foo`,
+		`[{identity: foo}]`,
+		`[{token: foo, tenant: foo, tenants: [bar]}]`,
+		`[{token: foo}, {token: foo}]`,
+		`[{token: foo, foo: bar}]`,
+	} {
+		_, err = parseBearerTokens([]byte(s))
+		assert.Error(t, err, s)
+	}
+}
+
+func Test_jwtVerifier(t *testing.T) {
+	keys, b := generateJWKS(t)
+
+	file := filepath.Join(t.TempDir(), "jwks.json")
+	require.NoError(t, os.WriteFile(file, b, 0o644))
+
+	cfg, err := getConfig(testConfig)
+	require.NoError(t, err)
+
+	cfg.Auth.Ingress.Bearer.JWT.JWKSFile = file
+	cfg.Auth.Ingress.Bearer.JWT.Issuer = "issuer"
+	cfg.Auth.Ingress.Bearer.JWT.Audience = "cortex-tenant"
+
+	v, err := newJWTVerifier(*cfg)
+	require.NoError(t, err)
+
+	exp := time.Now().Add(time.Hour).Unix()
+	claims := func(tenant any) jwt.MapClaims {
+		return jwt.MapClaims{"sub": "foo", "iss": "issuer", "aud": "cortex-tenant", "exp": exp, "tenant": tenant}
+	}
+
+	for _, tc := range []struct {
+		method jwt.SigningMethod
+		kid    string
+	}{
+		{jwt.SigningMethodRS256, "rsa"},
+		{jwt.SigningMethodES256, "ec"},
+		{jwt.SigningMethodEdDSA, "ed"},
+	} {
+		id, err := v.verify(signJWT(t, tc.method, tc.kid, keys[tc.kid], claims("team-a")))
+		require.NoError(t, err, tc.kid)
+		assert.Equal(t, &identity{name: "foo", tenant: "team-a"}, id, tc.kid)
+	}
+
+	id, err := v.verify(signJWT(t, jwt.SigningMethodRS256, "rsa", keys["rsa"], claims([]string{"team-a", "team-b"})))
+	require.NoError(t, err)
+	assert.Equal(t, &identity{name: "foo", allowed: []string{"team-a", "team-b"}}, id)
+
+	id, err = v.verify(signJWT(t, jwt.SigningMethodRS256, "rsa", keys["rsa"], claims(nil)))
+	require.NoError(t, err)
+	assert.Equal(t, &identity{name: "foo"}, id)
+
+	expired := claims("team-a")
+	expired["exp"] = time.Now().Add(-time.Hour).Unix()
+
+	wrongIssuer := claims("team-a")
+	wrongIssuer["iss"] = "foo"
+
+	noExpiry := claims("team-a")
+	delete(noExpiry, "exp")
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	for name, tok := range map[string]string{
+		"expired":       signJWT(t, jwt.SigningMethodRS256, "rsa", keys["rsa"], expired),
+		"wrong issuer":  signJWT(t, jwt.SigningMethodRS256, "rsa", keys["rsa"], wrongIssuer),
+		"no expiry":     signJWT(t, jwt.SigningMethodRS256, "rsa", keys["rsa"], noExpiry),
+		"unknown kid":   signJWT(t, jwt.SigningMethodRS256, "foo", keys["rsa"], claims("team-a")),
+		"wrong key":     signJWT(t, jwt.SigningMethodRS256, "rsa", otherKey, claims("team-a")),
+		"hmac":          signJWT(t, jwt.SigningMethodHS256, "rsa", []byte("secret"), claims("team-a")),
+		"invalid claim": signJWT(t, jwt.SigningMethodRS256, "rsa", keys["rsa"], claims(1)),
+		"empty claim":   signJWT(t, jwt.SigningMethodRS256, "rsa", keys["rsa"], claims([]string{})),
+		"empty tenant":  signJWT(t, jwt.SigningMethodRS256, "rsa", keys["rsa"], claims("")),
+		"garbage":       "foo.bar.baz",
+	} {
+		_, err = v.verify(tok)
+		assert.Error(t, err, name)
+	}
+
+	// The claim is required once it's configured
+	cfg.Auth.Ingress.Bearer.JWT.TenantClaim = "tenant"
+	v, err = newJWTVerifier(*cfg)
+	require.NoError(t, err)
+
+	noTenant := claims(nil)
+	delete(noTenant, "tenant")
+
+	for _, c := range []jwt.MapClaims{claims(nil), noTenant} {
+		_, err = v.verify(signJWT(t, jwt.SigningMethodRS256, "rsa", keys["rsa"], c))
+		assert.ErrorContains(t, err, "claim 'tenant' is missing")
+	}
+
+	id, err = v.verify(signJWT(t, jwt.SigningMethodRS256, "rsa", keys["rsa"], claims("team-a")))
+	require.NoError(t, err)
+	assert.Equal(t, &identity{name: "foo", tenant: "team-a"}, id)
+}
+
+func Test_jwtVerifier_remote(t *testing.T) {
+	keys, b := generateJWKS(t)
+
+	var (
+		mtx  sync.Mutex
+		code = fh.StatusOK
+	)
+
+	l := fhu.NewInmemoryListener()
+	s := &fh.Server{
+		Handler: func(ctx *fh.RequestCtx) {
+			mtx.Lock()
+			defer mtx.Unlock()
+
+			ctx.SetStatusCode(code)
+			ctx.SetBody(b)
+		},
+	}
+	go s.Serve(l)
+	defer s.Shutdown()
+
+	cfg, err := getConfig(testConfig)
+	require.NoError(t, err)
+
+	cfg.Auth.Ingress.Bearer.JWT.JWKSURL = "http://jwks/keys"
+
+	v, err := newJWTVerifier(*cfg)
+	require.NoError(t, err)
+
+	v.cli.Dial = func(string) (net.Conn, error) {
+		return l.Dial()
+	}
+
+	tok := signJWT(t, jwt.SigningMethodES256, "ec", keys["ec"], jwt.MapClaims{"sub": "foo", "exp": time.Now().Add(time.Hour).Unix()})
+
+	// No keys before the first fetch
+	_, err = v.verify(tok)
+	assert.Error(t, err)
+
+	require.NoError(t, v.fetch())
+
+	id, err := v.verify(tok)
+	require.NoError(t, err)
+	assert.Equal(t, "foo", id.name)
+
+	mtx.Lock()
+	code = fh.StatusInternalServerError
+	mtx.Unlock()
+
+	errs := testutil.ToFloat64(metricJWKSReloadErrors)
+	v.reload()
+	assert.Equal(t, errs+1, testutil.ToFloat64(metricJWKSReloadErrors))
+
+	// The previous keys are kept
+	_, err = v.verify(tok)
+	assert.NoError(t, err)
+}
+
+func Test_bearerAuth(t *testing.T) {
+	keys, b := generateJWKS(t)
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "tokens.yml"), []byte(testBearerTokens), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "jwks.json"), b, 0o644))
+
+	cfg, err := getConfig(testConfig)
+	require.NoError(t, err)
+
+	cfg.Auth.Ingress.Bearer.TokensFile = filepath.Join(dir, "tokens.yml")
+	cfg.Auth.Ingress.Bearer.JWT.JWKSFile = filepath.Join(dir, "jwks.json")
+	cfg.TargetOTLP = "http://127.0.0.1/otlp/v1/metrics"
+	cfg.pipeOut = fhu.NewInmemoryListener()
+
+	var (
+		mtx     sync.Mutex
+		tenants []string
+	)
+
+	s := &fh.Server{
+		Handler: func(ctx *fh.RequestCtx) {
+			mtx.Lock()
+			tenants = append(tenants, string(ctx.Request.Header.Peek("X-Scope-OrgID")))
+			mtx.Unlock()
+		},
+	}
+	go s.Serve(cfg.pipeOut)
+	defer s.Shutdown()
+
+	p, err := newProcessor(*cfg)
+	require.NoError(t, err)
+
+	wrq, err := p.marshalPromWrite(&prompb.WriteRequest{Timeseries: []prompb.TimeSeries{
+		{Labels: []prompb.Label{{Name: "__tenant__", Value: "foobar"}}},
+		{Labels: []prompb.Label{{Name: "job", Value: "foo"}}},
+	}})
+	require.NoError(t, err)
+
+	handle := func(uri, auth string) (*fh.RequestCtx, []string) {
+		mtx.Lock()
+		tenants = nil
+		mtx.Unlock()
+
+		ctx := &fh.RequestCtx{}
+		ctx.Request.Header.SetMethod("POST")
+		ctx.Request.SetRequestURI(uri)
+		ctx.Request.SetBody(wrq)
+
+		if auth != "" {
+			ctx.Request.Header.Set("Authorization", auth)
+		}
+
+		p.handle(ctx)
+
+		mtx.Lock()
+		defer mtx.Unlock()
+		return ctx, slices.Sorted(slices.Values(tenants))
+	}
+
+	ctx, _ := handle("/alive", "")
+	assert.Equal(t, 200, ctx.Response.StatusCode())
+
+	failures := func(reason string) float64 {
+		return testutil.ToFloat64(metricAuthFailures.WithLabelValues(reason))
+	}
+
+	missing, invalid := failures(authFailureMissing), failures(authFailureInvalid)
+
+	for _, auth := range []string{"", "Basic Zm9vOmJhcg==", "Bearer "} {
+		ctx, _ = handle("/push", auth)
+		assert.Equal(t, 401, ctx.Response.StatusCode(), auth)
+		assert.Equal(t, "Bearer", string(ctx.Response.Header.Peek("WWW-Authenticate")), auth)
+	}
+
+	ctx, _ = handle("/push", "Bearer foo")
+	assert.Equal(t, 401, ctx.Response.StatusCode())
+
+	assert.Equal(t, missing+3, failures(authFailureMissing))
+	assert.Equal(t, invalid+1, failures(authFailureInvalid))
+
+	jwtClaims := func(tenant any) string {
+		return "Bearer " + signJWT(t, jwt.SigningMethodEdDSA, "ed", keys["ed"], jwt.MapClaims{
+			"sub":    "jwt-client",
+			"exp":    time.Now().Add(time.Hour).Unix(),
+			"tenant": tenant,
+		})
+	}
+
+	for _, tc := range []struct {
+		uri     string
+		auth    string
+		code    int
+		tenants []string
+	}{
+		{"/push", "Bearer token-a", 200, []string{"team-a"}},
+		// The token tenant takes precedence over the URL
+		{"/push/foo", "bearer token-a", 200, []string{"team-a"}},
+		{"/push", "Bearer token-ci", 200, []string{"default", "foobar"}},
+		{"/push/foo", "Bearer token-ci", 403, nil},
+		{"/push", "Bearer token-any", 200, []string{"default", "foobar"}},
+		{"/push", jwtClaims("team-b"), 200, []string{"team-b"}},
+		{"/push", jwtClaims([]string{"foobar"}), 403, nil},
+		{"/push", jwtClaims([]string{"foobar", "default", "team-b"}), 200, []string{"default", "foobar"}},
+	} {
+		ctx, tenants := handle(tc.uri, tc.auth)
+		assert.Equal(t, tc.code, ctx.Response.StatusCode(), tc.auth)
+		assert.Equal(t, tc.tenants, tenants, tc.auth)
+	}
+
+	ctx, _ = handle("/push", "Bearer token-ci")
+	assert.Equal(t, "ci", p.identityName(ctx))
+
+	// The token tenant overrides the tenants in the OTLP attributes
+	otlpReq, err := testOTLPMetrics().MarshalProto()
+	require.NoError(t, err)
+
+	for auth, exp := range map[string][]string{
+		"Bearer token-a":    {"team-a"},
+		jwtClaims("team-b"): {"team-b"},
+		"Bearer token-any":  {"default", "foobar", "foobaz"},
+	} {
+		mtx.Lock()
+		tenants = nil
+		mtx.Unlock()
+
+		ctx = &fh.RequestCtx{}
+		ctx.Request.Header.SetMethod("POST")
+		ctx.Request.SetRequestURI("/otlp/v1/metrics")
+		ctx.Request.Header.SetContentType("application/x-protobuf")
+		ctx.Request.Header.Set("Authorization", auth)
+		ctx.Request.SetBody(otlpReq)
+
+		p.handle(ctx)
+		assert.Equal(t, 200, ctx.Response.StatusCode(), auth)
+
+		mtx.Lock()
+		assert.Equal(t, exp, slices.Sorted(slices.Values(tenants)), auth)
+		mtx.Unlock()
+	}
+
+	// Splunk HEC has its own authentication
+	ctx, _ = handle("/services/collector/event", "")
+	assert.NotEqual(t, 401, ctx.Response.StatusCode())
+
+	file := filepath.Join(t.TempDir(), "config.yml")
+	require.NoError(t, os.WriteFile(file, []byte(`
+auth:
+  ingress:
+    bearer:
+      jwt:
+        jwks_file: foo
+        jwks_url: http://foo
+`), 0o644))
+
+	_, err = configLoad(file)
+	assert.Error(t, err)
+}
+
+func Test_authorization(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "tokens.yml")
+	require.NoError(t, os.WriteFile(file, []byte(`
+- token: t-a
+  identity: team-a
+- token: t-b
+  identity: team-b
+`), 0o644))
+
+	cfg, err := getConfig(testConfig + `
+auth:
+  ingress:
+    bearer:
+      tokens_file: ` + file + `
+authorization:
+  rules:
+    - identity: team-a
+      tenants: [team-a, team-a-*]
+    - cidrs: [10.0.0.0/8]
+      tenants: ["*"]
+`)
+	require.NoError(t, err)
+	assert.Equal(t, authorizationActionReject, cfg.Authorization.Action)
+
+	cfg.pipeOut = fhu.NewInmemoryListener()
+
+	var (
+		mtx     sync.Mutex
+		tenants []string
+	)
+
+	s := &fh.Server{
+		Handler: func(ctx *fh.RequestCtx) {
+			mtx.Lock()
+			tenants = append(tenants, string(ctx.Request.Header.Peek("X-Scope-OrgID")))
+			mtx.Unlock()
+		},
+	}
+	go s.Serve(cfg.pipeOut)
+	defer s.Shutdown()
+
+	handle := func(p *processor, token, ip string, seriesTenants ...string) (int, []string) {
+		wrReq := &prompb.WriteRequest{}
+		for _, tenant := range seriesTenants {
+			wrReq.Timeseries = append(wrReq.Timeseries, prompb.TimeSeries{
+				Labels: []prompb.Label{{Name: "__tenant__", Value: tenant}},
+			})
+		}
+
+		wrq, err := p.marshalPromWrite(wrReq)
+		require.NoError(t, err)
+
+		mtx.Lock()
+		tenants = nil
+		mtx.Unlock()
+
+		req := &fh.Request{}
+		req.Header.SetMethod("POST")
+		req.SetRequestURI("/push")
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.SetBody(wrq)
+
+		ctx := &fh.RequestCtx{}
+		ctx.Init(req, &net.TCPAddr{IP: net.ParseIP(ip)}, nil)
+		p.handle(ctx)
+
+		mtx.Lock()
+		defer mtx.Unlock()
+		return ctx.Response.StatusCode(), slices.Sorted(slices.Values(tenants))
+	}
+
+	p, err := newProcessor(*cfg)
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		token   string
+		ip      string
+		series  []string
+		code    int
+		tenants []string
+	}{
+		{"t-a", "192.168.0.1", []string{"team-a", "team-a-dev"}, 200, []string{"team-a", "team-a-dev"}},
+		{"t-a", "192.168.0.1", []string{"team-a", "foobar"}, 403, nil},
+		// The identity rule matches first
+		{"t-a", "10.1.1.1", []string{"foobar"}, 403, nil},
+		{"t-b", "10.1.1.1", []string{"foobar", "team-a"}, 200, []string{"foobar", "team-a"}},
+		// No rule matches
+		{"t-b", "192.168.0.1", []string{"team-b"}, 403, nil},
+	} {
+		code, tenants := handle(p, tc.token, tc.ip, tc.series...)
+		assert.Equal(t, tc.code, code, tc)
+		assert.Equal(t, tc.tenants, tenants, tc)
+	}
+
+	cfg.Authorization.Action = authorizationActionDrop
+	p, err = newProcessor(*cfg)
+	require.NoError(t, err)
+
+	denied := testutil.ToFloat64(metricAuthorizationDenied.WithLabelValues("team-a", authorizationActionDrop))
+
+	code, tenants := handle(p, "t-a", "192.168.0.1", "team-a", "foobar", "team-b")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, []string{"team-a"}, tenants)
+	assert.Equal(t, denied+2, testutil.ToFloat64(metricAuthorizationDenied.WithLabelValues("team-a", authorizationActionDrop)))
+
+	// Nothing is left to send
+	code, tenants = handle(p, "t-b", "192.168.0.1", "team-b")
+	assert.Equal(t, 200, code)
+	assert.Empty(t, tenants)
+
+	for _, rc := range []authorizationRuleConfig{
+		{Tenants: nil},
+		{CIDRs: []string{"foo"}, Tenants: []string{"*"}},
+	} {
+		cfg.Authorization.Rules = []authorizationRuleConfig{rc}
+		_, err = newProcessor(*cfg)
+		assert.Error(t, err, rc)
+	}
+
+	for _, c := range []string{
+		"authorization:\n  action: foo\n",
+		"authorization:\n  rules:\n    - tenants: [team-a]\ntenant:\n  prefix_prefer_source: true\n",
+	} {
+		file = filepath.Join(t.TempDir(), "config.yml")
+		require.NoError(t, os.WriteFile(file, []byte(c), 0o644))
+
+		_, err = configLoad(file)
+		assert.Error(t, err, c)
+	}
+}
+
+func Test_basicAuth(t *testing.T) {
+	hash := func(password string) string {
+		h, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+		require.NoError(t, err)
+		return string(h)
+	}
+
+	file := filepath.Join(t.TempDir(), "htpasswd")
+	require.NoError(t, os.WriteFile(file, []byte("# comment\n\nfoo:"+hash("bar")+"\n"), 0o644))
+
+	cfg, err := getConfig(testConfig + `
+auth:
+  ingress:
+    basic:
+      htpasswd_file: ` + file + `
+      max_failed_attempts: 3
+`)
+	require.NoError(t, err)
+
+	cfg.pipeIn = fhu.NewInmemoryListener()
+	cfg.pipeOut = fhu.NewInmemoryListener()
+
+	s := &fh.Server{Handler: sinkHandler}
+	go s.Serve(cfg.pipeOut)
+	defer s.Shutdown()
+
+	p, err := newProcessor(*cfg)
+	require.NoError(t, err)
+	runProcessor(t, p)
+
+	wrq, err := p.marshalPromWrite(&prompb.WriteRequest{Timeseries: []prompb.TimeSeries{
+		{Labels: []prompb.Label{{Name: "__tenant__", Value: "foobar"}}},
+	}})
+	require.NoError(t, err)
+
+	handle := func(uri, ip, user, password string) *fh.RequestCtx {
+		req := &fh.Request{}
+		req.Header.SetMethod("POST")
+		req.SetRequestURI(uri)
+		req.SetBody(wrq)
+
+		if user != "" {
+			req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(user+":"+password)))
+		}
+
+		ctx := &fh.RequestCtx{}
+		ctx.Init(req, &net.TCPAddr{IP: net.ParseIP(ip)}, nil)
+		p.handle(ctx)
+
+		return ctx
+	}
+
+	ctx := handle("/alive", "10.0.0.1", "", "")
+	assert.Equal(t, 200, ctx.Response.StatusCode())
+
+	ctx = handle("/push", "10.0.0.1", "", "")
+	assert.Equal(t, 401, ctx.Response.StatusCode())
+	assert.Equal(t, `Basic realm="cortex-tenant"`, string(ctx.Response.Header.Peek("WWW-Authenticate")))
+
+	ctx = handle("/push", "10.0.0.1", "foo", "bar")
+	assert.Equal(t, 200, ctx.Response.StatusCode())
+	assert.Equal(t, "foo", p.identityName(ctx))
+
+	// Served from the cache of the verified credentials
+	ctx = handle("/push", "10.0.0.1", "foo", "bar")
+	assert.Equal(t, 200, ctx.Response.StatusCode())
+
+	limited := testutil.ToFloat64(metricAuthFailures.WithLabelValues(authFailureRateLimited))
+
+	for _, creds := range [][2]string{{"foo", "baz"}, {"bar", "bar"}, {"foo", ""}} {
+		ctx = handle("/push", "10.0.0.2", creds[0], creds[1])
+		assert.Equal(t, 401, ctx.Response.StatusCode(), creds)
+	}
+
+	// Blocked even with the right password
+	ctx = handle("/push", "10.0.0.2", "foo", "bar")
+	assert.Equal(t, 429, ctx.Response.StatusCode())
+	assert.Equal(t, limited+1, testutil.ToFloat64(metricAuthFailures.WithLabelValues(authFailureRateLimited)))
+
+	// The other IPs are not affected
+	ctx = handle("/push", "10.0.0.1", "foo", "bar")
+	assert.Equal(t, 200, ctx.Response.StatusCode())
+
+	// Reloaded on change
+	require.NoError(t, os.WriteFile(file, []byte("foo:"+hash("baz")+"\n"), 0o644))
+
+	assert.Eventually(t, func() bool {
+		return handle("/push", "10.0.0.3", "foo", "baz").Response.StatusCode() == 200
+	}, 5*time.Second, 50*time.Millisecond)
+
+	ctx = handle("/push", "10.0.0.1", "foo", "bar")
+	assert.Equal(t, 401, ctx.Response.StatusCode())
+
+	// The previous users are kept if the file is broken
+	errs := testutil.ToFloat64(metricHtpasswdReloadErrors)
+	require.NoError(t, os.WriteFile(file, []byte("foo:bar\n"), 0o644))
+
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(metricHtpasswdReloadErrors) > errs
+	}, 5*time.Second, 50*time.Millisecond)
+
+	ctx = handle("/push", "10.0.0.3", "foo", "baz")
+	assert.Equal(t, 200, ctx.Response.StatusCode())
+}
+
+func Test_parseHtpasswd(t *testing.T) {
+	for _, s := range []string{
+		"",
+		"# comment",
+		"foo",
+		":$2y$05$abc",
+		"foo:{SHA}Ys23Ag/5IOWqZCw9QGaVDdHwH00=",
+		"foo:$apr1$abc$def",
+	} {
+		_, err := parseHtpasswd([]byte(s))
+		assert.Error(t, err, s)
+	}
+}
+
+func Test_failureLimiter(t *testing.T) {
+	l := newFailureLimiter(2, 100*time.Millisecond)
+
+	assert.False(t, l.blocked("foo"))
+	l.fail("foo")
+	assert.False(t, l.blocked("foo"))
+	l.fail("foo")
+	assert.True(t, l.blocked("foo"))
+	assert.False(t, l.blocked("bar"))
+
+	// Replenished over time
+	assert.Eventually(t, func() bool {
+		return !l.blocked("foo")
+	}, time.Second, 10*time.Millisecond)
+
+	assert.Eventually(t, func() bool {
+		l.cleanup()
+
+		l.mtx.Lock()
+		defer l.mtx.Unlock()
+		return len(l.limiters) == 0
+	}, time.Second, 10*time.Millisecond)
+}
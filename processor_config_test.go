@@ -10,13 +10,19 @@ import (
 	"encoding/base64"
 	"encoding/pem"
 	"io"
+	"math/big"
 	"net"
+	"net/url"
 	"os"
+	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/prometheus/prometheus/prompb"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
@@ -80,7 +86,7 @@ func runConfigTest(t *testing.T, cfgSetup func(*config), handler fh.RequestHandl
 
 	go s.Serve(cfg.pipeOut)
 
-	result := p.send("http://test/push", getClientIP(), getUUID(t), "", emptyBodyFunc)
+	result := p.send("http://test/push", formatPromWrite, getClientIP(), getUUID(t), "", emptyBodyFunc)
 	require.NoError(t, result.err)
 }
 
@@ -377,3 +383,217 @@ func Test_TlsFail(t *testing.T) {
 	_, err := newProcessor(cfg)
 	require.Error(t, err)
 }
+
+// Tests that the client certificate identity is used as the tenant, the default tenant,
+// the prefix or the set of allowed tenants
+func Test_ClientCert(t *testing.T) {
+	dir := t.TempDir()
+
+	signed, caPriv := generateCA(t, "Test CA")
+	ca, err := x509.ParseCertificate(signed)
+	require.NoError(t, err)
+
+	makeAndWrite(t, filepath.Join(dir, "ca.crt"), "CERTIFICATE", signed)
+
+	pubKey, privateKey := makePrivateKey(t)
+	makeAndWrite(t, filepath.Join(dir, "tls.crt"), "CERTIFICATE", signCert(t, &x509.Certificate{
+		Subject:  pkix.Name{CommonName: "test"},
+		DNSNames: []string{"test"},
+	}, ca, pubKey, caPriv))
+
+	marshalledKey, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	require.NoError(t, err)
+	makeAndWrite(t, filepath.Join(dir, "tls.key"), "PRIVATE KEY", marshalledKey)
+
+	u, err := url.Parse("spiffe://example.org/tenant/team-c")
+	require.NoError(t, err)
+
+	pubKey, privateKey = makePrivateKey(t)
+	clientCert := tls.Certificate{
+		Certificate: [][]byte{signCert(t, &x509.Certificate{
+			SerialNumber: big.NewInt(2),
+			Subject: pkix.Name{
+				CommonName:         "team-a",
+				OrganizationalUnit: []string{"default", "foobar"},
+			},
+			URIs: []*url.URL{u},
+		}, ca, pubKey, caPriv)},
+		PrivateKey: privateKey,
+	}
+
+	var (
+		mtx     sync.Mutex
+		tenants []string
+	)
+
+	pipeOut := fhu.NewInmemoryListener()
+	s := &fh.Server{
+		Handler: func(ctx *fh.RequestCtx) {
+			mtx.Lock()
+			tenants = append(tenants, string(ctx.Request.Header.Peek("X-Scope-OrgID")))
+			mtx.Unlock()
+		},
+	}
+	go s.Serve(pipeOut)
+	defer s.Shutdown()
+
+	wrq, err := (&processor{}).marshalPromWrite(&prompb.WriteRequest{Timeseries: []prompb.TimeSeries{
+		{Labels: []prompb.Label{{Name: "__tenant__", Value: "foobar"}}},
+		{Labels: []prompb.Label{{Name: "job", Value: "foo"}}},
+	}})
+	require.NoError(t, err)
+
+	uri, contentType, body := "https://test/push", "", wrq
+
+	push := func(yml string, withCert bool) ([]string, int, error) {
+		cfg, err := getConfig(testConfig + `
+auth:
+  ingress:
+    tls_config:
+      cert_file: ` + filepath.Join(dir, "tls.crt") + `
+      key_file: ` + filepath.Join(dir, "tls.key") + `
+      client_ca_file: ` + filepath.Join(dir, "ca.crt") + yml)
+		require.NoError(t, err)
+
+		cfg.pipeIn = fhu.NewInmemoryListener()
+		cfg.pipeOut = pipeOut
+		cfg.TargetOTLP = "http://127.0.0.1/otlp/v1/metrics"
+
+		p, err := newProcessor(*cfg)
+		require.NoError(t, err)
+		runProcessor(t, p)
+
+		c := &fh.Client{
+			Dial: func(_ string) (net.Conn, error) {
+				return cfg.pipeIn.Dial()
+			},
+			TLSConfig: &tls.Config{
+				RootCAs: x509.NewCertPool(),
+			},
+		}
+		c.TLSConfig.RootCAs.AddCert(ca)
+
+		if withCert {
+			c.TLSConfig.Certificates = []tls.Certificate{clientCert}
+		}
+
+		mtx.Lock()
+		tenants = nil
+		mtx.Unlock()
+
+		req, resp := fh.AcquireRequest(), fh.AcquireResponse()
+		req.Header.SetMethod("POST")
+		req.SetRequestURI(uri)
+		req.Header.SetContentType(contentType)
+		req.SetBody(body)
+
+		if err = c.Do(req, resp); err != nil {
+			return nil, 0, err
+		}
+
+		mtx.Lock()
+		defer mtx.Unlock()
+		return slices.Sorted(slices.Values(tenants)), resp.StatusCode(), nil
+	}
+
+	for _, tc := range []struct {
+		yml     string
+		code    int
+		tenants []string
+	}{
+		// Client certificate verification only
+		{``, 200, []string{"default", "foobar"}},
+		{`
+    client_cert:
+      identity: cn`, 200, []string{"team-a"}},
+		{`
+    client_cert:
+      identity: cn
+      tenant_mode: default`, 200, []string{"foobar", "team-a"}},
+		{`
+    client_cert:
+      identity: cn
+      tenant_mode: prefix`, 200, []string{"team-a-default", "team-a-foobar"}},
+		{`
+    client_cert:
+      identity: san_uri
+      san_uri_prefix: spiffe://example.org/tenant/`, 200, []string{"team-c"}},
+		{`
+    client_cert:
+      identity: cn
+      tenant_mode: allowed`, 403, nil},
+		{`
+    client_cert:
+      identity: ou
+      tenant_mode: allowed`, 200, []string{"default", "foobar"}},
+	} {
+		tenants, code, err := push(tc.yml, true)
+		require.NoError(t, err, tc.yml)
+		assert.Equal(t, tc.code, code, tc.yml)
+		assert.Equal(t, tc.tenants, tenants, tc.yml)
+	}
+
+	// The certificate is required by default
+	_, _, err = push(`
+    client_cert:
+      identity: cn`, false)
+	assert.Error(t, err)
+
+	tenants, code, err := push(`
+      client_auth: verify_if_given
+    client_cert:
+      identity: cn`, false)
+	require.NoError(t, err)
+	assert.Equal(t, 200, code)
+	assert.Equal(t, []string{"default", "foobar"}, tenants)
+
+	// The pinned tenant overrides the tenants in the OTLP attributes
+	uri, contentType = "https://test/otlp/v1/metrics", "application/x-protobuf"
+	body, err = testOTLPMetrics().MarshalProto()
+	require.NoError(t, err)
+
+	tenants, code, err = push(`
+    client_cert:
+      identity: cn`, true)
+	require.NoError(t, err)
+	assert.Equal(t, 200, code)
+	assert.Equal(t, []string{"team-a"}, tenants)
+}
+
+func Test_ClientCertConfig(t *testing.T) {
+	for _, yml := range []string{
+		`
+    tls_config:
+      client_ca_file: ca.crt`,
+		`
+    tls_config:
+      cert_file: tls.crt
+      key_file: tls.key
+      client_ca_file: ca.crt
+      client_auth: foo`,
+		`
+    client_cert:
+      identity: cn`,
+		`
+    tls_config:
+      cert_file: tls.crt
+      key_file: tls.key
+      client_ca_file: ca.crt
+    client_cert:
+      identity: foo`,
+		`
+    tls_config:
+      cert_file: tls.crt
+      key_file: tls.key
+      client_ca_file: ca.crt
+    client_cert:
+      identity: cn
+      tenant_mode: foo`,
+	} {
+		file := filepath.Join(t.TempDir(), "config.yml")
+		require.NoError(t, os.WriteFile(file, []byte("auth:\n  ingress:"+yml+"\n"), 0o644))
+
+		_, err := configLoad(file)
+		assert.Error(t, err, yml)
+	}
+}
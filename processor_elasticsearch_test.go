@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/grafana/loki/v3/pkg/logproto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	fh "github.com/valyala/fasthttp"
+	fhu "github.com/valyala/fasthttp/fasthttputil"
+)
+
+const testBulk = `{"index": {"_index": "logs", "_id": "1"}}
+{"@timestamp": "2024-01-01T00:00:00Z", "message": "hello", "tenant": "foobar", "kubernetes": {"namespace_name": "ns1"}, "trace_id": "abc"}
+{"create": {"_index": "logs"}}
+{"message": "world", "tenant": "foobaz"}
+{"delete": {"_index": "logs", "_id": "1"}}
+
+{"index": {}}
+{"foo": "bar", "tenant": "foobar", "kubernetes": {"namespace_name": "ns1"}}
+{"index": {}}
+{"@timestamp": "yesterday"}
+`
+
+func testElasticsearchConfig(t *testing.T) *config {
+	cfg, err := getConfig(testLokiConfig)
+	require.NoError(t, err)
+
+	cfg.Tenant.LabelList = []string{"__tenant__"}
+	cfg.Elasticsearch.TenantField = "tenant"
+	cfg.Elasticsearch.IndexLabel = "index"
+	cfg.Elasticsearch.LabelFields = []string{"kubernetes.namespace_name"}
+	cfg.Elasticsearch.MetadataFields = []string{"trace_id"}
+
+	return cfg
+}
+
+func Test_esBulkToPushRequest(t *testing.T) {
+	p, err := newProcessor(*testElasticsearchConfig(t))
+	require.NoError(t, err)
+
+	now := time.Unix(1000, 0)
+
+	req, tenants, items, err := p.esBulkToPushRequest([]byte(testBulk), now)
+	require.NoError(t, err)
+	require.Len(t, items, 5)
+	assert.Equal(t, []string{"foobar", "foobaz", "foobar"}, tenants)
+
+	assert.Equal(t, []logproto.Stream{
+		{
+			Labels: `{index="logs", kubernetes_namespace_name="ns1"}`,
+			Entries: []logproto.Entry{{
+				Timestamp:          time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+				Line:               "hello",
+				StructuredMetadata: []logproto.LabelAdapter{{Name: "trace_id", Value: "abc"}},
+			}},
+		},
+		{
+			Labels:  `{index="logs", job="elasticsearch"}`,
+			Entries: []logproto.Entry{{Timestamp: now, Line: "world"}},
+		},
+		{
+			Labels: `{kubernetes_namespace_name="ns1"}`,
+			Entries: []logproto.Entry{{
+				Timestamp: now,
+				Line:      `{"foo":"bar","kubernetes":{"namespace_name":"ns1"},"tenant":"foobar"}`,
+			}},
+		},
+	}, req.Streams)
+
+	assert.Equal(t, []int{0, 1, -1, 2, -1}, []int{items[0].stream, items[1].stream, items[2].stream, items[3].stream, items[4].stream})
+	assert.Equal(t, "create", items[1].action)
+	assert.Equal(t, "delete", items[2].action)
+	assert.NotNil(t, items[2].Error)
+	assert.Equal(t, "mapper_parsing_exception", items[4].Error.Type)
+
+	for _, body := range []string{"foo\n{}", `{"index": {}}`, `{"upsert": {}}` + "\n{}"} {
+		_, _, _, err = p.esBulkToPushRequest([]byte(body), now)
+		assert.Error(t, err, body)
+	}
+}
+
+func Test_handle_elasticsearch(t *testing.T) {
+	cfg := testElasticsearchConfig(t)
+	cfg.pipeIn = fhu.NewInmemoryListener()
+	cfg.pipeOut = fhu.NewInmemoryListener()
+
+	p, err := newProcessor(*cfg)
+	require.NoError(t, err)
+	runProcessor(t, p)
+
+	// Fail the pushes for one of the tenants
+	s := &fh.Server{
+		Handler: func(ctx *fh.RequestCtx) {
+			b, err := snappy.Decode(nil, ctx.Request.Body())
+			if err != nil {
+				ctx.Error(err.Error(), fh.StatusBadRequest)
+				return
+			}
+
+			if _, err := p.unmarshalLokiPush(b); err != nil {
+				ctx.Error(err.Error(), fh.StatusBadRequest)
+				return
+			}
+
+			if string(ctx.Request.Header.Peek("X-Scope-OrgID")) == "foobaz" {
+				ctx.Error("rate limited", fh.StatusTooManyRequests)
+				return
+			}
+
+			ctx.SetStatusCode(fh.StatusNoContent)
+		},
+	}
+	go s.Serve(cfg.pipeOut)
+
+	c := &fh.Client{
+		Dial: func(a string) (net.Conn, error) {
+			return cfg.pipeIn.Dial()
+		},
+	}
+
+	req := fh.AcquireRequest()
+	resp := fh.AcquireResponse()
+
+	req.Header.SetMethod("POST")
+	req.SetRequestURI("http://127.0.0.1/_bulk")
+	req.Header.SetContentType("application/x-ndjson")
+	req.SetBodyString(testBulk)
+
+	require.NoError(t, c.Do(req, resp))
+	assert.Equal(t, 200, resp.StatusCode())
+
+	var bulkResp struct {
+		Errors bool
+		Items  []map[string]struct {
+			Status int
+			Error  *esBulkError
+		}
+	}
+
+	require.NoError(t, json.Unmarshal(resp.Body(), &bulkResp))
+	assert.True(t, bulkResp.Errors)
+	require.Len(t, bulkResp.Items, 5)
+
+	for i, exp := range []struct {
+		action string
+		status int
+	}{{"index", 201}, {"create", 429}, {"delete", 400}, {"index", 201}, {"index", 400}} {
+		item, ok := bulkResp.Items[i][exp.action]
+		require.True(t, ok, i)
+		assert.Equal(t, exp.status, item.Status, i)
+	}
+
+	// Broken body
+	req.SetBodyString("foo")
+	resp.Reset()
+
+	require.NoError(t, c.Do(req, resp))
+	assert.Equal(t, 400, resp.StatusCode())
+
+	// The items of the tenants dropped by the authorization are forbidden
+	cfg.Authorization.Action = authorizationActionDrop
+	cfg.Authorization.Rules = []authorizationRuleConfig{{Tenants: []string{"foobaz"}}}
+
+	p, err = newProcessor(*cfg)
+	require.NoError(t, err)
+
+	ctx := &fh.RequestCtx{}
+	ctx.Request.Header.SetMethod("POST")
+	ctx.Request.SetRequestURI("/_bulk")
+	ctx.Request.SetBodyString(testBulk)
+	p.handleElasticsearchBulk(ctx)
+
+	require.NoError(t, json.Unmarshal(ctx.Response.Body(), &bulkResp))
+	require.Len(t, bulkResp.Items, 5)
+
+	for i, exp := range []struct {
+		action string
+		status int
+	}{{"index", 403}, {"create", 429}, {"delete", 400}, {"index", 403}, {"index", 400}} {
+		assert.Equal(t, exp.status, bulkResp.Items[i][exp.action].Status, i)
+	}
+}
+
+func Test_handle_elasticsearch_template(t *testing.T) {
+	cfg := testElasticsearchConfig(t)
+	cfg.Tenant.Template = `ns-{{ .kubernetes_namespace_name }}`
+	cfg.pipeOut = fhu.NewInmemoryListener()
+
+	var (
+		mtx     sync.Mutex
+		tenants []string
+	)
+
+	s := &fh.Server{
+		Handler: func(ctx *fh.RequestCtx) {
+			mtx.Lock()
+			tenants = append(tenants, string(ctx.Request.Header.Peek("X-Scope-OrgID")))
+			mtx.Unlock()
+			ctx.SetStatusCode(fh.StatusNoContent)
+		},
+	}
+	go s.Serve(cfg.pipeOut)
+	defer s.Shutdown()
+
+	p, err := newProcessor(*cfg)
+	require.NoError(t, err)
+
+	// The tenant field takes precedence over the template, the other documents use it
+	ctx := &fh.RequestCtx{}
+	ctx.Request.Header.SetMethod("POST")
+	ctx.Request.SetRequestURI("/_bulk")
+	ctx.Request.SetBodyString(`{"index": {}}
+{"message": "a", "tenant": "foobar", "kubernetes": {"namespace_name": "ns1"}}
+{"index": {}}
+{"message": "b", "kubernetes": {"namespace_name": "ns1"}}
+`)
+	p.handleElasticsearchBulk(ctx)
+	assert.Equal(t, 200, ctx.Response.StatusCode())
+
+	var bulkResp struct {
+		Errors bool
+	}
+
+	require.NoError(t, json.Unmarshal(ctx.Response.Body(), &bulkResp))
+	assert.False(t, bulkResp.Errors)
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	assert.ElementsMatch(t, []string{"foobar", "ns-ns1"}, tenants)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	fh "github.com/valyala/fasthttp"
+	fhu "github.com/valyala/fasthttp/fasthttputil"
+)
+
+func Test_parseExposition(t *testing.T) {
+	now := time.Unix(1000, 0)
+	extra := labels.FromStrings("env", "prod", "job", "override")
+
+	body := []byte(`# HELP up Is the target up
+# TYPE up gauge
+up{job="node",__tenant__="foobar"} 1 5000
+up{job="api"} 0
+`)
+
+	wrq, err := parseExposition(body, "text/plain", extra, now)
+	require.NoError(t, err)
+
+	assert.Equal(t, []prompb.TimeSeries{
+		{
+			Labels: []prompb.Label{
+				{Name: "__name__", Value: "up"},
+				{Name: "__tenant__", Value: "foobar"},
+				{Name: "env", Value: "prod"},
+				{Name: "job", Value: "override"},
+			},
+			Samples: []prompb.Sample{{Value: 1, Timestamp: 5000}},
+		},
+		{
+			Labels: []prompb.Label{
+				{Name: "__name__", Value: "up"},
+				{Name: "env", Value: "prod"},
+				{Name: "job", Value: "override"},
+			},
+			Samples: []prompb.Sample{{Value: 0, Timestamp: now.UnixMilli()}},
+		},
+	}, wrq.Timeseries)
+
+	// OpenMetrics timestamps are in seconds, the terminator is optional
+	body = []byte("# TYPE foo counter\nfoo_total{a=\"b\"} 3 10.5\n")
+
+	wrq, err = parseExposition(body, "application/openmetrics-text", labels.EmptyLabels(), now)
+	require.NoError(t, err)
+	require.Len(t, wrq.Timeseries, 1)
+	assert.Equal(t, []prompb.Sample{{Value: 3, Timestamp: 10500}}, wrq.Timeseries[0].Samples)
+
+	_, err = parseExposition([]byte("up{job= 1"), "text/plain", labels.EmptyLabels(), now)
+	assert.Error(t, err)
+}
+
+func Test_handle_import(t *testing.T) {
+	cfg, err := getConfig(testConfig)
+	require.NoError(t, err)
+
+	cfg.pipeIn = fhu.NewInmemoryListener()
+	cfg.pipeOut = fhu.NewInmemoryListener()
+
+	p, err := newProcessor(*cfg)
+	require.NoError(t, err)
+	runProcessor(t, p)
+
+	tenants := make(chan string, 2)
+	s := &fh.Server{
+		Handler: func(ctx *fh.RequestCtx) {
+			tenants <- string(ctx.Request.Header.Peek("X-Scope-OrgID"))
+			ctx.WriteString("Ok")
+		},
+	}
+	go s.Serve(cfg.pipeOut)
+
+	c := &fh.Client{
+		Dial: func(a string) (net.Conn, error) {
+			return cfg.pipeIn.Dial()
+		},
+	}
+
+	req := fh.AcquireRequest()
+	resp := fh.AcquireResponse()
+
+	req.Header.SetMethod("POST")
+	req.SetRequestURI("http://127.0.0.1/api/v1/import/prometheus?extra_label=__tenant__=foobaz")
+	req.Header.SetContentEncoding("gzip")
+	req.SetBody(fh.AppendGzipBytes(nil, []byte("up 1\n")))
+
+	require.NoError(t, c.Do(req, resp))
+	assert.Equal(t, 200, resp.StatusCode())
+	assert.Equal(t, "foobaz", <-tenants)
+
+	// Broken extra label
+	req.SetRequestURI("http://127.0.0.1/api/v1/import/prometheus?extra_label=foo")
+	resp.Reset()
+
+	require.NoError(t, c.Do(req, resp))
+	assert.Equal(t, 400, resp.StatusCode())
+
+	// Broken body
+	req.SetRequestURI("http://127.0.0.1/api/v1/import/prometheus")
+	req.Header.SetContentEncoding("")
+	req.SetBodyString("up{")
+	resp.Reset()
+
+	require.NoError(t, c.Do(req, resp))
+	assert.Equal(t, 400, resp.StatusCode())
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	fh "github.com/valyala/fasthttp"
+	fhu "github.com/valyala/fasthttp/fasthttputil"
+)
+
+func Test_parseInfluxLine(t *testing.T) {
+	pt, err := parseInfluxLine(`cpu\ load,host=server\,01,__tenant__=foobar usage=0.5,count=3i,up=true,msg="hello, world" 1700000000000000000`)
+	require.NoError(t, err)
+
+	assert.Equal(t, "cpu load", pt.measurement)
+	assert.Equal(t, []prompb.Label{
+		{Name: "host", Value: "server,01"},
+		{Name: "__tenant__", Value: "foobar"},
+	}, pt.tags)
+	assert.Equal(t, []influxField{
+		{key: "usage", value: 0.5},
+		{key: "count", value: 3},
+		{key: "up", value: 1},
+	}, pt.fields)
+	assert.Equal(t, int64(1700000000000000000), pt.timestamp)
+
+	pt, err = parseInfluxLine(`mem free=10u`)
+	require.NoError(t, err)
+	assert.Equal(t, []influxField{{key: "free", value: 10}}, pt.fields)
+	assert.Equal(t, int64(0), pt.timestamp)
+
+	for _, line := range []string{
+		`cpu`,
+		`cpu,host usage=1`,
+		`cpu usage`,
+		`cpu usage=foo`,
+		`cpu usage=1 abc`,
+		`cpu msg="unterminated`,
+		`cpu,__name__=foo usage=1`,
+	} {
+		_, err = parseInfluxLine(line)
+		assert.Error(t, err, line)
+	}
+}
+
+func Test_influxToWriteRequest(t *testing.T) {
+	now := time.Unix(1000, 0)
+	body := []byte("# comment\ncpu,host=a usage=1,idle=2 5\n\nbroken\nmem,__tenant__=foobar used=3\ncpu usage=1 9223372036854775\ncpu usage=1 -9223372036854775")
+
+	wrq, errs := influxToWriteRequest(body, int64(time.Second), now)
+	require.Len(t, errs, 3)
+	assert.Contains(t, errs[0], "line 4")
+	assert.Contains(t, errs[1], "line 6: unable to parse 'cpu usage=1 9223372036854775': timestamp 9223372036854775 is out of range")
+	assert.Contains(t, errs[2], "line 7")
+
+	assert.Equal(t, []prompb.TimeSeries{
+		{
+			Labels:  []prompb.Label{{Name: "__name__", Value: "cpu_usage"}, {Name: "host", Value: "a"}},
+			Samples: []prompb.Sample{{Value: 1, Timestamp: 5000}},
+		},
+		{
+			Labels:  []prompb.Label{{Name: "__name__", Value: "cpu_idle"}, {Name: "host", Value: "a"}},
+			Samples: []prompb.Sample{{Value: 2, Timestamp: 5000}},
+		},
+		{
+			Labels:  []prompb.Label{{Name: "__name__", Value: "mem_used"}, {Name: "__tenant__", Value: "foobar"}},
+			Samples: []prompb.Sample{{Value: 3, Timestamp: now.UnixMilli()}},
+		},
+	}, wrq.Timeseries)
+}
+
+func Test_handle_influx(t *testing.T) {
+	cfg, err := getConfig(testConfig)
+	require.NoError(t, err)
+
+	cfg.pipeIn = fhu.NewInmemoryListener()
+	cfg.pipeOut = fhu.NewInmemoryListener()
+
+	p, err := newProcessor(*cfg)
+	require.NoError(t, err)
+	runProcessor(t, p)
+
+	s := &fh.Server{
+		Handler: sinkHandler,
+	}
+	go s.Serve(cfg.pipeOut)
+
+	c := &fh.Client{
+		Dial: func(a string) (net.Conn, error) {
+			return cfg.pipeIn.Dial()
+		},
+	}
+
+	req := fh.AcquireRequest()
+	resp := fh.AcquireResponse()
+
+	req.Header.SetMethod("POST")
+	req.SetRequestURI("http://127.0.0.1/api/v2/write?precision=s")
+	req.SetBodyString("cpu,__tenant__=foobar usage=1 1700000000\nmem,__tenant__=foobaz used=2")
+
+	require.NoError(t, c.Do(req, resp))
+	assert.Equal(t, 204, resp.StatusCode())
+
+	// Partial write
+	req.SetBodyString("cpu,__tenant__=foobar usage=1\nbroken")
+	resp.Reset()
+
+	require.NoError(t, c.Do(req, resp))
+	assert.Equal(t, 400, resp.StatusCode())
+
+	var v2Err map[string]string
+	require.NoError(t, json.Unmarshal(resp.Body(), &v2Err))
+	assert.Equal(t, "invalid", v2Err["code"])
+	assert.Contains(t, v2Err["message"], "partial write: line 2")
+
+	// InfluxDB 1.x error format
+	req.SetRequestURI("http://127.0.0.1/write")
+	req.SetBodyString("broken")
+	resp.Reset()
+
+	require.NoError(t, c.Do(req, resp))
+	assert.Equal(t, 400, resp.StatusCode())
+
+	var v1Err map[string]string
+	require.NoError(t, json.Unmarshal(resp.Body(), &v1Err))
+	assert.Contains(t, v1Err["error"], "line 1")
+
+	// Bad precision
+	req.SetRequestURI("http://127.0.0.1/write?precision=foo")
+	resp.Reset()
+
+	require.NoError(t, c.Do(req, resp))
+	assert.Equal(t, 400, resp.StatusCode())
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/google/uuid"
+	"github.com/grafana/loki/v3/pkg/logproto"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	fh "github.com/valyala/fasthttp"
+	fhu "github.com/valyala/fasthttp/fasthttputil"
+)
+
+func Test_injectLabel(t *testing.T) {
+	for _, tc := range []struct {
+		in  []prompb.Label
+		exp []prompb.Label
+	}{
+		{
+			in:  nil,
+			exp: []prompb.Label{{Name: "tenant", Value: "foo"}},
+		},
+		{
+			in:  []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "a"}},
+			exp: []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "a"}, {Name: "tenant", Value: "foo"}},
+		},
+		{
+			in:  []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "zone", Value: "a"}},
+			exp: []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "tenant", Value: "foo"}, {Name: "zone", Value: "a"}},
+		},
+		// The existing value is overridden
+		{
+			in:  []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "tenant", Value: "bar"}},
+			exp: []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "tenant", Value: "foo"}},
+		},
+		// Unsorted labels are sorted
+		{
+			in:  []prompb.Label{{Name: "zone", Value: "a"}, {Name: "__name__", Value: "up"}},
+			exp: []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "tenant", Value: "foo"}, {Name: "zone", Value: "a"}},
+		},
+	} {
+		ts := prompb.TimeSeries{Labels: tc.in}
+		injectLabel(&ts, "tenant", "foo")
+		assert.Equal(t, tc.exp, ts.Labels, tc.in)
+	}
+
+	// The labels shared with the other timeseries are not modified
+	lbls := make([]prompb.Label, 2, 3)
+	lbls[0], lbls[1] = prompb.Label{Name: "a", Value: "1"}, prompb.Label{Name: "tenant", Value: "bar"}
+	ts1, ts2 := prompb.TimeSeries{Labels: lbls[:1]}, prompb.TimeSeries{Labels: lbls}
+
+	injectLabel(&ts1, "b", "2")
+	injectLabel(&ts2, "tenant", "foo")
+	assert.Equal(t, []prompb.Label{{Name: "a", Value: "1"}, {Name: "tenant", Value: "bar"}}, lbls)
+	assert.Equal(t, []prompb.Label{{Name: "a", Value: "1"}, {Name: "b", Value: "2"}}, ts1.Labels)
+}
+
+func Test_injectLabelV2(t *testing.T) {
+	symbols := []string{"", "__name__", "up", "zone", "a", "tenant", "foo", "bar"}
+
+	refs, err := injectLabelV2([]uint32{3, 4, 1, 2}, symbols, 5, 6)
+	require.NoError(t, err)
+	assert.Equal(t, []uint32{1, 2, 5, 6, 3, 4}, refs)
+
+	refs, err = injectLabelV2([]uint32{1, 2, 5, 7}, symbols, 5, 6)
+	require.NoError(t, err)
+	assert.Equal(t, []uint32{1, 2, 5, 6}, refs)
+
+	_, err = injectLabelV2([]uint32{1}, symbols, 5, 6)
+	assert.Error(t, err)
+
+	_, err = injectLabelV2([]uint32{1, 100}, symbols, 5, 6)
+	assert.Error(t, err)
+}
+
+func Test_injectStreamLabel(t *testing.T) {
+	s := &logproto.Stream{Labels: `{job="a", zone="b \"c\""}`}
+	require.NoError(t, injectStreamLabel(s, "tenant", `foo"bar`))
+	assert.Equal(t, `{job="a", tenant="foo\"bar", zone="b \"c\""}`, s.Labels)
+
+	s = &logproto.Stream{Labels: `{tenant="bar"}`}
+	require.NoError(t, injectStreamLabel(s, "tenant", "foo"))
+	assert.Equal(t, `{tenant="foo"}`, s.Labels)
+
+	s = &logproto.Stream{Labels: `{foo`}
+	assert.Error(t, injectStreamLabel(s, "tenant", "foo"))
+}
+
+func Test_inject(t *testing.T) {
+	cfg, err := getConfig(testConfig + `  inject_label: tenant_id
+`)
+	require.NoError(t, err)
+
+	cfg.pipeOut = fhu.NewInmemoryListener()
+
+	type upstreamReq struct {
+		header string
+		body   []byte
+	}
+
+	var (
+		mtx      sync.Mutex
+		received []upstreamReq
+	)
+
+	s := &fh.Server{
+		Handler: func(ctx *fh.RequestCtx) {
+			b, err := snappy.Decode(nil, ctx.Request.Body())
+			require.NoError(t, err)
+
+			mtx.Lock()
+			received = append(received, upstreamReq{string(ctx.Request.Header.Peek("X-Scope-OrgID")), b})
+			mtx.Unlock()
+		},
+	}
+	go s.Serve(cfg.pipeOut)
+	defer s.Shutdown()
+
+	p, err := newProcessor(*cfg)
+	require.NoError(t, err)
+
+	handle := func(uri, contentType, tenant string, body []byte) []upstreamReq {
+		mtx.Lock()
+		received = nil
+		mtx.Unlock()
+
+		ctx := &fh.RequestCtx{}
+		ctx.Request.Header.SetMethod("POST")
+		ctx.Request.SetRequestURI(uri)
+		ctx.Request.Header.SetContentType(contentType)
+		ctx.Request.SetBody(body)
+
+		if tenant != "" {
+			ctx.Request.Header.Set("X-Scope-OrgID", tenant)
+		}
+
+		p.handle(ctx)
+		assert.Equal(t, 200, ctx.Response.StatusCode(), uri)
+
+		mtx.Lock()
+		defer mtx.Unlock()
+		return received
+	}
+
+	wrq, err := p.marshalPromWrite(&prompb.WriteRequest{Timeseries: []prompb.TimeSeries{
+		{Labels: []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "__tenant__", Value: "foobar"}}},
+		{Labels: []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "tenant_id", Value: "spoofed"}}},
+	}})
+	require.NoError(t, err)
+
+	// The tenant from the header is injected into all the timeseries
+	reqs := handle("/push", "application/x-protobuf", "team-a", wrq)
+	require.Len(t, reqs, 1)
+	assert.Empty(t, reqs[0].header)
+
+	var wrReqOut prompb.WriteRequest
+	require.NoError(t, proto.Unmarshal(reqs[0].body, &wrReqOut))
+	require.Len(t, wrReqOut.Timeseries, 2)
+	assert.Equal(t, []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "__tenant__", Value: "foobar"}, {Name: "tenant_id", Value: "team-a"}}, wrReqOut.Timeseries[0].Labels)
+	assert.Equal(t, []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "tenant_id", Value: "team-a"}}, wrReqOut.Timeseries[1].Labels)
+
+	// Without the header the tenant is resolved as usual, all the tenants are sent in one request
+	reqs = handle("/push", "application/x-protobuf", "", wrq)
+	require.Len(t, reqs, 1)
+	assert.Empty(t, reqs[0].header)
+
+	wrReqOut = prompb.WriteRequest{}
+	require.NoError(t, proto.Unmarshal(reqs[0].body, &wrReqOut))
+	require.Len(t, wrReqOut.Timeseries, 2)
+
+	var injected []string
+	for _, ts := range wrReqOut.Timeseries {
+		injected = append(injected, promLabelValue(ts.Labels, "tenant_id"))
+	}
+	assert.ElementsMatch(t, []string{"foobar", "default"}, injected)
+
+	pushReq, err := json.Marshal(map[string]any{"streams": []any{
+		map[string]any{"stream": map[string]string{"job": "foo", "zone": "a"}, "values": [][]string{{"1700000000000000000", "foo"}}},
+	}})
+	require.NoError(t, err)
+
+	reqs = handle("/loki/push", "application/json", "team-a", pushReq)
+	require.Len(t, reqs, 1)
+	assert.Empty(t, reqs[0].header)
+
+	var pushReqOut logproto.PushRequest
+	require.NoError(t, proto.Unmarshal(reqs[0].body, &pushReqOut))
+	require.Len(t, pushReqOut.Streams, 1)
+	assert.Equal(t, `{job="foo", tenant_id="team-a", zone="a"}`, pushReqOut.Streams[0].Labels)
+
+	// Remote Write 2.0
+	wrqV2In := testWRQv2()
+	symbols := len(wrqV2In.Symbols)
+
+	m, err := p.createWriteRequestsV2(wrqV2In, sourceTenant{tenant: "team-a", override: true})
+	require.NoError(t, err)
+	require.Len(t, m, 1)
+
+	// The injected label is added to the symbols once for all the timeseries
+	assert.Len(t, wrqV2In.Symbols, symbols+2)
+
+	buf, err := m["team-a"]()
+	require.NoError(t, err)
+	wrqV2, err := p.unmarshalPromWriteV2(buf)
+	require.NoError(t, err)
+	require.Len(t, wrqV2.Timeseries, 2)
+
+	b := labels.NewScratchBuilder(0)
+	assert.Equal(t,
+		labels.FromStrings("__name__", "foo_total", "__tenant__", "foobar", "job", "a", "tenant_id", "team-a"),
+		wrqV2.Timeseries[0].ToLabels(&b, wrqV2.Symbols),
+	)
+	assert.Equal(t,
+		labels.FromStrings("__name__", "bar", "__tenant__", "foobaz", "job", "b", "tenant_id", "team-a"),
+		wrqV2.Timeseries[1].ToLabels(&b, wrqV2.Symbols),
+	)
+
+	// The Remote Write 2.0 requests are merged with a common symbols table
+	m, err = p.createWriteRequestsV2(testWRQv2(), sourceTenant{})
+	require.NoError(t, err)
+	require.Len(t, m, 2)
+
+	var bodies [][]byte
+	for _, tenant := range []string{"foobar", "foobaz"} {
+		buf, err := m[tenant]()
+		require.NoError(t, err)
+		bodies = append(bodies, buf)
+	}
+
+	buf, err = mergePromWriteV2(bodies)
+	require.NoError(t, err)
+	wrqV2, err = p.unmarshalPromWriteV2(buf)
+	require.NoError(t, err)
+	require.Len(t, wrqV2.Timeseries, 2)
+
+	assert.Equal(t,
+		labels.FromStrings("__name__", "foo_total", "__tenant__", "foobar", "job", "a", "tenant_id", "foobar"),
+		wrqV2.Timeseries[0].ToLabels(&b, wrqV2.Symbols),
+	)
+	assert.Equal(t,
+		labels.FromStrings("__name__", "bar", "__tenant__", "foobaz", "job", "b", "tenant_id", "foobaz"),
+		wrqV2.Timeseries[1].ToLabels(&b, wrqV2.Symbols),
+	)
+
+	// The other formats keep the header
+	req := &fh.Request{}
+	p.fillRequestHeaders(formatOTLP, &net.TCPAddr{}, uuid.UUID{}, "team-a", req)
+	assert.Equal(t, "team-a", string(req.Header.Peek("X-Scope-OrgID")))
+
+	file := filepath.Join(t.TempDir(), "config.yml")
+	require.NoError(t, os.WriteFile(file, []byte(testConfig+"  inject_label: foo\n  prefix_prefer_source: true\n"), 0o644))
+
+	_, err = configLoad(file)
+	assert.Error(t, err)
+
+	// The prefix would be missing from the label
+	require.NoError(t, os.WriteFile(file, []byte(testConfig+"  inject_label: foo\n  prefix: foo-\n"), 0o644))
+
+	_, err = configLoad(file)
+	assert.Error(t, err)
+}
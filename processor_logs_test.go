@@ -328,7 +328,7 @@ func Test_createPushRequests(t *testing.T) {
 	p, err := createProcessor()
 	assert.Nil(t, err)
 
-	m, err := p.createPushRequests(testPRQ)
+	m, err := p.createPushRequests(testPRQ, sourceTenant{})
 	assert.Nil(t, err)
 
 	mExp := map[string]func() ([]byte, error){
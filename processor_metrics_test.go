@@ -228,7 +228,7 @@ func Test_request_headers(t *testing.T) {
 	req := fh.AcquireRequest()
 	clientIP, _ := net.ResolveIPAddr("ip", "1.1.1.1")
 	reqID, _ := uuid.NewRandom()
-	p.fillRequestHeaders(clientIP, reqID, "my-tenant", req)
+	p.fillRequestHeaders(formatPromWrite, clientIP, reqID, "my-tenant", req)
 
 	assert.Equal(t, "snappy", string(req.Header.Peek("Content-Encoding")))
 	assert.Equal(t, "my-tenant", string(req.Header.Peek("X-Scope-OrgID")))
@@ -428,7 +428,7 @@ func Test_createWriteRequests(t *testing.T) {
 	p, err := createProcessor()
 	assert.Nil(t, err)
 
-	m, err := p.createWriteRequests(testWRQ)
+	m, err := p.createWriteRequests(testWRQ, sourceTenant{})
 	assert.Nil(t, err)
 
 	mExp := map[string]func() ([]byte, error){
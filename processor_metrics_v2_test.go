@@ -0,0 +1,202 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/prometheus/prometheus/model/labels"
+	writev2 "github.com/prometheus/prometheus/prompb/io/prometheus/write/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	fh "github.com/valyala/fasthttp"
+	fhu "github.com/valyala/fasthttp/fasthttputil"
+)
+
+// Builds a RW 2.0 request with two tenants carrying metadata,
+// exemplars and a native histogram
+func testWRQv2() *writev2.Request {
+	st := writev2.NewSymbolTable()
+
+	ts1 := writev2.TimeSeries{
+		LabelsRefs: st.SymbolizeLabels(labels.FromStrings("__name__", "foo_total", "__tenant__", "foobar", "job", "a"), nil),
+		Samples:    []writev2.Sample{{Value: 1, Timestamp: 1}},
+		Exemplars: []writev2.Exemplar{{
+			LabelsRefs: st.SymbolizeLabels(labels.FromStrings("trace_id", "abc"), nil),
+			Value:      1,
+			Timestamp:  1,
+		}},
+		Metadata: writev2.Metadata{
+			Type:    writev2.Metadata_METRIC_TYPE_COUNTER,
+			HelpRef: st.Symbolize("Foo help"),
+			UnitRef: st.Symbolize("seconds"),
+		},
+	}
+
+	ts2 := writev2.TimeSeries{
+		LabelsRefs: st.SymbolizeLabels(labels.FromStrings("__name__", "bar", "__tenant__", "foobaz", "job", "b"), nil),
+		Histograms: []writev2.Histogram{{
+			Count:         &writev2.Histogram_CountInt{CountInt: 3},
+			Sum:           4,
+			Schema:        1,
+			ZeroThreshold: 0.001,
+			ZeroCount:     &writev2.Histogram_ZeroCountInt{ZeroCountInt: 1},
+			PositiveSpans: []writev2.BucketSpan{{Offset: 0, Length: 2}},
+			PositiveDeltas: []int64{
+				1, 0,
+			},
+			Timestamp: 2,
+		}},
+		Metadata: writev2.Metadata{
+			Type:    writev2.Metadata_METRIC_TYPE_HISTOGRAM,
+			HelpRef: st.Symbolize("Bar help"),
+		},
+	}
+
+	return &writev2.Request{
+		Symbols:    st.Symbols(),
+		Timeseries: []writev2.TimeSeries{ts1, ts2},
+	}
+}
+
+func Test_createWriteRequestsV2(t *testing.T) {
+	cfg, err := getConfig(testConfig)
+	require.NoError(t, err)
+	cfg.Tenant.LabelRemove = true
+
+	p, err := newProcessor(*cfg)
+	require.NoError(t, err)
+
+	m, err := p.createWriteRequestsV2(testWRQv2(), sourceTenant{})
+	require.NoError(t, err)
+	require.Len(t, m, 2)
+
+	b := labels.NewScratchBuilder(0)
+
+	buf, err := m["foobar"]()
+	require.NoError(t, err)
+	wrq, err := p.unmarshalPromWriteV2(buf)
+	require.NoError(t, err)
+
+	require.Len(t, wrq.Timeseries, 1)
+	ts := wrq.Timeseries[0]
+	assert.Equal(t, labels.FromStrings("__name__", "foo_total", "job", "a"), ts.ToLabels(&b, wrq.Symbols))
+	assert.Equal(t, "Foo help", ts.ToMetadata(wrq.Symbols).Help)
+	assert.Equal(t, "seconds", ts.ToMetadata(wrq.Symbols).Unit)
+	require.Len(t, ts.Exemplars, 1)
+	assert.Equal(t, labels.FromStrings("trace_id", "abc"), ts.Exemplars[0].ToExemplar(&b, wrq.Symbols).Labels)
+
+	// Symbols of the other tenant must not leak
+	assert.NotContains(t, wrq.Symbols, "foobaz")
+	assert.NotContains(t, wrq.Symbols, "Bar help")
+	assert.NotContains(t, wrq.Symbols, "__tenant__")
+
+	buf, err = m["foobaz"]()
+	require.NoError(t, err)
+	wrq, err = p.unmarshalPromWriteV2(buf)
+	require.NoError(t, err)
+
+	require.Len(t, wrq.Timeseries, 1)
+	ts = wrq.Timeseries[0]
+	assert.Equal(t, labels.FromStrings("__name__", "bar", "job", "b"), ts.ToLabels(&b, wrq.Symbols))
+	assert.Equal(t, "Bar help", ts.ToMetadata(wrq.Symbols).Help)
+	require.Len(t, ts.Histograms, 1)
+	assert.Equal(t, testWRQv2().Timeseries[1].Histograms[0], ts.Histograms[0])
+	assert.Empty(t, ts.Samples)
+}
+
+func Test_processTimeseriesV2(t *testing.T) {
+	cfg, err := getConfig(testConfig)
+	require.NoError(t, err)
+
+	p, err := newProcessor(*cfg)
+	require.NoError(t, err)
+
+	symbols := []string{"", "__tenant__", "foobar", "job", "a"}
+
+	ten, err := p.processTimeseriesV2(&writev2.TimeSeries{LabelsRefs: []uint32{1, 2, 3, 4}}, symbols)
+	require.NoError(t, err)
+	assert.Equal(t, "foobar", ten)
+
+	ten, err = p.processTimeseriesV2(&writev2.TimeSeries{LabelsRefs: []uint32{3, 4}}, symbols)
+	require.NoError(t, err)
+	assert.Equal(t, "default", ten)
+
+	_, err = p.processTimeseriesV2(&writev2.TimeSeries{LabelsRefs: []uint32{3, 10}}, symbols)
+	assert.Error(t, err)
+
+	_, err = p.processTimeseriesV2(&writev2.TimeSeries{LabelsRefs: []uint32{3}}, symbols)
+	assert.Error(t, err)
+
+	// Exemplar referencing a missing symbol
+	_, err = p.createWriteRequestsV2(&writev2.Request{
+		Symbols: symbols,
+		Timeseries: []writev2.TimeSeries{{
+			LabelsRefs: []uint32{1, 2},
+			Exemplars:  []writev2.Exemplar{{LabelsRefs: []uint32{3, 10}}},
+		}},
+	}, sourceTenant{})
+	assert.Error(t, err)
+}
+
+func Test_handle_v2(t *testing.T) {
+	cfg, err := getConfig(testConfig)
+	require.NoError(t, err)
+
+	cfg.pipeIn = fhu.NewInmemoryListener()
+	cfg.pipeOut = fhu.NewInmemoryListener()
+
+	p, err := newProcessor(*cfg)
+	require.NoError(t, err)
+	runProcessor(t, p)
+
+	s := &fh.Server{
+		Handler: func(ctx *fh.RequestCtx) {
+			if string(ctx.Request.Header.ContentType()) != formatPromWriteV2.contentType {
+				ctx.Error("wrong content type", fh.StatusUnsupportedMediaType)
+				return
+			}
+
+			if _, err := p.unmarshalPromWriteV2(ctx.Request.Body()); err != nil {
+				ctx.Error(err.Error(), fh.StatusBadRequest)
+				return
+			}
+
+			ctx.Response.Header.Set("X-Prometheus-Remote-Write-Samples-Written", "1")
+			ctx.Response.Header.Set("X-Prometheus-Remote-Write-Histograms-Written", "2")
+			ctx.Response.Header.Set("X-Prometheus-Remote-Write-Exemplars-Written", "3")
+			ctx.SetStatusCode(fh.StatusNoContent)
+		},
+	}
+	go s.Serve(cfg.pipeOut)
+
+	c := &fh.Client{
+		Dial: func(a string) (net.Conn, error) {
+			return cfg.pipeIn.Dial()
+		},
+	}
+
+	body, err := p.marshalPromWriteV2(testWRQv2())
+	require.NoError(t, err)
+
+	req := fh.AcquireRequest()
+	resp := fh.AcquireResponse()
+
+	req.Header.SetMethod("POST")
+	req.SetRequestURI("http://127.0.0.1/push")
+	req.Header.SetContentType(formatPromWriteV2.contentType)
+	req.SetBody(body)
+
+	require.NoError(t, c.Do(req, resp))
+	assert.Equal(t, 204, resp.StatusCode())
+	assert.Equal(t, "2", string(resp.Header.Peek("X-Prometheus-Remote-Write-Samples-Written")))
+	assert.Equal(t, "4", string(resp.Header.Peek("X-Prometheus-Remote-Write-Histograms-Written")))
+	assert.Equal(t, "6", string(resp.Header.Peek("X-Prometheus-Remote-Write-Exemplars-Written")))
+
+	// Unknown protobuf message
+	req.Header.SetContentType("application/x-protobuf;proto=foo.Bar")
+	resp.Reset()
+
+	require.NoError(t, c.Do(req, resp))
+	assert.Equal(t, 415, resp.StatusCode())
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/collector/pdata/plog"
+	"go.opentelemetry.io/collector/pdata/plog/plogotlp"
+
+	fh "github.com/valyala/fasthttp"
+	fhu "github.com/valyala/fasthttp/fasthttputil"
+)
+
+// Builds an OTLP logs request with two namespaces and a resource without one
+func testOTLPLogs() plogotlp.ExportRequest {
+	ld := plog.NewLogs()
+
+	for _, ns := range []string{"foobar", "foobaz", ""} {
+		rl := ld.ResourceLogs().AppendEmpty()
+		if ns != "" {
+			rl.Resource().Attributes().PutStr("k8s.namespace.name", ns)
+		}
+
+		lr := rl.ScopeLogs().AppendEmpty().LogRecords().AppendEmpty()
+		lr.Body().SetStr("Hello " + ns)
+	}
+
+	return plogotlp.NewExportRequestFromLogs(ld)
+}
+
+func Test_createOTLPLogsRequests(t *testing.T) {
+	cfg, err := getConfig(testLokiConfig)
+	require.NoError(t, err)
+	cfg.Tenant.AttributeList = []string{"tenant", "k8s.namespace.name"}
+
+	p, err := newProcessor(*cfg)
+	require.NoError(t, err)
+
+	m, err := p.createOTLPLogsRequests(testOTLPLogs(), sourceTenant{})
+	require.NoError(t, err)
+	require.Len(t, m, 3)
+
+	for tenant, body := range map[string]string{"foobar": "Hello foobar", "foobaz": "Hello foobaz", "default": "Hello "} {
+		buf, err := m[tenant]()
+		require.NoError(t, err)
+
+		req, err := p.unmarshalOTLPLogs(buf, false)
+		require.NoError(t, err)
+
+		ld := req.Logs()
+		require.Equal(t, 1, ld.LogRecordCount())
+		assert.Equal(t, body, ld.ResourceLogs().At(0).ScopeLogs().At(0).LogRecords().At(0).Body().AsString())
+
+		// The tenant attribute is kept unless label_remove is set
+		if tenant != "default" {
+			v, ok := ld.ResourceLogs().At(0).Resource().Attributes().Get("k8s.namespace.name")
+			assert.True(t, ok)
+			assert.Equal(t, tenant, v.AsString())
+		}
+	}
+}
+
+func Test_handle_otlp_logs(t *testing.T) {
+	cfg, err := getConfig(testLokiConfig)
+	require.NoError(t, err)
+
+	cfg.pipeIn = fhu.NewInmemoryListener()
+	cfg.pipeOut = fhu.NewInmemoryListener()
+	cfg.Tenant.AttributeList = []string{"k8s.namespace.name"}
+
+	c := &fh.Client{
+		Dial: func(a string) (net.Conn, error) {
+			return cfg.pipeIn.Dial()
+		},
+	}
+
+	body, err := testOTLPLogs().MarshalProto()
+	require.NoError(t, err)
+
+	// Disabled without a target
+	p, err := newProcessor(*cfg)
+	require.NoError(t, err)
+
+	ctx := &fh.RequestCtx{}
+	ctx.Request.Header.SetMethod("POST")
+	ctx.Request.SetRequestURI("/otlp/v1/logs")
+	ctx.Request.Header.SetContentType("application/x-protobuf")
+	ctx.Request.SetBody(body)
+
+	p.handle(ctx)
+	assert.Equal(t, 404, ctx.Response.StatusCode())
+
+	cfg.TargetLokiOTLP = "http://127.0.0.1/otlp/v1/logs"
+
+	p, err = newProcessor(*cfg)
+	require.NoError(t, err)
+	runProcessor(t, p)
+
+	tenants := make(chan string, 3)
+	s := &fh.Server{
+		Handler: func(ctx *fh.RequestCtx) {
+			if _, err := p.unmarshalOTLPLogs(ctx.Request.Body(), false); err != nil {
+				ctx.Error(err.Error(), fh.StatusBadRequest)
+				return
+			}
+
+			tenants <- string(ctx.Request.Header.Peek("X-Scope-OrgID"))
+			ctx.WriteString("Ok")
+		},
+	}
+	go s.Serve(cfg.pipeOut)
+
+	req := fh.AcquireRequest()
+	resp := fh.AcquireResponse()
+
+	req.Header.SetMethod("POST")
+	req.SetRequestURI("http://127.0.0.1/otlp/v1/logs")
+	req.Header.SetContentType("application/x-protobuf")
+	req.SetBody(body)
+
+	require.NoError(t, c.Do(req, resp))
+	assert.Equal(t, 200, resp.StatusCode())
+	assert.ElementsMatch(t, []string{"foobar", "foobaz", "default"}, []string{<-tenants, <-tenants, <-tenants})
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/collector/pdata/pmetric"
+	"go.opentelemetry.io/collector/pdata/pmetric/pmetricotlp"
+
+	fh "github.com/valyala/fasthttp"
+	fhu "github.com/valyala/fasthttp/fasthttputil"
+)
+
+// Builds an OTLP metrics request with:
+// - a resource for tenant "foobar"
+// - a resource without a tenant with a scope overriding it to "foobaz"
+// - a resource without a tenant at all
+func testOTLPMetrics() pmetricotlp.ExportRequest {
+	md := pmetric.NewMetrics()
+
+	rm := md.ResourceMetrics().AppendEmpty()
+	rm.Resource().Attributes().PutStr("__tenant__", "foobar")
+	rm.Resource().Attributes().PutStr("service.name", "svc1")
+	sm := rm.ScopeMetrics().AppendEmpty()
+	g := sm.Metrics().AppendEmpty()
+	g.SetName("foo")
+	g.SetEmptyGauge().DataPoints().AppendEmpty().SetIntValue(1)
+
+	rm = md.ResourceMetrics().AppendEmpty()
+	rm.Resource().Attributes().PutStr("service.name", "svc2")
+	sm = rm.ScopeMetrics().AppendEmpty()
+	sm.Scope().Attributes().PutStr("__tenant__", "foobaz")
+	g = sm.Metrics().AppendEmpty()
+	g.SetName("bar")
+	g.SetEmptyGauge().DataPoints().AppendEmpty().SetIntValue(2)
+	sm = rm.ScopeMetrics().AppendEmpty()
+	g = sm.Metrics().AppendEmpty()
+	g.SetName("baz")
+	g.SetEmptyGauge().DataPoints().AppendEmpty().SetIntValue(3)
+
+	return pmetricotlp.NewExportRequestFromMetrics(md)
+}
+
+func Test_createOTLPMetricsRequests(t *testing.T) {
+	cfg, err := getConfig(testConfig)
+	require.NoError(t, err)
+	cfg.Tenant.LabelRemove = true
+
+	p, err := newProcessor(*cfg)
+	require.NoError(t, err)
+
+	m, err := p.createOTLPMetricsRequests(testOTLPMetrics(), sourceTenant{})
+	require.NoError(t, err)
+	require.Len(t, m, 3)
+
+	unmarshal := func(tenant string) pmetric.Metrics {
+		buf, err := m[tenant]()
+		require.NoError(t, err)
+
+		req, err := p.unmarshalOTLPMetrics(buf, false)
+		require.NoError(t, err)
+
+		return req.Metrics()
+	}
+
+	md := unmarshal("foobar")
+	require.Equal(t, 1, md.ResourceMetrics().Len())
+	_, ok := md.ResourceMetrics().At(0).Resource().Attributes().Get("__tenant__")
+	assert.False(t, ok)
+	assert.Equal(t, "foo", md.ResourceMetrics().At(0).ScopeMetrics().At(0).Metrics().At(0).Name())
+
+	md = unmarshal("foobaz")
+	require.Equal(t, 1, md.ResourceMetrics().Len())
+	rm := md.ResourceMetrics().At(0)
+	v, _ := rm.Resource().Attributes().Get("service.name")
+	assert.Equal(t, "svc2", v.AsString())
+	require.Equal(t, 1, rm.ScopeMetrics().Len())
+	assert.Equal(t, 0, rm.ScopeMetrics().At(0).Scope().Attributes().Len())
+	assert.Equal(t, "bar", rm.ScopeMetrics().At(0).Metrics().At(0).Name())
+
+	md = unmarshal("default")
+	require.Equal(t, 1, md.ResourceMetrics().Len())
+	assert.Equal(t, "baz", md.ResourceMetrics().At(0).ScopeMetrics().At(0).Metrics().At(0).Name())
+
+	// No default tenant
+	cfg.Tenant.Default = ""
+	p, err = newProcessor(*cfg)
+	require.NoError(t, err)
+
+	_, err = p.createOTLPMetricsRequests(testOTLPMetrics(), sourceTenant{})
+	assert.Error(t, err)
+}
+
+func Test_handle_otlp_metrics(t *testing.T) {
+	cfg, err := getConfig(testConfig)
+	require.NoError(t, err)
+
+	cfg.pipeIn = fhu.NewInmemoryListener()
+	cfg.pipeOut = fhu.NewInmemoryListener()
+	cfg.TargetOTLP = "http://127.0.0.1/otlp/v1/metrics"
+
+	p, err := newProcessor(*cfg)
+	require.NoError(t, err)
+	runProcessor(t, p)
+
+	tenants := make(chan string, 3)
+	s := &fh.Server{
+		Handler: func(ctx *fh.RequestCtx) {
+			if _, err := p.unmarshalOTLPMetrics(ctx.Request.Body(), false); err != nil {
+				ctx.Error(err.Error(), fh.StatusBadRequest)
+				return
+			}
+
+			tenants <- string(ctx.Request.Header.Peek("X-Scope-OrgID"))
+			ctx.WriteString("Ok")
+		},
+	}
+	go s.Serve(cfg.pipeOut)
+
+	c := &fh.Client{
+		Dial: func(a string) (net.Conn, error) {
+			return cfg.pipeIn.Dial()
+		},
+	}
+
+	body, err := testOTLPMetrics().MarshalJSON()
+	require.NoError(t, err)
+
+	req := fh.AcquireRequest()
+	resp := fh.AcquireResponse()
+
+	req.Header.SetMethod("POST")
+	req.SetRequestURI("http://127.0.0.1/otlp/v1/metrics")
+	req.Header.SetContentType("application/json")
+	req.SetBody(body)
+
+	require.NoError(t, c.Do(req, resp))
+	assert.Equal(t, 200, resp.StatusCode())
+	assert.ElementsMatch(t, []string{"foobar", "foobaz", "default"}, []string{<-tenants, <-tenants, <-tenants})
+
+	// Wrong Content-Type
+	req.Header.SetContentType("text/plain")
+	resp.Reset()
+
+	require.NoError(t, c.Do(req, resp))
+	assert.Equal(t, 400, resp.StatusCode())
+}
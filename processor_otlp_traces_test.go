@@ -0,0 +1,123 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+	"go.opentelemetry.io/collector/pdata/ptrace/ptraceotlp"
+
+	fh "github.com/valyala/fasthttp"
+	fhu "github.com/valyala/fasthttp/fasthttputil"
+)
+
+// Builds an OTLP traces request with a single resource holding spans
+// of two tenants in different scopes
+func testOTLPTraces() ptraceotlp.ExportRequest {
+	td := ptrace.NewTraces()
+
+	rs := td.ResourceSpans().AppendEmpty()
+	rs.Resource().Attributes().PutStr("__tenant__", "foobar")
+
+	ss := rs.ScopeSpans().AppendEmpty()
+	ss.Spans().AppendEmpty().SetName("span1")
+	ss.Spans().AppendEmpty().SetName("span2")
+
+	ss = rs.ScopeSpans().AppendEmpty()
+	ss.Scope().Attributes().PutStr("__tenant__", "foobaz")
+	ss.Spans().AppendEmpty().SetName("span3")
+
+	return ptraceotlp.NewExportRequestFromTraces(td)
+}
+
+func Test_createOTLPTracesRequests(t *testing.T) {
+	cfg, err := getConfig(testConfig)
+	require.NoError(t, err)
+	cfg.Tenant.LabelRemove = true
+
+	p, err := newProcessor(*cfg)
+	require.NoError(t, err)
+
+	m, err := p.createOTLPTracesRequests(testOTLPTraces(), sourceTenant{})
+	require.NoError(t, err)
+	require.Len(t, m, 2)
+
+	buf, err := m["foobar"]()
+	require.NoError(t, err)
+	req, err := p.unmarshalOTLPTraces(buf, false)
+	require.NoError(t, err)
+
+	td := req.Traces()
+	require.Equal(t, 2, td.SpanCount())
+	assert.Equal(t, 0, td.ResourceSpans().At(0).Resource().Attributes().Len())
+	assert.Equal(t, "span1", td.ResourceSpans().At(0).ScopeSpans().At(0).Spans().At(0).Name())
+
+	buf, err = m["foobaz"]()
+	require.NoError(t, err)
+	req, err = p.unmarshalOTLPTraces(buf, false)
+	require.NoError(t, err)
+
+	// The resource attribute is kept since the tenant came from the scope
+	td = req.Traces()
+	require.Equal(t, 1, td.SpanCount())
+	v, _ := td.ResourceSpans().At(0).Resource().Attributes().Get("__tenant__")
+	assert.Equal(t, "foobar", v.AsString())
+	assert.Equal(t, 0, td.ResourceSpans().At(0).ScopeSpans().At(0).Scope().Attributes().Len())
+	assert.Equal(t, "span3", td.ResourceSpans().At(0).ScopeSpans().At(0).Spans().At(0).Name())
+}
+
+func Test_handle_otlp_traces(t *testing.T) {
+	cfg, err := getConfig(testConfig)
+	require.NoError(t, err)
+
+	cfg.pipeIn = fhu.NewInmemoryListener()
+	cfg.pipeOut = fhu.NewInmemoryListener()
+	cfg.TargetTempo = "http://127.0.0.1/v1/traces"
+
+	p, err := newProcessor(*cfg)
+	require.NoError(t, err)
+	runProcessor(t, p)
+
+	s := &fh.Server{
+		Handler: sinkHandlerError,
+	}
+	go s.Serve(cfg.pipeOut)
+
+	c := &fh.Client{
+		Dial: func(a string) (net.Conn, error) {
+			return cfg.pipeIn.Dial()
+		},
+	}
+
+	body, err := testOTLPTraces().MarshalProto()
+	require.NoError(t, err)
+
+	req := fh.AcquireRequest()
+	resp := fh.AcquireResponse()
+
+	req.Header.SetMethod("POST")
+	req.SetRequestURI("http://127.0.0.1/otlp/v1/traces")
+	req.Header.SetContentType("application/x-protobuf")
+	req.SetBody(body)
+
+	// Upstream error is passed back
+	require.NoError(t, c.Do(req, resp))
+	assert.Equal(t, 500, resp.StatusCode())
+
+	s.Handler = func(ctx *fh.RequestCtx) {
+		ctx.WriteString("Ok")
+	}
+
+	resp.Reset()
+	require.NoError(t, c.Do(req, resp))
+	assert.Equal(t, 200, resp.StatusCode())
+
+	// Broken body
+	req.SetBody([]byte("foobar"))
+	resp.Reset()
+
+	require.NoError(t, c.Do(req, resp))
+	assert.Equal(t, 400, resp.StatusCode())
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	fh "github.com/valyala/fasthttp"
+	fhu "github.com/valyala/fasthttp/fasthttputil"
+)
+
+func testProfileSeries() []profileSeries {
+	return []profileSeries{
+		{
+			labels:  []prompb.Label{{Name: "__name__", Value: "process_cpu"}, {Name: "__tenant__", Value: "foobar"}},
+			samples: [][]byte{[]byte("\x0a\x03abc"), []byte("\x0a\x03def")},
+		},
+		{
+			labels:  []prompb.Label{{Name: "__name__", Value: "memory"}, {Name: "__tenant__", Value: "foobaz"}},
+			samples: [][]byte{[]byte("\x0a\x03ghi")},
+		},
+	}
+}
+
+func Test_pyroscopePush(t *testing.T) {
+	series := testProfileSeries()
+
+	series2, err := unmarshalPyroscopePush(marshalPyroscopePush(series))
+	require.NoError(t, err)
+	assert.Equal(t, series, series2)
+
+	_, err = unmarshalPyroscopePush([]byte("foobar"))
+	assert.Error(t, err)
+}
+
+func Test_parsePyroscopeName(t *testing.T) {
+	lbls, err := parsePyroscopeName("app.cpu{env=staging, __tenant__=foobar}")
+	require.NoError(t, err)
+	assert.Equal(t, []prompb.Label{
+		{Name: "__name__", Value: "app.cpu"},
+		{Name: "env", Value: "staging"},
+		{Name: "__tenant__", Value: "foobar"},
+	}, lbls)
+
+	assert.Equal(t, "app.cpu{__tenant__=foobar,env=staging}", formatPyroscopeName(lbls))
+
+	lbls, err = parsePyroscopeName("app.cpu")
+	require.NoError(t, err)
+	assert.Equal(t, []prompb.Label{{Name: "__name__", Value: "app.cpu"}}, lbls)
+
+	for _, name := range []string{"", "{env=staging}", "app{env=staging", "app{env}"} {
+		_, err = parsePyroscopeName(name)
+		assert.Error(t, err, name)
+	}
+}
+
+func Test_createProfilesPushRequests(t *testing.T) {
+	cfg, err := getConfig(testConfig)
+	require.NoError(t, err)
+	cfg.Tenant.LabelRemove = true
+
+	p, err := newProcessor(*cfg)
+	require.NoError(t, err)
+
+	m, err := p.createProfilesPushRequests(testProfileSeries(), sourceTenant{})
+	require.NoError(t, err)
+	require.Len(t, m, 2)
+
+	buf, err := m["foobar"]()
+	require.NoError(t, err)
+
+	series, err := unmarshalPyroscopePush(buf)
+	require.NoError(t, err)
+	assert.Equal(t, []profileSeries{{
+		labels:  []prompb.Label{{Name: "__name__", Value: "process_cpu"}},
+		samples: [][]byte{[]byte("\x0a\x03abc"), []byte("\x0a\x03def")},
+	}}, series)
+}
+
+func Test_handle_profiles(t *testing.T) {
+	cfg, err := getConfig(testConfig)
+	require.NoError(t, err)
+
+	cfg.pipeIn = fhu.NewInmemoryListener()
+	cfg.pipeOut = fhu.NewInmemoryListener()
+	cfg.TargetPyroscope = "http://127.0.0.1/"
+
+	p, err := newProcessor(*cfg)
+	require.NoError(t, err)
+	runProcessor(t, p)
+
+	type upstreamReq struct {
+		tenant, uri string
+	}
+
+	reqs := make(chan upstreamReq, 2)
+	s := &fh.Server{
+		Handler: func(ctx *fh.RequestCtx) {
+			reqs <- upstreamReq{
+				tenant: string(ctx.Request.Header.Peek("X-Scope-OrgID")),
+				uri:    string(ctx.RequestURI()),
+			}
+		},
+	}
+	go s.Serve(cfg.pipeOut)
+
+	c := &fh.Client{
+		Dial: func(a string) (net.Conn, error) {
+			return cfg.pipeIn.Dial()
+		},
+	}
+
+	req := fh.AcquireRequest()
+	resp := fh.AcquireResponse()
+
+	req.Header.SetMethod("POST")
+	req.SetRequestURI("http://127.0.0.1/push.v1.PusherService/Push")
+	req.Header.SetContentType("application/proto")
+	req.SetBody(marshalPyroscopePush(testProfileSeries()))
+
+	require.NoError(t, c.Do(req, resp))
+	assert.Equal(t, 200, resp.StatusCode())
+
+	r1, r2 := <-reqs, <-reqs
+	assert.ElementsMatch(t, []string{"foobar", "foobaz"}, []string{r1.tenant, r2.tenant})
+	assert.Equal(t, "/push.v1.PusherService/Push", r1.uri)
+
+	// Unsupported encoding
+	req.Header.SetContentType("application/json")
+	resp.Reset()
+
+	require.NoError(t, c.Do(req, resp))
+	assert.Equal(t, 415, resp.StatusCode())
+
+	// Legacy ingestion
+	req.SetRequestURI("http://127.0.0.1/ingest?name=app.cpu%7B__tenant__%3Dfoobar%7D&format=folded")
+	req.Header.SetContentType("text/plain")
+	req.SetBodyString("foo;bar 100")
+	resp.Reset()
+
+	require.NoError(t, c.Do(req, resp))
+	assert.Equal(t, 200, resp.StatusCode())
+
+	r1 = <-reqs
+	assert.Equal(t, "foobar", r1.tenant)
+	assert.Contains(t, r1.uri, "/ingest?name=app.cpu%7B__tenant__%3Dfoobar%7D")
+	assert.Contains(t, r1.uri, "format=folded")
+}
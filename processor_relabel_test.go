@@ -0,0 +1,273 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/grafana/loki/v3/pkg/logproto"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/prompb"
+	writev2 "github.com/prometheus/prometheus/prompb/io/prometheus/write/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+)
+
+const testRelabelConfig = testConfig + `
+relabel_configs:
+  - action: drop
+    source_labels: [job]
+    regex: drop-me
+  - action: replace
+    source_labels: [team]
+    regex: "team-(.*)"
+    target_label: __tenant__
+    replacement: "tenant-$1"
+  - action: labeldrop
+    regex: team
+  - action: lowercase
+    source_labels: [env]
+    target_label: env
+`
+
+func Test_relabelTimeseries(t *testing.T) {
+	cfg, err := getConfig(testRelabelConfig)
+	require.NoError(t, err)
+	require.Len(t, cfg.RelabelConfigs, 4)
+
+	p, err := newProcessor(*cfg)
+	require.NoError(t, err)
+
+	dropped := testutil.ToFloat64(metricRelabelDropped.WithLabelValues("timeseries"))
+
+	wrReq := &prompb.WriteRequest{Timeseries: []prompb.TimeSeries{
+		{Labels: []prompb.Label{{Name: "team", Value: "team-foo"}, {Name: "env", Value: "PROD"}, {Name: "__name__", Value: "up"}}},
+		{Labels: []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "drop-me"}}},
+		{Labels: []prompb.Label{{Name: "__name__", Value: "up"}}},
+	}}
+
+	m, err := p.createWriteRequests(wrReq, sourceTenant{})
+	require.NoError(t, err)
+	require.Len(t, m, 2)
+	assert.Equal(t, dropped+1, testutil.ToFloat64(metricRelabelDropped.WithLabelValues("timeseries")))
+
+	b, err := m["tenant-foo"]()
+	require.NoError(t, err)
+
+	wrReqOut, err := p.unmarshalPromWrite(b)
+	require.NoError(t, err)
+	require.Len(t, wrReqOut.Timeseries, 1)
+
+	// Tenant label is synthesized by relabeling and the labels are kept sorted
+	assert.Equal(t, []prompb.Label{
+		{Name: "__name__", Value: "up"},
+		{Name: "__tenant__", Value: "tenant-foo"},
+		{Name: "env", Value: "prod"},
+	}, wrReqOut.Timeseries[0].Labels)
+
+	_, ok := m["default"]
+	assert.True(t, ok)
+
+	// Remote Write 2.0
+	wrReqV2 := &writev2.Request{
+		Symbols: []string{"", "__name__", "up", "team", "team-bar", "job", "drop-me"},
+		Timeseries: []writev2.TimeSeries{
+			{LabelsRefs: []uint32{1, 2, 3, 4}},
+			{LabelsRefs: []uint32{1, 2, 5, 6}},
+		},
+	}
+
+	m, err = p.createWriteRequestsV2(wrReqV2, sourceTenant{})
+	require.NoError(t, err)
+	require.Len(t, m, 1)
+	assert.Equal(t, dropped+2, testutil.ToFloat64(metricRelabelDropped.WithLabelValues("timeseries")))
+
+	b, err = m["tenant-bar"]()
+	require.NoError(t, err)
+
+	wrReqV2Out, err := p.unmarshalPromWriteV2(b)
+	require.NoError(t, err)
+	require.Len(t, wrReqV2Out.Timeseries, 1)
+
+	var lbls []string
+	for _, ref := range wrReqV2Out.Timeseries[0].LabelsRefs {
+		lbls = append(lbls, wrReqV2Out.Symbols[ref])
+	}
+	assert.Equal(t, []string{"__name__", "up", "__tenant__", "tenant-bar"}, lbls)
+
+	// The symbols are interned rather than appended for every series
+	wrReqV2.Timeseries = nil
+	for range 100 {
+		wrReqV2.Timeseries = append(wrReqV2.Timeseries, writev2.TimeSeries{LabelsRefs: []uint32{1, 2, 3, 4}})
+	}
+
+	_, err = p.createWriteRequestsV2(wrReqV2, sourceTenant{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"", "__name__", "up", "team", "team-bar", "job", "drop-me", "__tenant__", "tenant-bar"}, wrReqV2.Symbols)
+
+	_, err = p.createWriteRequestsV2(&writev2.Request{
+		Symbols:    []string{""},
+		Timeseries: []writev2.TimeSeries{{LabelsRefs: []uint32{1, 2}}},
+	}, sourceTenant{})
+	assert.Error(t, err)
+}
+
+func Test_relabelStream(t *testing.T) {
+	cfg, err := getConfig(testRelabelConfig)
+	require.NoError(t, err)
+
+	p, err := newProcessor(*cfg)
+	require.NoError(t, err)
+
+	dropped := testutil.ToFloat64(metricRelabelDropped.WithLabelValues("streams"))
+
+	m, err := p.createPushRequests(&logproto.PushRequest{Streams: []logproto.Stream{
+		{Labels: `{team="team-foo", env="DEV"}`, Entries: []logproto.Entry{{Line: "foo"}}},
+		{Labels: `{job="drop-me"}`, Entries: []logproto.Entry{{Line: "bar"}}},
+	}}, sourceTenant{})
+	require.NoError(t, err)
+	require.Len(t, m, 1)
+	assert.Equal(t, dropped+1, testutil.ToFloat64(metricRelabelDropped.WithLabelValues("streams")))
+
+	b, err := m["tenant-foo"]()
+	require.NoError(t, err)
+
+	b, err = snappy.Decode(nil, b)
+	require.NoError(t, err)
+
+	req, err := p.unmarshalLokiPush(b)
+	require.NoError(t, err)
+	require.Len(t, req.Streams, 1)
+	assert.Equal(t, `{__tenant__="tenant-foo", env="dev"}`, req.Streams[0].Labels)
+
+	_, err = p.createPushRequests(&logproto.PushRequest{Streams: []logproto.Stream{{Labels: `{foo`}}}, sourceTenant{})
+	assert.Error(t, err)
+}
+
+func Test_relabel_config_invalid(t *testing.T) {
+	cfg := &config{}
+	err := yaml.UnmarshalStrict([]byte(`
+relabel_configs:
+  - action: replace
+    source_labels: [foo]
+`), cfg)
+	assert.Error(t, err)
+}
+
+const testTenantsConfig = testConfig + `
+tenants:
+  foobar:
+    external_labels:
+      origin_proxy: ct-1
+      env: prod
+    relabel_configs:
+      - action: keep
+        source_labels: [__name__]
+        regex: "up|requests_total"
+  foobaz:
+    relabel_configs:
+      - action: labeldrop
+        regex: pod
+`
+
+func Test_tenantRelabelWrite(t *testing.T) {
+	cfg, err := getConfig(testTenantsConfig)
+	require.NoError(t, err)
+
+	p, err := newProcessor(*cfg)
+	require.NoError(t, err)
+
+	wrReq := &prompb.WriteRequest{Timeseries: []prompb.TimeSeries{
+		{Labels: []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "__tenant__", Value: "foobar"}, {Name: "env", Value: "dev"}}},
+		{Labels: []prompb.Label{{Name: "__name__", Value: "expensive"}, {Name: "__tenant__", Value: "foobar"}}},
+		{Labels: []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "__tenant__", Value: "foobaz"}, {Name: "pod", Value: "a"}}},
+		{Labels: []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "pod", Value: "a"}}},
+	}}
+
+	m, err := p.createWriteRequests(wrReq, sourceTenant{})
+	require.NoError(t, err)
+	require.Len(t, m, 3)
+
+	exp := map[string][]prompb.Label{
+		// External label doesn't override the existing one
+		"foobar":  {{Name: "__name__", Value: "up"}, {Name: "__tenant__", Value: "foobar"}, {Name: "env", Value: "dev"}, {Name: "origin_proxy", Value: "ct-1"}},
+		"foobaz":  {{Name: "__name__", Value: "up"}, {Name: "__tenant__", Value: "foobaz"}},
+		"default": {{Name: "__name__", Value: "up"}, {Name: "pod", Value: "a"}},
+	}
+
+	for tenant, lbls := range exp {
+		b, err := m[tenant]()
+		require.NoError(t, err)
+
+		wrReqOut, err := p.unmarshalPromWrite(b)
+		require.NoError(t, err)
+		require.Len(t, wrReqOut.Timeseries, 1, tenant)
+		assert.Equal(t, lbls, wrReqOut.Timeseries[0].Labels, tenant)
+	}
+
+	// All series of the tenant are dropped
+	m, err = p.createWriteRequests(&prompb.WriteRequest{Timeseries: []prompb.TimeSeries{
+		{Labels: []prompb.Label{{Name: "__name__", Value: "expensive"}, {Name: "__tenant__", Value: "foobar"}}},
+	}}, sourceTenant{})
+	require.NoError(t, err)
+	assert.Empty(t, m)
+
+	// Remote Write 2.0
+	m, err = p.createWriteRequestsV2(&writev2.Request{
+		Symbols: []string{"", "__name__", "up", "__tenant__", "foobar", "expensive"},
+		Timeseries: []writev2.TimeSeries{
+			{LabelsRefs: []uint32{1, 2, 3, 4}},
+			{LabelsRefs: []uint32{1, 5, 3, 4}},
+		},
+	}, sourceTenant{})
+	require.NoError(t, err)
+	require.Len(t, m, 1)
+
+	b, err := m["foobar"]()
+	require.NoError(t, err)
+
+	wrReqV2Out, err := p.unmarshalPromWriteV2(b)
+	require.NoError(t, err)
+	require.Len(t, wrReqV2Out.Timeseries, 1)
+
+	var lbls []string
+	for _, ref := range wrReqV2Out.Timeseries[0].LabelsRefs {
+		lbls = append(lbls, wrReqV2Out.Symbols[ref])
+	}
+	assert.Equal(t, []string{"__name__", "up", "__tenant__", "foobar", "env", "prod", "origin_proxy", "ct-1"}, lbls)
+}
+
+func Test_tenantRelabelPush(t *testing.T) {
+	cfg, err := getConfig(testTenantsConfig)
+	require.NoError(t, err)
+
+	p, err := newProcessor(*cfg)
+	require.NoError(t, err)
+
+	m, err := p.createPushRequests(&logproto.PushRequest{Streams: []logproto.Stream{
+		{Labels: `{__tenant__="foobaz", pod="a", app="foo"}`, Entries: []logproto.Entry{{Line: "foo"}}},
+	}}, sourceTenant{})
+	require.NoError(t, err)
+
+	b, err := m["foobaz"]()
+	require.NoError(t, err)
+
+	b, err = snappy.Decode(nil, b)
+	require.NoError(t, err)
+
+	req, err := p.unmarshalLokiPush(b)
+	require.NoError(t, err)
+	require.Len(t, req.Streams, 1)
+	assert.Equal(t, `{__tenant__="foobaz", app="foo"}`, req.Streams[0].Labels)
+
+	// Streams have no __name__ so everything is dropped by the keep rule
+	m, err = p.createPushRequests(&logproto.PushRequest{Streams: []logproto.Stream{
+		{Labels: `{__tenant__="foobar"}`, Entries: []logproto.Entry{{Line: "foo"}}},
+	}}, sourceTenant{})
+	require.NoError(t, err)
+	assert.Empty(t, m)
+
+	cfg.Tenants["foobar"] = tenantConfig{ExternalLabels: map[string]string{"": "baz"}}
+	_, err = newProcessor(*cfg)
+	assert.Error(t, err)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/grafana/loki/v3/pkg/logproto"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/prompb"
+	writev2 "github.com/prometheus/prometheus/prompb/io/prometheus/write/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testRoutesConfig = testConfig + `
+routes:
+  - name: infra-prod
+    match: '{job=~"node.*", env="prod"}'
+    tenant: infra-prod
+  - name: audit
+    match: '{audit!=""}'
+    tenant: audit
+    continue: true
+  - match: '{team="a", env!~"dev|test"}'
+    tenant: team-a
+`
+
+func Test_routes(t *testing.T) {
+	cfg, err := getConfig(testRoutesConfig)
+	require.NoError(t, err)
+
+	p, err := newProcessor(*cfg)
+	require.NoError(t, err)
+	require.Len(t, p.routes, 3)
+
+	hits := func(route string) float64 {
+		return testutil.ToFloat64(metricRouteHits.WithLabelValues(route))
+	}
+
+	hitsInfra, hitsAudit, hitsTeam, hitsDefault := hits("infra-prod"), hits("audit"), hits("2"), hits(routeDefault)
+
+	series := func(lbls ...string) prompb.TimeSeries {
+		ts := prompb.TimeSeries{}
+		for i := 0; i < len(lbls); i += 2 {
+			ts.Labels = append(ts.Labels, prompb.Label{Name: lbls[i], Value: lbls[i+1]})
+		}
+
+		return ts
+	}
+
+	m, err := p.createWriteRequests(&prompb.WriteRequest{Timeseries: []prompb.TimeSeries{
+		series("env", "prod", "job", "node-exporter"),
+		// Fan out to both audit and team-a
+		series("audit", "yes", "team", "a"),
+		// Only audit, team-a doesn't match the env
+		series("audit", "yes", "env", "dev", "team", "a"),
+		// Default rule
+		series("__tenant__", "foobar", "env", "dev", "job", "node"),
+	}}, sourceTenant{})
+	require.NoError(t, err)
+
+	counts := map[string]int{}
+	for tenant, f := range m {
+		b, err := f()
+		require.NoError(t, err)
+
+		wrReq, err := p.unmarshalPromWrite(b)
+		require.NoError(t, err)
+		counts[tenant] = len(wrReq.Timeseries)
+	}
+
+	assert.Equal(t, map[string]int{"infra-prod": 1, "audit": 2, "team-a": 1, "foobar": 1}, counts)
+
+	assert.Equal(t, hitsInfra+1, hits("infra-prod"))
+	assert.Equal(t, hitsAudit+2, hits("audit"))
+	assert.Equal(t, hitsTeam+1, hits("2"))
+	assert.Equal(t, hitsDefault+1, hits(routeDefault))
+
+	// Remote Write 2.0
+	m, err = p.createWriteRequestsV2(&writev2.Request{
+		Symbols: []string{"", "audit", "yes", "team", "a", "__tenant__", "foobar"},
+		Timeseries: []writev2.TimeSeries{
+			{LabelsRefs: []uint32{1, 2, 3, 4}},
+			{LabelsRefs: []uint32{5, 6}},
+		},
+	}, sourceTenant{})
+	require.NoError(t, err)
+	assert.Len(t, m, 3)
+	assert.Contains(t, m, "audit")
+	assert.Contains(t, m, "team-a")
+	assert.Contains(t, m, "foobar")
+
+	// Loki
+	m, err = p.createPushRequests(&logproto.PushRequest{Streams: []logproto.Stream{
+		{Labels: `{env="prod", job="node"}`, Entries: []logproto.Entry{{Line: "foo"}}},
+		{Labels: `{__tenant__="foobaz"}`, Entries: []logproto.Entry{{Line: "bar"}}},
+	}}, sourceTenant{})
+	require.NoError(t, err)
+	assert.Len(t, m, 2)
+	assert.Contains(t, m, "infra-prod")
+	assert.Contains(t, m, "foobaz")
+}
+
+func Test_routes_invalid(t *testing.T) {
+	cfg, err := getConfig(testConfig)
+	require.NoError(t, err)
+
+	for _, rc := range []routeConfig{
+		{Match: `{job="foo"}`},
+		{Match: `{job="foo"`, Tenant: "foo"},
+		{Match: `{job=~"("}`, Tenant: "foo"},
+	} {
+		cfg.Routes = []routeConfig{rc}
+		_, err = newProcessor(*cfg)
+		assert.Error(t, err, rc.Match)
+	}
+
+	// Collides with the implicit rule in the metrics
+	file := filepath.Join(t.TempDir(), "config.yml")
+	require.NoError(t, os.WriteFile(file, []byte(testConfig+"routes:\n  - name: default\n    match: '{job=\"foo\"}'\n    tenant: foo\n"), 0o644))
+
+	_, err = configLoad(file)
+	assert.Error(t, err)
+}
+
+func Test_routes_dedupe(t *testing.T) {
+	cfg, err := getConfig(testConfig + `
+routes:
+  - match: '{job="foo"}'
+    tenant: foo
+    continue: true
+  - match: '{env="prod"}'
+    tenant: foo
+    continue: true
+  - match: '{env="prod"}'
+    tenant: bar
+`)
+	require.NoError(t, err)
+
+	p, err := newProcessor(*cfg)
+	require.NoError(t, err)
+
+	ts := prompb.TimeSeries{Labels: []prompb.Label{{Name: "env", Value: "prod"}, {Name: "job", Value: "foo"}}}
+	tenants, err := p.timeseriesTenants(nil, &ts, sourceTenant{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"foo", "bar"}, tenants)
+}
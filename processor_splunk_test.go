@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/grafana/loki/v3/pkg/logproto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	fh "github.com/valyala/fasthttp"
+	fhu "github.com/valyala/fasthttp/fasthttputil"
+)
+
+func Test_splunkEventsToPushRequest(t *testing.T) {
+	now := time.Unix(1000, 0)
+
+	req, hErr := splunkEventsToPushRequest([]byte(`{"time": 1426279439.5, "host": "h1", "index": "main", "event": "hello", "fields": {"b": 1, "a": "x"}}
+{"event": {"foo": "bar"}, "index": "main", "host": "h1"}{"event": "world"}`), now)
+	require.Nil(t, hErr)
+
+	assert.Equal(t, []logproto.Stream{
+		{
+			Labels: `{host="h1", index="main"}`,
+			Entries: []logproto.Entry{
+				{
+					Timestamp:          time.Unix(1426279439, 5e8),
+					Line:               "hello",
+					StructuredMetadata: []logproto.LabelAdapter{{Name: "a", Value: "x"}, {Name: "b", Value: "1"}},
+				},
+				{Timestamp: now, Line: `{"foo": "bar"}`},
+			},
+		},
+		{
+			Labels:  `{job="splunk"}`,
+			Entries: []logproto.Entry{{Timestamp: now, Line: "world"}},
+		},
+	}, req.Streams)
+
+	for body, code := range map[string]int{
+		`{"host": "h1"}`:             hecCodeEventRequired,
+		`{"event": ""}`:              hecCodeEventBlank,
+		`{"event": "a"`:              hecCodeInvalidFormat,
+		`{"event": "a", "time": 1}x`: hecCodeInvalidFormat,
+	} {
+		_, hErr = splunkEventsToPushRequest([]byte(body), now)
+		require.NotNil(t, hErr, body)
+		assert.Equal(t, code, hErr.code, body)
+	}
+}
+
+func Test_handle_splunk(t *testing.T) {
+	cfg, err := getConfig(testLokiConfig)
+	require.NoError(t, err)
+
+	cfg.pipeIn = fhu.NewInmemoryListener()
+	cfg.pipeOut = fhu.NewInmemoryListener()
+	cfg.Tenant.LabelList = []string{"index"}
+	cfg.Splunk.Tokens = map[string]string{
+		"token1": "foobar",
+		"token2": "",
+		"token3": "",
+	}
+	cfg.Authorization.Rules = []authorizationRuleConfig{
+		{Identity: splunkIdentity("token3"), Tenants: []string{"foobaz"}},
+		{Tenants: []string{"*"}},
+	}
+
+	p, err := newProcessor(*cfg)
+	require.NoError(t, err)
+	runProcessor(t, p)
+
+	tenants := make(chan string, 10)
+	s := &fh.Server{
+		Handler: func(ctx *fh.RequestCtx) {
+			b, err := snappy.Decode(nil, ctx.Request.Body())
+			if err != nil {
+				ctx.Error(err.Error(), fh.StatusBadRequest)
+				return
+			}
+
+			if _, err := p.unmarshalLokiPush(b); err != nil {
+				ctx.Error(err.Error(), fh.StatusBadRequest)
+				return
+			}
+
+			tenant := string(ctx.Request.Header.Peek("X-Scope-OrgID"))
+			tenants <- tenant
+
+			if tenant == "broken" {
+				ctx.Error("rate limited", fh.StatusTooManyRequests)
+				return
+			}
+
+			ctx.SetStatusCode(fh.StatusNoContent)
+		},
+	}
+	go s.Serve(cfg.pipeOut)
+
+	c := &fh.Client{
+		Dial: func(a string) (net.Conn, error) {
+			return cfg.pipeIn.Dial()
+		},
+	}
+
+	do := func(uri, token, body string) (int, int) {
+		req := fh.AcquireRequest()
+		resp := fh.AcquireResponse()
+		defer fh.ReleaseRequest(req)
+		defer fh.ReleaseResponse(resp)
+
+		req.Header.SetMethod("POST")
+		req.SetRequestURI("http://127.0.0.1" + uri)
+		if token != "" {
+			req.Header.Set("Authorization", "Splunk "+token)
+		}
+		req.SetBodyString(body)
+
+		require.NoError(t, c.Do(req, resp))
+
+		var hecResp struct {
+			Code int
+		}
+		require.NoError(t, json.Unmarshal(resp.Body(), &hecResp))
+		return resp.StatusCode(), hecResp.Code
+	}
+
+	// Authentication
+	status, code := do("/services/collector/event", "", `{"event": "a"}`)
+	assert.Equal(t, 401, status)
+	assert.Equal(t, hecCodeTokenRequired, code)
+
+	status, code = do("/services/collector/event", "foo", `{"event": "a"}`)
+	assert.Equal(t, 403, status)
+	assert.Equal(t, hecCodeInvalidToken, code)
+
+	// Tenant from the token
+	status, code = do("/services/collector/event", "token1", `{"event": "a", "index": "foobaz"}`)
+	assert.Equal(t, 200, status)
+	assert.Equal(t, hecCodeSuccess, code)
+	assert.Equal(t, "foobar", <-tenants)
+
+	// Tenant from the index
+	status, _ = do("/services/collector/raw?index=foobaz", "token2", "line1\nline2\n")
+	assert.Equal(t, 200, status)
+	assert.Equal(t, "foobaz", <-tenants)
+
+	// Failure of one of the tenants fails the whole request
+	status, code = do("/services/collector", "token2", `{"event": "a", "index": "foobaz"}{"event": "b", "index": "broken"}`)
+	assert.Equal(t, 429, status)
+	assert.Equal(t, hecCodeInternalError, code)
+	assert.ElementsMatch(t, []string{"foobaz", "broken"}, []string{<-tenants, <-tenants})
+
+	// The token identity is authorized
+	status, _ = do("/services/collector/raw?index=foobaz", "token3", "line1\n")
+	assert.Equal(t, 200, status)
+	assert.Equal(t, "foobaz", <-tenants)
+
+	status, code = do("/services/collector/raw?index=foobar", "token3", "line1\n")
+	assert.Equal(t, 403, status)
+	assert.Equal(t, hecCodeInvalidAuth, code)
+}
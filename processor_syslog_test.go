@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/grafana/loki/v3/pkg/logproto"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	fh "github.com/valyala/fasthttp"
+	fhu "github.com/valyala/fasthttp/fasthttputil"
+)
+
+func Test_parseSyslog(t *testing.T) {
+	now := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+
+	m, err := parseSyslog([]byte(`<165>1 2003-10-11T22:14:15.003Z mymachine.example.com evntslog 1234 ID47 [exampleSDID@32473 iut="3" eventID="10\]11"][other@1 a="b"] An application event`), now)
+	require.NoError(t, err)
+	assert.Equal(t, syslogMessage{
+		facility:  20,
+		severity:  5,
+		timestamp: time.Date(2003, 10, 11, 22, 14, 15, 3000000, time.UTC),
+		hostname:  "mymachine.example.com",
+		appName:   "evntslog",
+		procID:    "1234",
+		msgID:     "ID47",
+		message:   "An application event",
+	}, m)
+	assert.Equal(t, "local4", m.facilityName())
+	assert.Equal(t, "notice", m.severityName())
+
+	m, err = parseSyslog([]byte("<13>1 - - - - - -\n"), now)
+	require.NoError(t, err)
+	assert.Equal(t, syslogMessage{facility: 1, severity: 5}, m)
+
+	m, err = parseSyslog([]byte("<34>Oct 11 22:14:15 mymachine su[123]: 'su root' failed"), now)
+	require.NoError(t, err)
+	assert.Equal(t, syslogMessage{
+		facility:  4,
+		severity:  2,
+		timestamp: time.Date(2023, 10, 11, 22, 14, 15, 0, time.UTC),
+		hostname:  "mymachine",
+		appName:   "su",
+		procID:    "123",
+		message:   "'su root' failed",
+	}, m)
+
+	// No header at all
+	m, err = parseSyslog([]byte("<14>something happened"), now)
+	require.NoError(t, err)
+	assert.Equal(t, "something happened", m.message)
+	assert.True(t, m.timestamp.IsZero())
+
+	for _, msg := range []string{"", "foo", "<200>foo", "<1x>foo", "<13>1 2003-10-11T22:14:15Z host", "<13>1 foo host app - - -", "<13>1 - - - - - [unterminated"} {
+		_, err = parseSyslog([]byte(msg), now)
+		assert.Error(t, err, msg)
+	}
+}
+
+func Test_readSyslogFrame(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("<13>first\r\n\n11 <13>sec\nond<13>third"))
+
+	for _, exp := range []string{"<13>first", "<13>sec\nond", "<13>third"} {
+		b, err := readSyslogFrame(r)
+		require.NoError(t, err)
+		assert.Equal(t, exp, string(b))
+	}
+
+	_, err := readSyslogFrame(r)
+	assert.Error(t, err)
+
+	for _, s := range []string{"99999999 <13>foo", "99999 <13>foo", strings.Repeat("1", 1024), "1x <13>foo"} {
+		_, err = readSyslogFrame(newSyslogReader(strings.NewReader(s)))
+		assert.Error(t, err, s)
+	}
+
+	// Longer than the default bufio buffer
+	line := "<13>" + strings.Repeat("a", 10*1024)
+	b, err := readSyslogFrame(newSyslogReader(strings.NewReader(line + "\n")))
+	require.NoError(t, err)
+	assert.Equal(t, line, string(b))
+
+	_, err = readSyslogFrame(newSyslogReader(strings.NewReader(strings.Repeat("a", maxSyslogMessageSize+1) + "\n")))
+	assert.Error(t, err)
+}
+
+func Test_syslog(t *testing.T) {
+	cfg, err := getConfig(testLokiConfig)
+	require.NoError(t, err)
+
+	cfg.pipeIn = fhu.NewInmemoryListener()
+	cfg.pipeOut = fhu.NewInmemoryListener()
+	cfg.Tenant.LabelList = []string{"host"}
+	cfg.Syslog.BatchWait = 10 * time.Millisecond
+	cfg.Syslog.Listeners = []syslogListenerConfig{{
+		ListenTCP:     "127.0.0.1:0",
+		ListenUDP:     "127.0.0.1:0",
+		DefaultTenant: "network",
+	}}
+
+	p, err := newProcessor(*cfg)
+	require.NoError(t, err)
+	runProcessor(t, p)
+
+	type pushed struct {
+		tenant  string
+		streams []logproto.Stream
+	}
+
+	reqs := make(chan pushed, 10)
+	s := &fh.Server{
+		Handler: func(ctx *fh.RequestCtx) {
+			b, err := snappy.Decode(nil, ctx.Request.Body())
+			if err != nil {
+				ctx.Error(err.Error(), fh.StatusBadRequest)
+				return
+			}
+
+			req, err := p.unmarshalLokiPush(b)
+			if err != nil {
+				ctx.Error(err.Error(), fh.StatusBadRequest)
+				return
+			}
+
+			reqs <- pushed{string(ctx.Request.Header.Peek("X-Scope-OrgID")), req.Streams}
+		},
+	}
+	go s.Serve(cfg.pipeOut)
+
+	c, err := net.Dial("tcp", p.syslogListeners[0].tcp.Addr().String())
+	require.NoError(t, err)
+	defer c.Close()
+
+	_, err = c.Write([]byte("<34>Oct 11 22:14:15 foobar su: failed\n27 <13>1 - - app - - - message"))
+	require.NoError(t, err)
+
+	// Both messages might end up in the same batch
+	streams := map[string][]logproto.Stream{}
+	for len(streams) < 2 {
+		r := <-reqs
+		streams[r.tenant] = r.streams
+	}
+
+	require.Len(t, streams["foobar"], 1)
+	assert.Equal(t, `{app="su", facility="auth", host="foobar", severity="crit"}`, streams["foobar"][0].Labels)
+	assert.Equal(t, "failed", streams["foobar"][0].Entries[0].Line)
+
+	require.Len(t, streams["network"], 1)
+	assert.Equal(t, `{app="app", facility="user", severity="notice"}`, streams["network"][0].Labels)
+	assert.Equal(t, "message", streams["network"][0].Entries[0].Line)
+
+	u, err := net.Dial("udp", p.syslogListeners[0].udp.LocalAddr().String())
+	require.NoError(t, err)
+	defer u.Close()
+
+	_, err = u.Write([]byte("<13>1 - foobaz - - - - udp message"))
+	require.NoError(t, err)
+
+	r := <-reqs
+	assert.Equal(t, "foobaz", r.tenant)
+	assert.Equal(t, "udp message", r.streams[0].Entries[0].Line)
+}
+
+func Test_syslogEntry(t *testing.T) {
+	cfg, err := getConfig(testLokiConfig + `
+relabel_configs:
+  - action: drop
+    source_labels: [app]
+    regex: noisy
+  - action: replace
+    source_labels: [host]
+    regex: "team-(.*)"
+    target_label: __tenant__
+routes:
+  - match: '{severity="crit"}'
+    tenant: alerts
+    continue: true
+`)
+	require.NoError(t, err)
+
+	p, err := newProcessor(*cfg)
+	require.NoError(t, err)
+
+	now := time.Now()
+	parse := func(b string) syslogMessage {
+		msg, err := parseSyslog([]byte(b), now)
+		require.NoError(t, err)
+		return msg
+	}
+
+	// The tenant label is synthesized by the relabeling
+	e, keep, err := p.syslogEntry(parse("<13>1 - team-a app - - - message"), now, sourceTenant{})
+	require.NoError(t, err)
+	assert.True(t, keep)
+	assert.Equal(t, []string{"a"}, e.tenants)
+	assert.Equal(t, `{__tenant__="a", app="app", facility="user", host="team-a", severity="notice"}`, e.labels)
+
+	// The routes apply as well
+	e, keep, err = p.syslogEntry(parse("<34>1 - team-a app - - - message"), now, sourceTenant{})
+	require.NoError(t, err)
+	assert.True(t, keep)
+	assert.Equal(t, []string{"alerts"}, e.tenants)
+
+	_, keep, err = p.syslogEntry(parse("<13>1 - team-a noisy - - - message"), now, sourceTenant{})
+	require.NoError(t, err)
+	assert.False(t, keep)
+}
+
+func Test_syslog_idle(t *testing.T) {
+	cfg, err := getConfig(testLokiConfig)
+	require.NoError(t, err)
+
+	cfg.pipeIn = fhu.NewInmemoryListener()
+	cfg.IdleTimeout = 50 * time.Millisecond
+	cfg.Syslog.Listeners = []syslogListenerConfig{{ListenTCP: "127.0.0.1:0"}}
+
+	p, err := newProcessor(*cfg)
+	require.NoError(t, err)
+	runProcessor(t, p)
+
+	// Neither the idle clients nor the ones stuck in a partial frame keep the connection
+	for _, b := range []string{"", "27 <13>1"} {
+		c, err := net.Dial("tcp", p.syslogListeners[0].tcp.Addr().String())
+		require.NoError(t, err)
+		defer c.Close()
+
+		_, err = c.Write([]byte(b))
+		require.NoError(t, err)
+
+		require.NoError(t, c.SetReadDeadline(time.Now().Add(5*time.Second)))
+		_, err = c.Read(make([]byte, 1))
+		assert.ErrorIs(t, err, io.EOF, b)
+	}
+}
+
+func Test_syslog_queueFull(t *testing.T) {
+	cfg, err := getConfig(testLokiConfig)
+	require.NoError(t, err)
+
+	cfg.Syslog.BatchSize = 2
+	cfg.Syslog.Listeners = []syslogListenerConfig{{ListenUDP: "127.0.0.1:0"}}
+
+	p, err := newProcessor(*cfg)
+	require.NoError(t, err)
+
+	dropped := testutil.ToFloat64(metricSyslogMessagesDropped.WithLabelValues("queue_full"))
+
+	// The batcher isn't running, the listener doesn't wait for it
+	for i := 0; i < 5; i++ {
+		p.syslogListeners[0].handleMessage([]byte("<13>1 - foobar - - - - message"), "udp", "")
+	}
+
+	assert.Len(t, p.syslog.entries, 2)
+	assert.Equal(t, dropped+3, testutil.ToFloat64(metricSyslogMessagesDropped.WithLabelValues("queue_full")))
+}
+
+func Test_syslog_sourceNetworks(t *testing.T) {
+	cfg, err := getConfig(testLokiConfig)
+	require.NoError(t, err)
+
+	cfg.pipeIn = fhu.NewInmemoryListener()
+	cfg.pipeOut = fhu.NewInmemoryListener()
+	cfg.Tenant.LabelList = []string{"host"}
+	cfg.Syslog.BatchWait = 10 * time.Millisecond
+	cfg.Syslog.Listeners = []syslogListenerConfig{{ListenTCP: "127.0.0.1:0", ListenUDP: "127.0.0.1:0"}}
+	cfg.SourceNetworks.Networks = []sourceNetworkConfig{{CIDRs: []string{"127.0.0.1/32"}, Tenant: "loopback"}}
+
+	p, err := newProcessor(*cfg)
+	require.NoError(t, err)
+	runProcessor(t, p)
+
+	tenants := make(chan string, 10)
+	s := &fh.Server{
+		Handler: func(ctx *fh.RequestCtx) {
+			tenants <- string(ctx.Request.Header.Peek("X-Scope-OrgID"))
+		},
+	}
+	go s.Serve(cfg.pipeOut)
+
+	// The default tenant of the source network is used if none of the labels matched
+	c, err := net.Dial("tcp", p.syslogListeners[0].tcp.Addr().String())
+	require.NoError(t, err)
+	defer c.Close()
+
+	_, err = c.Write([]byte("<13>1 - - app - - - message\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "loopback", <-tenants)
+
+	// The denied clients are disconnected and their datagrams are dropped
+	cfg.pipeIn = fhu.NewInmemoryListener()
+	cfg.SourceNetworks.Networks = []sourceNetworkConfig{{CIDRs: []string{"127.0.0.0/8"}, Action: sourceNetworkActionDeny}}
+
+	p, err = newProcessor(*cfg)
+	require.NoError(t, err)
+	runProcessor(t, p)
+
+	denied := testutil.ToFloat64(metricSourceNetworkDenied)
+
+	c, err = net.Dial("tcp", p.syslogListeners[0].tcp.Addr().String())
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.NoError(t, c.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, err = c.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+
+	u, err := net.Dial("udp", p.syslogListeners[0].udp.LocalAddr().String())
+	require.NoError(t, err)
+	defer u.Close()
+
+	_, err = u.Write([]byte("<13>1 - foobaz - - - - udp message"))
+	require.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(metricSourceNetworkDenied) == denied+2
+	}, 5*time.Second, 10*time.Millisecond)
+}
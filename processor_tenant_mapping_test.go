@@ -0,0 +1,316 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	fh "github.com/valyala/fasthttp"
+	fhu "github.com/valyala/fasthttp/fasthttputil"
+)
+
+const testMappingYAML = `
+team-a: tenant-a
+"eu-*": tenant-eu
+"us-??": tenant-us
+"*": tenant-other
+`
+
+func Test_parseTenantMappingTable(t *testing.T) {
+	tbl, err := parseTenantMappingTable([]byte(testMappingYAML), false)
+	require.NoError(t, err)
+
+	for key, exp := range map[string]string{
+		"team-a":  "tenant-a",
+		"eu-west": "tenant-eu",
+		"us-01":   "tenant-us",
+		"us-001":  "tenant-other",
+		"foo":     "tenant-other",
+	} {
+		tenant, ok := tbl.lookup(key)
+		assert.True(t, ok, key)
+		assert.Equal(t, exp, tenant, key)
+	}
+
+	tbl, err = parseTenantMappingTable([]byte("# key,tenant\nteam-a,tenant-a\neu-*, tenant-eu\n"), true)
+	require.NoError(t, err)
+
+	tenant, ok := tbl.lookup("eu-west")
+	assert.True(t, ok)
+	assert.Equal(t, "tenant-eu", tenant)
+
+	_, ok = tbl.lookup("foo")
+	assert.False(t, ok)
+
+	_, err = parseTenantMappingTable([]byte("a,b,c\n"), true)
+	assert.Error(t, err)
+
+	_, err = parseTenantMappingTable([]byte("foo: \"\"\n"), false)
+	assert.Error(t, err)
+}
+
+func Test_tenantMapper_unmapped(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "mapping.csv")
+	require.NoError(t, os.WriteFile(file, []byte("team-a,tenant-a\n"), 0o644))
+
+	cfg, err := getConfig(testConfig)
+	require.NoError(t, err)
+	cfg.Tenant.MappingFile = file
+
+	for policy, exp := range map[string]string{
+		mappingUnmappedPassthrough: "team-b",
+		mappingUnmappedDefault:     "default",
+		mappingUnmappedReject:      "",
+	} {
+		cfg.Tenant.MappingUnmapped = policy
+
+		p, err := newProcessor(*cfg)
+		require.NoError(t, err)
+
+		ts := &prompb.TimeSeries{Labels: []prompb.Label{{Name: "__tenant__", Value: "team-a"}}}
+		tenant, err := p.processTimeseries(ts)
+		require.NoError(t, err)
+		assert.Equal(t, "tenant-a", tenant)
+
+		ts = &prompb.TimeSeries{Labels: []prompb.Label{{Name: "__tenant__", Value: "team-b"}}}
+		tenant, err = p.processTimeseries(ts)
+		if exp == "" {
+			assert.Error(t, err, policy)
+		} else {
+			require.NoError(t, err, policy)
+			assert.Equal(t, exp, tenant, policy)
+		}
+
+		// The default tenant is never mapped
+		tenant, err = p.processTimeseries(&prompb.TimeSeries{})
+		require.NoError(t, err)
+		assert.Equal(t, "default", tenant)
+	}
+
+	cfg.Tenant.MappingUnmapped = "foo"
+	_, err = newProcessor(*cfg)
+	assert.Error(t, err)
+
+	cfg.Tenant.MappingUnmapped = mappingUnmappedReject
+	cfg.Tenant.MappingFile = filepath.Join(t.TempDir(), "missing.yaml")
+	_, err = newProcessor(*cfg)
+	assert.Error(t, err)
+}
+
+func Test_tenantMapper_reject(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "mapping.yaml")
+	require.NoError(t, os.WriteFile(file, []byte("team-a: tenant-a\n"), 0o644))
+
+	cfg, err := getConfig(testConfig)
+	require.NoError(t, err)
+	cfg.Tenant.MappingFile = file
+	cfg.Tenant.MappingUnmapped = mappingUnmappedReject
+
+	p, err := newProcessor(*cfg)
+	require.NoError(t, err)
+
+	wrq, err := p.marshalPromWrite(&prompb.WriteRequest{Timeseries: []prompb.TimeSeries{
+		{Labels: []prompb.Label{{Name: "__tenant__", Value: "team-b"}}},
+	}})
+	require.NoError(t, err)
+
+	ctx := &fh.RequestCtx{}
+	ctx.Request.SetBody(wrq)
+	p.handleMetrics(ctx)
+	assert.Equal(t, fh.StatusBadRequest, ctx.Response.StatusCode())
+	assert.Contains(t, string(ctx.Response.Body()), "tenant 'team-b' is not mapped")
+
+	ctx = &fh.RequestCtx{}
+	ctx.Request.Header.SetContentType("application/json")
+	ctx.Request.SetBody([]byte(`{"streams":[{"stream":{"__tenant__":"team-b"},"values":[["1700000000000000000","foo"]]}]}`))
+	p.handleLogs(ctx)
+	assert.Equal(t, fh.StatusBadRequest, ctx.Response.StatusCode())
+}
+
+func Test_tenantMapper_reload(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "mapping.yaml")
+	require.NoError(t, os.WriteFile(file, []byte("team-a: tenant-a\n"), 0o644))
+
+	cfg, err := getConfig(testConfig)
+	require.NoError(t, err)
+	cfg.Tenant.MappingFile = file
+
+	m, err := newTenantMapper(*cfg, nil)
+	require.NoError(t, err)
+	require.NoError(t, m.watch())
+	defer m.close()
+
+	tenant, err := m.mapTenant("team-a", "")
+	require.NoError(t, err)
+	assert.Equal(t, "tenant-a", tenant)
+
+	// Replace the file atomically
+	tmp := file + ".tmp"
+	require.NoError(t, os.WriteFile(tmp, []byte("team-a: tenant-b\n"), 0o644))
+	require.NoError(t, os.Rename(tmp, file))
+
+	assert.Eventually(t, func() bool {
+		tenant, _ := m.mapTenant("team-a", "")
+		return tenant == "tenant-b"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Broken file keeps the previous mapping
+	require.NoError(t, os.WriteFile(file, []byte("team-a: [\n"), 0o644))
+	time.Sleep(100 * time.Millisecond)
+
+	tenant, err = m.mapTenant("team-a", "")
+	require.NoError(t, err)
+	assert.Equal(t, "tenant-b", tenant)
+}
+
+func Test_parseTenantMappingJSON(t *testing.T) {
+	tbl, err := parseTenantMappingJSON([]byte(`{"team-a": "tenant-a", "team-*": "tenant-team", "*": "tenant-other"}`))
+	require.NoError(t, err)
+
+	for key, exp := range map[string]string{
+		"team-a": "tenant-a",
+		"team-b": "tenant-team",
+		"foo":    "tenant-other",
+	} {
+		tenant, ok := tbl.lookup(key)
+		assert.True(t, ok, key)
+		assert.Equal(t, exp, tenant, key)
+	}
+
+	for _, doc := range []string{`[]`, `{"foo": 1}`, `{"foo": "bar"`, ``} {
+		_, err = parseTenantMappingJSON([]byte(doc))
+		assert.Error(t, err, doc)
+	}
+}
+
+func Test_tenantMapper_remote(t *testing.T) {
+	cfg, err := getConfig(testConfig)
+	require.NoError(t, err)
+
+	cfg.Tenant.MappingRemote.URL = "http://cmdb/mapping"
+	cfg.Tenant.MappingRemote.Interval = 10 * time.Millisecond
+	cfg.Tenant.MappingRemote.BearerToken = "secret"
+	cfg.Tenant.MappingUnmapped = mappingUnmappedPassthrough
+
+	var (
+		mtx      sync.Mutex
+		body     = `{"team-a": "tenant-a"}`
+		code     = fh.StatusOK
+		requests int
+		notMod   int
+	)
+
+	ln := fhu.NewInmemoryListener()
+	s := &fh.Server{Handler: func(ctx *fh.RequestCtx) {
+		mtx.Lock()
+		defer mtx.Unlock()
+
+		requests++
+
+		if string(ctx.Request.Header.Peek("Authorization")) != "Bearer secret" {
+			ctx.SetStatusCode(fh.StatusUnauthorized)
+			return
+		}
+
+		if code != fh.StatusOK {
+			ctx.SetStatusCode(code)
+			return
+		}
+
+		etag := fmt.Sprintf(`"%x"`, len(body))
+		if string(ctx.Request.Header.Peek("If-None-Match")) == etag {
+			notMod++
+			ctx.SetStatusCode(fh.StatusNotModified)
+			return
+		}
+
+		ctx.Response.Header.Set("ETag", etag)
+		ctx.SetBodyString(body)
+	}}
+	go s.Serve(ln)
+	defer s.Shutdown()
+
+	tlsConfig := &tls.Config{}
+	m, err := newTenantMapper(*cfg, tlsConfig)
+	require.NoError(t, err)
+	assert.Same(t, tlsConfig, m.remote.cli.TLSConfig)
+	m.remote.cli.Dial = func(string) (net.Conn, error) { return ln.Dial() }
+
+	// Nothing is fetched before the start, the values are rejected regardless of the unmapped policy
+	_, err = m.mapTenant("team-a", "default")
+	assert.ErrorIs(t, err, errMappingNotLoaded)
+
+	require.NoError(t, m.start())
+	defer m.close()
+
+	tenant, err := m.mapTenant("team-a", "default")
+	require.NoError(t, err)
+	assert.Equal(t, "tenant-a", tenant)
+
+	// Unchanged mapping is not fetched again
+	assert.Eventually(t, func() bool {
+		mtx.Lock()
+		defer mtx.Unlock()
+		return notMod > 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Failing upstream keeps the last good copy
+	mtx.Lock()
+	code, requests = fh.StatusInternalServerError, 0
+	mtx.Unlock()
+
+	assert.Eventually(t, func() bool {
+		mtx.Lock()
+		defer mtx.Unlock()
+		return requests > 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	tenant, err = m.mapTenant("team-a", "default")
+	require.NoError(t, err)
+	assert.Equal(t, "tenant-a", tenant)
+	assert.Greater(t, testutil.ToFloat64(metricMappingReloadErrors.WithLabelValues(mappingSourceRemote)), 0.0)
+
+	// Recovers with the new content
+	mtx.Lock()
+	code, body = fh.StatusOK, `{"team-a": "tenant-b", "*": "tenant-other"}`
+	mtx.Unlock()
+
+	assert.Eventually(t, func() bool {
+		tenant, _ := m.mapTenant("team-a", "default")
+		return tenant == "tenant-b"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	tenant, err = m.mapTenant("foo", "default")
+	require.NoError(t, err)
+	assert.Equal(t, "tenant-other", tenant)
+	assert.InDelta(t, float64(time.Now().Unix()), testutil.ToFloat64(metricMappingLastSuccess.WithLabelValues(mappingSourceRemote)), 5)
+
+	// The senders retry until the mapping is loaded
+	p, err := newProcessor(*cfg)
+	require.NoError(t, err)
+
+	wrq, err := p.marshalPromWrite(&prompb.WriteRequest{Timeseries: []prompb.TimeSeries{
+		{Labels: []prompb.Label{{Name: "__tenant__", Value: "team-a"}}},
+	}})
+	require.NoError(t, err)
+
+	ctx := &fh.RequestCtx{}
+	ctx.Request.SetBody(wrq)
+	p.handleMetrics(ctx)
+	assert.Equal(t, fh.StatusServiceUnavailable, ctx.Response.StatusCode())
+
+	ctx = &fh.RequestCtx{}
+	ctx.Request.Header.SetContentType("application/json")
+	ctx.Request.SetBody([]byte(`{"streams":[{"stream":{"__tenant__":"team-a"},"values":[["1700000000000000000","foo"]]}]}`))
+	p.handleLogs(ctx)
+	assert.Equal(t, fh.StatusServiceUnavailable, ctx.Response.StatusCode())
+}
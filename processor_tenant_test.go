@@ -0,0 +1,571 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/grafana/loki/v3/pkg/logproto"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/prompb"
+	writev2 "github.com/prometheus/prometheus/prompb/io/prometheus/write/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	fh "github.com/valyala/fasthttp"
+	fhu "github.com/valyala/fasthttp/fasthttputil"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/plog"
+	"go.opentelemetry.io/collector/pdata/plog/plogotlp"
+	"go.opentelemetry.io/collector/pdata/pmetric"
+	"go.opentelemetry.io/collector/pdata/pmetric/pmetricotlp"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+	"go.opentelemetry.io/collector/pdata/ptrace/ptraceotlp"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func Test_tenantTemplate(t *testing.T) {
+	cfg, err := getConfig(testConfig)
+	require.NoError(t, err)
+
+	cfg.Tenant.Template = `{{ .cluster }}-{{ if .namespace }}{{ .namespace }}{{ end }}`
+	cfg.Tenant.Regex = map[string]string{"namespace": "team-(.*)-prod"}
+
+	tt, err := newTenantTemplate(*cfg)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"cluster", "namespace"}, tt.tmplLabels)
+
+	lookup := func(m map[string]string) func(string) string {
+		return func(name string) string { return m[name] }
+	}
+
+	tenant, used, err := tt.execute(lookup(map[string]string{"cluster": "eu", "namespace": "team-foo-prod"}))
+	require.NoError(t, err)
+	assert.Equal(t, "eu-foo", tenant)
+	assert.Equal(t, []string{"cluster", "namespace"}, used)
+
+	// Not matching the regex
+	_, _, err = tt.execute(lookup(map[string]string{"cluster": "eu", "namespace": "team-foo-dev"}))
+	assert.Error(t, err)
+
+	// Missing label
+	_, _, err = tt.execute(lookup(map[string]string{"namespace": "team-foo-prod"}))
+	assert.Error(t, err)
+
+	// Regex only picks from the label list
+	cfg.Tenant.Template = ""
+	cfg.Tenant.LabelList = []string{"namespace", "cluster"}
+	tt, err = newTenantTemplate(*cfg)
+	require.NoError(t, err)
+
+	tenant, used, err = tt.execute(lookup(map[string]string{"cluster": "eu", "namespace": "team-foo-dev"}))
+	require.NoError(t, err)
+	assert.Equal(t, "eu", tenant)
+	assert.Equal(t, []string{"cluster"}, used)
+
+	for _, tmpl := range []string{"{{ .foo ", "static"} {
+		cfg.Tenant.Template = tmpl
+		_, err = newTenantTemplate(*cfg)
+		assert.Error(t, err, tmpl)
+	}
+
+	cfg.Tenant.Template = ""
+	cfg.Tenant.Regex = map[string]string{"foo": "("}
+	_, err = newTenantTemplate(*cfg)
+	assert.Error(t, err)
+}
+
+func Test_processTimeseries_template(t *testing.T) {
+	cfg, err := getConfig(testConfig)
+	require.NoError(t, err)
+
+	cfg.Tenant.Template = `{{ .cluster }}-{{ .namespace }}`
+	cfg.Tenant.Regex = map[string]string{"namespace": "team-(.*)-prod"}
+	cfg.Tenant.LabelRemove = true
+
+	p, err := newProcessor(*cfg)
+	require.NoError(t, err)
+
+	ts := &prompb.TimeSeries{Labels: []prompb.Label{
+		{Name: "__name__", Value: "up"},
+		{Name: "cluster", Value: "eu"},
+		{Name: "job", Value: "node"},
+		{Name: "namespace", Value: "team-foo-prod"},
+	}}
+
+	tenant, err := p.processTimeseries(ts)
+	require.NoError(t, err)
+	assert.Equal(t, "eu-foo", tenant)
+	assert.Equal(t, []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "node"}}, ts.Labels)
+
+	// Falls back to the default
+	ts = &prompb.TimeSeries{Labels: []prompb.Label{{Name: "cluster", Value: "eu"}}}
+	tenant, err = p.processTimeseries(ts)
+	require.NoError(t, err)
+	assert.Equal(t, "default", tenant)
+	assert.Equal(t, []prompb.Label{{Name: "cluster", Value: "eu"}}, ts.Labels)
+
+	symbols := []string{"", "__name__", "up", "cluster", "eu", "namespace", "team-foo-prod"}
+	tsV2 := &writev2.TimeSeries{LabelsRefs: []uint32{1, 2, 3, 4, 5, 6}}
+	tenant, err = p.processTimeseriesV2(tsV2, symbols)
+	require.NoError(t, err)
+	assert.Equal(t, "eu-foo", tenant)
+	assert.Equal(t, []uint32{1, 2}, tsV2.LabelsRefs)
+
+	tenant, err = p.processStream(&logproto.Stream{Labels: `{cluster="us", namespace="team-bar-prod"}`})
+	require.NoError(t, err)
+	assert.Equal(t, "us-bar", tenant)
+
+	cfg.Tenant.Default = ""
+	p, err = newProcessor(*cfg)
+	require.NoError(t, err)
+
+	_, err = p.processTimeseries(&prompb.TimeSeries{Labels: []prompb.Label{{Name: "cluster", Value: "eu"}}})
+	assert.Error(t, err)
+}
+
+func Test_namespaceResolver(t *testing.T) {
+	cfg, err := getConfig(testConfig)
+	require.NoError(t, err)
+
+	p, err := newProcessor(*cfg)
+	require.NoError(t, err)
+
+	cfg.Tenant.Kubernetes.Annotation = "tenant.example.com/id"
+	cfg.Tenant.Kubernetes.Label = "tenant"
+
+	cs := fake.NewSimpleClientset(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+			Name:        "foo",
+			Annotations: map[string]string{"tenant.example.com/id": "tenant-foo"},
+			Labels:      map[string]string{"tenant": "tenant-label"},
+		}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+			Name:   "bar",
+			Labels: map[string]string{"tenant": "tenant-bar"},
+		}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "baz"}},
+	)
+
+	p.namespaceResolver = newNamespaceResolverWithClient(*cfg, cs)
+	defer p.namespaceResolver.close()
+
+	series := func(lbls ...prompb.Label) *prompb.TimeSeries {
+		return &prompb.TimeSeries{Labels: lbls}
+	}
+
+	// Not synced yet, falls back to the default
+	tenant, err := p.processTimeseries(series(prompb.Label{Name: "namespace", Value: "foo"}))
+	require.NoError(t, err)
+	assert.Equal(t, "default", tenant)
+
+	p.namespaceResolver.start()
+	require.True(t, p.namespaceResolver.waitForSync(5*time.Second))
+
+	for ns, exp := range map[string]string{
+		"foo":     "tenant-foo",
+		"bar":     "tenant-bar",
+		"baz":     "default",
+		"missing": "default",
+	} {
+		tenant, err = p.processTimeseries(series(prompb.Label{Name: "namespace", Value: ns}))
+		require.NoError(t, err)
+		assert.Equal(t, exp, tenant, ns)
+	}
+
+	// Tenant label is preferred
+	tenant, err = p.processTimeseries(series(prompb.Label{Name: "__tenant__", Value: "qux"}, prompb.Label{Name: "namespace", Value: "foo"}))
+	require.NoError(t, err)
+	assert.Equal(t, "qux", tenant)
+
+	tenant, err = p.processStream(&logproto.Stream{Labels: `{namespace="bar"}`})
+	require.NoError(t, err)
+	assert.Equal(t, "tenant-bar", tenant)
+
+	tenant, err = p.processTimeseriesV2(&writev2.TimeSeries{LabelsRefs: []uint32{1, 2}}, []string{"", "namespace", "foo"})
+	require.NoError(t, err)
+	assert.Equal(t, "tenant-foo", tenant)
+
+	resource := pcommon.NewMap()
+	resource.PutStr("k8s.namespace.name", "bar")
+	tenant, key, _, err := p.processOTLPAttributes(resource, pcommon.NewMap(), sourceTenant{})
+	require.NoError(t, err)
+	assert.Equal(t, "tenant-bar", tenant)
+	assert.Empty(t, key)
+}
+
+func Test_resolveTenant(t *testing.T) {
+	cfg, err := getConfig(testConfig)
+	require.NoError(t, err)
+
+	// The last label from the config is preferred regardless of the order of the labels
+	cfg.Tenant.LabelList = []string{"team", "__tenant__"}
+	cfg.Tenant.AttributeList = cfg.Tenant.LabelList
+	cfg.Tenant.LabelRemove = true
+
+	p, err := newProcessor(*cfg)
+	require.NoError(t, err)
+
+	ts := &prompb.TimeSeries{Labels: []prompb.Label{{Name: "__tenant__", Value: "foo"}, {Name: "job", Value: "a"}, {Name: "team", Value: "bar"}}}
+	tenant, err := p.processTimeseries(ts)
+	require.NoError(t, err)
+	assert.Equal(t, "bar", tenant)
+	assert.Equal(t, []prompb.Label{{Name: "__tenant__", Value: "foo"}, {Name: "job", Value: "a"}}, ts.Labels)
+
+	tsV2 := &writev2.TimeSeries{LabelsRefs: []uint32{1, 2, 3, 4}}
+	tenant, err = p.processTimeseriesV2(tsV2, []string{"", "__tenant__", "foo", "team", "bar"})
+	require.NoError(t, err)
+	assert.Equal(t, "bar", tenant)
+	assert.Equal(t, []uint32{1, 2}, tsV2.LabelsRefs)
+
+	tenant, err = p.processStream(&logproto.Stream{Labels: `{__tenant__="foo", team="bar"}`})
+	require.NoError(t, err)
+	assert.Equal(t, "bar", tenant)
+
+	a := alert{"labels": json.RawMessage(`{"__tenant__": "foo", "team": "bar"}`)}
+	tenant, err = p.processAlert(a)
+	require.NoError(t, err)
+	assert.Equal(t, "bar", tenant)
+	assert.JSONEq(t, `{"__tenant__": "foo"}`, string(a["labels"]))
+
+	resource := pcommon.NewMap()
+	resource.PutStr("__tenant__", "foo")
+	resource.PutStr("team", "bar")
+
+	tenant, key, inScope, err := p.processOTLPAttributes(resource, pcommon.NewMap(), sourceTenant{})
+	require.NoError(t, err)
+	assert.Equal(t, "bar", tenant)
+	assert.Equal(t, "team", key)
+	assert.False(t, inScope)
+
+	// Falls back to the default tenant of the source
+	tenant, err = p.processStreamDefault(&logproto.Stream{Labels: `{job="a"}`}, sourceTenant{network: "net"})
+	require.NoError(t, err)
+	assert.Equal(t, "net", tenant)
+}
+
+func Test_urlTenant(t *testing.T) {
+	cfg, err := getConfig(testConfig)
+	require.NoError(t, err)
+
+	cfg.pipeOut = fhu.NewInmemoryListener()
+
+	var (
+		mtx     sync.Mutex
+		tenants []string
+	)
+
+	s := &fh.Server{
+		Handler: func(ctx *fh.RequestCtx) {
+			mtx.Lock()
+			tenants = append(tenants, string(ctx.Request.Header.Peek("X-Scope-OrgID")))
+			mtx.Unlock()
+		},
+	}
+	go s.Serve(cfg.pipeOut)
+	defer s.Shutdown()
+
+	wrReq := &prompb.WriteRequest{Timeseries: []prompb.TimeSeries{
+		{Labels: []prompb.Label{{Name: "__tenant__", Value: "foobar"}}},
+		{Labels: []prompb.Label{{Name: "job", Value: "foo"}}},
+	}}
+
+	wrq, err := (&processor{}).marshalPromWrite(wrReq)
+	require.NoError(t, err)
+
+	pushReq, err := json.Marshal(map[string]any{"streams": []any{
+		map[string]any{"stream": map[string]string{"__tenant__": "foobaz"}, "values": [][]string{{"1700000000000000000", "foo"}}},
+		map[string]any{"stream": map[string]string{"job": "foo"}, "values": [][]string{{"1700000000000000000", "bar"}}},
+	}})
+	require.NoError(t, err)
+
+	handle := func(p *processor, uri string) ([]string, int) {
+		mtx.Lock()
+		tenants = nil
+		mtx.Unlock()
+
+		ctx := &fh.RequestCtx{}
+		ctx.Request.Header.SetMethod("POST")
+		ctx.Request.SetRequestURI(uri)
+
+		if strings.Contains(uri, "loki") {
+			ctx.Request.Header.SetContentType("application/json")
+			ctx.Request.SetBody(pushReq)
+		} else {
+			ctx.Request.SetBody(wrq)
+		}
+
+		p.handle(ctx)
+
+		mtx.Lock()
+		defer mtx.Unlock()
+		return slices.Sorted(slices.Values(tenants)), ctx.Response.StatusCode()
+	}
+
+	p, err := newProcessor(*cfg)
+	require.NoError(t, err)
+
+	for uri, exp := range map[string][]string{
+		"/push":                 {"default", "foobar"},
+		"/push/url":             {"foobar", "url"},
+		"/push?tenant=query":    {"foobar", "query"},
+		"/loki/push/url":        {"foobaz", "url"},
+		"/loki/push?tenant=url": {"foobaz", "url"},
+	} {
+		tenants, code := handle(p, uri)
+		assert.Equal(t, 200, code, uri)
+		assert.Equal(t, exp, tenants, uri)
+	}
+
+	for _, uri := range []string{"/push/", "/push/foo/bar", "/loki/push/"} {
+		_, code := handle(p, uri)
+		assert.Equal(t, 404, code, uri)
+	}
+
+	cfg.Tenant.URLMode = urlModeOverride
+	p, err = newProcessor(*cfg)
+	require.NoError(t, err)
+
+	for uri, exp := range map[string][]string{
+		"/push":              {"default", "foobar"},
+		"/push/url":          {"url"},
+		"/push?tenant=query": {"query"},
+		"/loki/push/url":     {"url"},
+	} {
+		tenants, code := handle(p, uri)
+		assert.Equal(t, 200, code, uri)
+		assert.Equal(t, exp, tenants, uri)
+	}
+
+	file := filepath.Join(t.TempDir(), "config.yml")
+	require.NoError(t, os.WriteFile(file, []byte(testConfig+"  url_mode: foo\n"), 0o644))
+
+	_, err = configLoad(file)
+	assert.Error(t, err)
+}
+
+func Test_sourceNetworks(t *testing.T) {
+	cfg, err := getConfig(testConfig + `
+source_networks:
+  trusted_proxies: [192.168.0.0/24]
+  default_action: deny
+  networks:
+    - cidrs: [10.1.0.0/16, "fd00:1::/32"]
+      tenant: site-a
+    - cidrs: [10.2.0.0/16]
+    - cidrs: [10.0.0.0/8]
+      action: deny
+`)
+	require.NoError(t, err)
+
+	cfg.pipeOut = fhu.NewInmemoryListener()
+
+	var (
+		mtx     sync.Mutex
+		tenants []string
+	)
+
+	s := &fh.Server{
+		Handler: func(ctx *fh.RequestCtx) {
+			mtx.Lock()
+			tenants = append(tenants, string(ctx.Request.Header.Peek("X-Scope-OrgID")))
+			mtx.Unlock()
+		},
+	}
+	go s.Serve(cfg.pipeOut)
+	defer s.Shutdown()
+
+	p, err := newProcessor(*cfg)
+	require.NoError(t, err)
+
+	wrq, err := p.marshalPromWrite(&prompb.WriteRequest{Timeseries: []prompb.TimeSeries{
+		{Labels: []prompb.Label{{Name: "__tenant__", Value: "foobar"}}},
+		{Labels: []prompb.Label{{Name: "job", Value: "foo"}}},
+	}})
+	require.NoError(t, err)
+
+	handle := func(uri, ip string, forwardedFor ...string) ([]string, int) {
+		mtx.Lock()
+		tenants = nil
+		mtx.Unlock()
+
+		req := &fh.Request{}
+		req.Header.SetMethod("POST")
+		req.SetRequestURI(uri)
+		req.SetBody(wrq)
+
+		for _, v := range forwardedFor {
+			req.Header.Add("X-Forwarded-For", v)
+		}
+
+		ctx := &fh.RequestCtx{}
+		ctx.Init(req, &net.TCPAddr{IP: net.ParseIP(ip)}, nil)
+		p.handle(ctx)
+
+		mtx.Lock()
+		defer mtx.Unlock()
+		return slices.Sorted(slices.Values(tenants)), ctx.Response.StatusCode()
+	}
+
+	denied := testutil.ToFloat64(metricSourceNetworkDenied)
+
+	for _, tc := range []struct {
+		uri          string
+		ip           string
+		forwardedFor []string
+		code         int
+		tenants      []string
+	}{
+		{uri: "/push", ip: "10.1.2.3", code: 200, tenants: []string{"foobar", "site-a"}},
+		{uri: "/push", ip: "fd00:1::1", code: 200, tenants: []string{"foobar", "site-a"}},
+		{uri: "/push/url", ip: "10.1.2.3", code: 200, tenants: []string{"foobar", "url"}},
+		{uri: "/push", ip: "10.2.0.1", code: 200, tenants: []string{"default", "foobar"}},
+		{uri: "/push", ip: "10.3.0.1", code: 403},
+		{uri: "/push", ip: "172.16.0.1", code: 403},
+		// Not trusted, X-Forwarded-For is ignored
+		{uri: "/push", ip: "10.3.0.1", forwardedFor: []string{"10.1.2.3"}, code: 403},
+		// Trusted, the rightmost untrusted address is the client
+		{uri: "/push", ip: "192.168.0.1", forwardedFor: []string{"10.3.0.1, 10.1.2.3, 192.168.0.2"}, code: 200, tenants: []string{"foobar", "site-a"}},
+		{uri: "/push", ip: "192.168.0.1", forwardedFor: []string{"10.1.2.3", "10.3.0.1"}, code: 403},
+		// Spoofed entries left of the malformed one are not trusted
+		{uri: "/push", ip: "192.168.0.1", forwardedFor: []string{"10.1.2.3, foo, 192.168.0.2"}, code: 403},
+		// Only proxies, the leftmost one is the client
+		{uri: "/push", ip: "192.168.0.1", forwardedFor: []string{"192.168.0.3"}, code: 403},
+		{uri: "/alive", ip: "172.16.0.1", code: 200},
+	} {
+		tenants, code := handle(tc.uri, tc.ip, tc.forwardedFor...)
+		assert.Equal(t, tc.code, code, tc)
+		assert.Equal(t, tc.tenants, tenants, tc)
+	}
+
+	assert.Equal(t, denied+6, testutil.ToFloat64(metricSourceNetworkDenied))
+
+	for _, c := range []string{
+		"source_networks:\n  default_action: foo\n",
+		"source_networks:\n  networks:\n    - cidrs: [foo]\n",
+		"source_networks:\n  networks:\n    - tenant: foo\n",
+		"source_networks:\n  networks:\n    - cidrs: [10.0.0.0/8]\n      action: foo\n",
+		"source_networks:\n  trusted_proxies: [foo]\n",
+	} {
+		file := filepath.Join(t.TempDir(), "config.yml")
+		require.NoError(t, os.WriteFile(file, []byte(testConfig+c), 0o644))
+
+		cfg, err := configLoad(file)
+		if err == nil {
+			_, err = newProcessor(*cfg)
+		}
+
+		assert.Error(t, err, c)
+	}
+}
+
+func Test_sourceTenant_endpoints(t *testing.T) {
+	cfg, err := getConfig(testConfig + `
+source_networks:
+  networks:
+    - cidrs: [10.1.0.0/16]
+      tenant: site-a
+`)
+	require.NoError(t, err)
+
+	file := filepath.Join(t.TempDir(), "tokens.yml")
+	require.NoError(t, os.WriteFile(file, []byte(testBearerTokens), 0o644))
+
+	cfg.Auth.Ingress.Bearer.TokensFile = file
+	cfg.TargetOTLP = "http://127.0.0.1/otlp/v1/metrics"
+	cfg.TargetLokiOTLP = "http://127.0.0.1/otlp/v1/logs"
+	cfg.TargetTempo = "http://127.0.0.1/otlp/v1/traces"
+	cfg.TargetAlertmanager = "http://127.0.0.1/api/v2/alerts"
+	cfg.TargetPyroscope = "http://127.0.0.1"
+	cfg.pipeOut = fhu.NewInmemoryListener()
+
+	var (
+		mtx     sync.Mutex
+		tenants []string
+	)
+
+	s := &fh.Server{
+		Handler: func(ctx *fh.RequestCtx) {
+			mtx.Lock()
+			tenants = append(tenants, string(ctx.Request.Header.Peek("X-Scope-OrgID")))
+			mtx.Unlock()
+		},
+	}
+	go s.Serve(cfg.pipeOut)
+	defer s.Shutdown()
+
+	p, err := newProcessor(*cfg)
+	require.NoError(t, err)
+
+	// None of the payloads carry a tenant label or attribute
+	md := pmetric.NewMetrics()
+	md.ResourceMetrics().AppendEmpty().ScopeMetrics().AppendEmpty().Metrics().AppendEmpty().SetName("foo")
+	otlpMetrics, err := pmetricotlp.NewExportRequestFromMetrics(md).MarshalProto()
+	require.NoError(t, err)
+
+	ld := plog.NewLogs()
+	ld.ResourceLogs().AppendEmpty().ScopeLogs().AppendEmpty().LogRecords().AppendEmpty().Body().SetStr("foo")
+	otlpLogs, err := plogotlp.NewExportRequestFromLogs(ld).MarshalProto()
+	require.NoError(t, err)
+
+	td := ptrace.NewTraces()
+	td.ResourceSpans().AppendEmpty().ScopeSpans().AppendEmpty().Spans().AppendEmpty().SetName("foo")
+	otlpTraces, err := ptraceotlp.NewExportRequestFromTraces(td).MarshalProto()
+	require.NoError(t, err)
+
+	profiles := marshalPyroscopePush([]profileSeries{{
+		labels:  []prompb.Label{{Name: "__name__", Value: "process_cpu"}},
+		samples: [][]byte{[]byte("\x0a\x03abc")},
+	}})
+
+	for _, ep := range []struct {
+		uri         string
+		contentType string
+		body        []byte
+	}{
+		{"/otlp/v1/metrics", "application/x-protobuf", otlpMetrics},
+		{"/otlp/v1/logs", "application/x-protobuf", otlpLogs},
+		{"/otlp/v1/traces", "application/x-protobuf", otlpTraces},
+		{"/api/v2/alerts", "application/json", []byte(`[{"labels": {"alertname": "A"}}]`)},
+		{pyroscopePushPath, "application/proto", profiles},
+		{pyroscopeIngestPath + "?name=app.cpu", "text/plain", []byte("foo;bar 1")},
+	} {
+		for _, tc := range []struct {
+			token  string
+			tenant string
+		}{
+			// The default tenant of the source network
+			{"token-any", "site-a"},
+			// The tenant pinned by the token
+			{"token-a", "team-a"},
+		} {
+			mtx.Lock()
+			tenants = nil
+			mtx.Unlock()
+
+			req := &fh.Request{}
+			req.Header.SetMethod("POST")
+			req.SetRequestURI(ep.uri)
+			req.Header.SetContentType(ep.contentType)
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+			req.SetBody(ep.body)
+
+			ctx := &fh.RequestCtx{}
+			ctx.Init(req, &net.TCPAddr{IP: net.ParseIP("10.1.2.3")}, nil)
+			p.handle(ctx)
+
+			assert.Equal(t, 200, ctx.Response.StatusCode(), ep.uri, tc.token)
+
+			mtx.Lock()
+			assert.Equal(t, []string{tc.tenant}, tenants, ep.uri, tc.token)
+			mtx.Unlock()
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/grafana/loki/v3/pkg/logproto"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/relabel"
+	"github.com/prometheus/prometheus/prompb"
+	writev2 "github.com/prometheus/prometheus/prompb/io/prometheus/write/v2"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+var (
+	metricRelabelDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cortex_tenant",
+		Name:      "relabel_dropped",
+		Help:      "The total number of timeseries and streams dropped by relabeling.",
+	}, []string{"type"})
+)
+
+// Per-tenant settings applied after the tenant is resolved
+type tenantConfig struct {
+	ExternalLabels map[string]string `yaml:"external_labels"`
+	RelabelConfigs []*relabel.Config `yaml:"relabel_configs"`
+}
+
+// External labels and relabeling rules applied to the label sets
+type relabelRules struct {
+	externalLabels labels.Labels
+	configs        []*relabel.Config
+}
+
+func newRelabelRules(externalLabels map[string]string, configs []*relabel.Config) (relabelRules, error) {
+	for k := range externalLabels {
+		if !model.LabelName(k).IsValid() {
+			return relabelRules{}, fmt.Errorf("invalid external label name '%s'", k)
+		}
+	}
+
+	return relabelRules{
+		externalLabels: labels.FromMap(externalLabels),
+		configs:        configs,
+	}, nil
+}
+
+func (r relabelRules) empty() bool {
+	return r.externalLabels.IsEmpty() && len(r.configs) == 0
+}
+
+// Adds the external labels (existing labels are not overridden, like in Prometheus)
+// and applies the relabeling. Returns false if the labels should be dropped.
+func (r relabelRules) apply(lbls labels.Labels, typ string) (labels.Labels, bool) {
+	if !r.externalLabels.IsEmpty() {
+		b := labels.NewBuilder(lbls)
+		r.externalLabels.Range(func(l labels.Label) {
+			if !lbls.Has(l.Name) {
+				b.Set(l.Name, l.Value)
+			}
+		})
+
+		lbls = b.Labels()
+	}
+
+	lbls, keep := relabel.Process(lbls, r.configs...)
+	if !keep || lbls.IsEmpty() {
+		metricRelabelDropped.WithLabelValues(typ).Inc()
+		return lbls, false
+	}
+
+	return lbls, true
+}
+
+// Relabels the timeseries in place, the resulting labels are sorted
+func relabelTimeseries(ts *prompb.TimeSeries, r relabelRules) bool {
+	if r.empty() {
+		return true
+	}
+
+	b := labels.NewScratchBuilder(len(ts.Labels))
+	for _, l := range ts.Labels {
+		b.Add(l.Name, l.Value)
+	}
+	b.Sort()
+
+	lbls, keep := r.apply(b.Labels(), "timeseries")
+	if !keep {
+		return false
+	}
+
+	// Don't reuse the original slice, the new label set might be bigger
+	ts.Labels = make([]prompb.Label, 0, lbls.Len())
+	lbls.Range(func(l labels.Label) {
+		ts.Labels = append(ts.Labels, prompb.Label{Name: l.Name, Value: l.Value})
+	})
+
+	return true
+}
+
+// Returns the references of the request symbols, the missing ones are appended.
+// The index is built on the first use, so that the requests which aren't modified don't pay for it.
+type symbolsInterner struct {
+	symbols *[]string
+	refs    map[string]uint32
+}
+
+func newSymbolsInterner(symbols *[]string) *symbolsInterner {
+	return &symbolsInterner{symbols: symbols}
+}
+
+func (s *symbolsInterner) ref(sym string) uint32 {
+	if s.refs == nil {
+		s.refs = make(map[string]uint32, len(*s.symbols))
+		for i, v := range *s.symbols {
+			if _, ok := s.refs[v]; !ok {
+				s.refs[v] = uint32(i)
+			}
+		}
+	}
+
+	ref, ok := s.refs[sym]
+	if !ok {
+		ref = uint32(len(*s.symbols))
+		*s.symbols = append(*s.symbols, sym)
+		s.refs[sym] = ref
+	}
+
+	return ref
+}
+
+// Relabels the timeseries in place. New label names and values are interned into the request symbols,
+// the per-tenant symbol tables are rebuilt anyway.
+func relabelTimeseriesV2(ts *writev2.TimeSeries, st *symbolsInterner, r relabelRules) (bool, error) {
+	if r.empty() {
+		return true, nil
+	}
+
+	if len(ts.LabelsRefs)%2 != 0 {
+		return false, fmt.Errorf("odd number of label references: %d", len(ts.LabelsRefs))
+	}
+
+	symbols := *st.symbols
+	b := labels.NewScratchBuilder(len(ts.LabelsRefs) / 2)
+	for i := 0; i < len(ts.LabelsRefs); i += 2 {
+		nameRef, valueRef := ts.LabelsRefs[i], ts.LabelsRefs[i+1]
+		if int(nameRef) >= len(symbols) || int(valueRef) >= len(symbols) {
+			return false, fmt.Errorf("label reference is out of range (%d symbols)", len(symbols))
+		}
+
+		b.Add(symbols[nameRef], symbols[valueRef])
+	}
+	b.Sort()
+
+	lbls, keep := r.apply(b.Labels(), "timeseries")
+	if !keep {
+		return false, nil
+	}
+
+	ts.LabelsRefs = make([]uint32, 0, lbls.Len()*2)
+	lbls.Range(func(l labels.Label) {
+		ts.LabelsRefs = append(ts.LabelsRefs, st.ref(l.Name), st.ref(l.Value))
+	})
+
+	return true, nil
+}
+
+// Relabels the stream labels in place
+func relabelStream(s *logproto.Stream, r relabelRules) (bool, error) {
+	if r.empty() {
+		return true, nil
+	}
+
+	lbls, err := parser.ParseMetric(s.Labels)
+	if err != nil {
+		return false, fmt.Errorf("unable to parse stream labels: %w", err)
+	}
+
+	lbls, keep := r.apply(lbls, "streams")
+	if !keep {
+		return false, nil
+	}
+
+	s.Labels = lbls.String()
+	return true, nil
+}
+
+// Applies the per-tenant rules to the write request, dropped timeseries are removed.
+// Then injects the tenant label if tenant.inject_label is set.
+func (p *processor) tenantRelabelWrite(tenant string, wr *prompb.WriteRequest) {
+	r, ok := p.tenantRules[tenant]
+	if !ok && p.cfg.Tenant.InjectLabel == "" {
+		return
+	}
+
+	ts := wr.Timeseries[:0]
+	for _, t := range wr.Timeseries {
+		if !relabelTimeseries(&t, r) {
+			continue
+		}
+
+		if p.cfg.Tenant.InjectLabel != "" {
+			injectLabel(&t, p.cfg.Tenant.InjectLabel, tenant)
+		}
+
+		ts = append(ts, t)
+	}
+
+	wr.Timeseries = ts
+}
+
+// Applies the per-tenant rules to the push request, dropped streams are removed.
+// Then injects the tenant label if tenant.inject_label is set.
+func (p *processor) tenantRelabelPush(tenant string, req *logproto.PushRequest) error {
+	r, ok := p.tenantRules[tenant]
+	if !ok && p.cfg.Tenant.InjectLabel == "" {
+		return nil
+	}
+
+	streams := req.Streams[:0]
+	for _, s := range req.Streams {
+		keep, err := relabelStream(&s, r)
+		if err != nil {
+			return err
+		}
+
+		if !keep {
+			continue
+		}
+
+		if p.cfg.Tenant.InjectLabel != "" {
+			if err = injectStreamLabel(&s, p.cfg.Tenant.InjectLabel, tenant); err != nil {
+				return err
+			}
+		}
+
+		streams = append(streams, s)
+	}
+
+	req.Streams = streams
+	return nil
+}
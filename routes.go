@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+var (
+	metricRouteHits = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cortex_tenant",
+		Name:      "route_hits",
+		Help:      "The total number of timeseries and streams matched by the routing rule.",
+	}, []string{"route"})
+)
+
+// Name of the implicit rule which extracts the tenant from the labels
+const routeDefault = "default"
+
+type routeConfig struct {
+	// Used in the metrics, defaults to the index of the rule
+	Name string `yaml:"name"`
+	// PromQL-style selector like {job=~"node.*", env="prod"}
+	Match  string `yaml:"match"`
+	Tenant string `yaml:"tenant"`
+	// Whether to continue matching the next rules, the series is sent to all matched tenants
+	Continue bool `yaml:"continue"`
+}
+
+type route struct {
+	matchers []*labels.Matcher
+	tenant   string
+	cont     bool
+	hits     prometheus.Counter
+}
+
+func newRoutes(c config) ([]*route, error) {
+	routes := make([]*route, 0, len(c.Routes))
+
+	for i, rc := range c.Routes {
+		name := rc.Name
+		if name == "" {
+			name = strconv.Itoa(i)
+		}
+
+		if rc.Tenant == "" {
+			return nil, fmt.Errorf("route %s: tenant is not specified", name)
+		}
+
+		matchers, err := parser.ParseMetricSelector(rc.Match)
+		if err != nil {
+			return nil, errors.Wrapf(err, "route %s: unable to parse matchers", name)
+		}
+
+		routes = append(routes, &route{
+			matchers: matchers,
+			tenant:   rc.Tenant,
+			cont:     rc.Continue,
+			hits:     metricRouteHits.WithLabelValues(name),
+		})
+	}
+
+	return routes, nil
+}
+
+func (r *route) matches(lookup func(name string) string) bool {
+	for _, m := range r.matchers {
+		if !m.Matches(lookup(m.Name)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Appends the tenants of the matching routes to the given slice, each of them once.
+// Nothing is appended if no route matches, then the tenant should be extracted from the labels.
+func (p *processor) routeTenants(tenants []string, lookup func(name string) string) []string {
+	for _, r := range p.routes {
+		if !r.matches(lookup) {
+			continue
+		}
+
+		r.hits.Inc()
+		if !slices.Contains(tenants, r.tenant) {
+			tenants = append(tenants, r.tenant)
+		}
+
+		if !r.cont {
+			return tenants
+		}
+	}
+
+	if len(tenants) == 0 {
+		metricRouteHits.WithLabelValues(routeDefault).Inc()
+	}
+
+	return tenants
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	fh "github.com/valyala/fasthttp"
+)
+
+var (
+	metricSourceNetworkDenied = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "cortex_tenant",
+		Name:      "source_network_denied",
+		Help:      "The total number of requests rejected due to the source network.",
+	})
+)
+
+// Whether the requests from the network are accepted
+const (
+	sourceNetworkActionAllow = "allow"
+	sourceNetworkActionDeny  = "deny"
+)
+
+const (
+	headerForwardedFor     = "X-Forwarded-For"
+	userValueSourceNetwork = "source_network"
+)
+
+type sourceNetworkConfig struct {
+	CIDRs []string `yaml:"cidrs"`
+	// Used instead of tenant.default for the requests from the network
+	Tenant string `yaml:"tenant"`
+	Action string `yaml:"action"`
+}
+
+type sourceNetwork struct {
+	name   string
+	nets   []*net.IPNet
+	tenant string
+	deny   bool
+}
+
+// Assigns the default tenant and allows or denies the requests by the client address
+type sourceNetworks struct {
+	networks []*sourceNetwork
+	// Used if none of the networks matches
+	unmatched *sourceNetwork
+	// The peers which X-Forwarded-For is trusted from
+	trustedProxies []*net.IPNet
+}
+
+func newSourceNetworks(c config) (*sourceNetworks, error) {
+	sc := c.SourceNetworks
+	if len(sc.Networks) == 0 && len(sc.TrustedProxies) == 0 && sc.DefaultAction != sourceNetworkActionDeny {
+		return nil, nil
+	}
+
+	s := &sourceNetworks{
+		unmatched: &sourceNetwork{name: "default", deny: sc.DefaultAction == sourceNetworkActionDeny},
+	}
+
+	var err error
+	if s.trustedProxies, err = parseCIDRs(sc.TrustedProxies); err != nil {
+		return nil, errors.Wrap(err, "source_networks.trusted_proxies")
+	}
+
+	for i, nc := range sc.Networks {
+		n := &sourceNetwork{name: fmt.Sprintf("source network %d", i), tenant: nc.Tenant}
+
+		if len(nc.CIDRs) == 0 {
+			return nil, fmt.Errorf("source network %d: cidrs are not specified", i)
+		}
+
+		if n.nets, err = parseCIDRs(nc.CIDRs); err != nil {
+			return nil, errors.Wrapf(err, "source network %d", i)
+		}
+
+		switch nc.Action {
+		case "", sourceNetworkActionAllow:
+		case sourceNetworkActionDeny:
+			n.deny = true
+		default:
+			return nil, fmt.Errorf("source network %d: unknown action value: %s", i, nc.Action)
+		}
+
+		s.networks = append(s.networks, n)
+	}
+
+	return s, nil
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+
+		nets = append(nets, n)
+	}
+
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns the first network containing the IP
+func (s *sourceNetworks) match(ip net.IP) *sourceNetwork {
+	for _, n := range s.networks {
+		if containsIP(n.nets, ip) {
+			return n
+		}
+	}
+
+	return s.unmatched
+}
+
+// Returns the address of the client. If the peer is a trusted proxy then X-Forwarded-For is walked
+// from the right and the first address which is not a trusted proxy is used.
+func (s *sourceNetworks) clientIP(peer net.IP, forwardedFor [][]byte) net.IP {
+	if !containsIP(s.trustedProxies, peer) {
+		return peer
+	}
+
+	ip := peer
+	for i := len(forwardedFor) - 1; i >= 0; i-- {
+		hops := bytes.Split(forwardedFor[i], []byte(","))
+
+		for j := len(hops) - 1; j >= 0; j-- {
+			hop := net.ParseIP(string(bytes.TrimSpace(hops[j])))
+			if hop == nil {
+				// Can't trust anything to the left of a malformed entry
+				return ip
+			}
+
+			ip = hop
+			if !containsIP(s.trustedProxies, ip) {
+				return ip
+			}
+		}
+	}
+
+	return ip
+}
+
+// Returns the address of the client, taking the trusted X-Forwarded-For into account
+func (p *processor) clientIP(ctx *fh.RequestCtx) net.IP {
+	if p.sourceNetworks == nil {
+		return ctx.RemoteIP()
+	}
+
+	return p.sourceNetworks.clientIP(ctx.RemoteIP(), ctx.Request.Header.PeekAll(headerForwardedFor))
+}
+
+// Matches the client against the source networks and rejects it if it's denied.
+// Returns false if the request was rejected.
+func (p *processor) checkSourceNetwork(ctx *fh.RequestCtx) bool {
+	if p.sourceNetworks == nil {
+		return true
+	}
+
+	ip := p.clientIP(ctx)
+	n := p.sourceNetworks.match(ip)
+
+	if n.deny {
+		metricSourceNetworkDenied.Inc()
+		p.Debugf("src=%s: client %s is denied (%s)", ctx.RemoteAddr(), ip, n.name)
+		ctx.Error("Forbidden", fh.StatusForbidden)
+		return false
+	}
+
+	ctx.SetUserValue(userValueSourceNetwork, n)
+	return true
+}
+
+// Matches the address of a non-HTTP client (like a syslog sender) against the source networks.
+// Returns the default tenant of its network and false if the client is denied.
+func (p *processor) addrSourceNetwork(addr net.Addr) (string, bool) {
+	if p.sourceNetworks == nil {
+		return "", true
+	}
+
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	}
+
+	n := p.sourceNetworks.match(ip)
+	if n.deny {
+		metricSourceNetworkDenied.Inc()
+		p.Debugf("src=%s: client is denied (%s)", addr, n.name)
+		return "", false
+	}
+
+	return n.tenant, true
+}
+
+// Returns the default tenant of the client's source network, if any
+func sourceNetworkTenant(ctx *fh.RequestCtx) string {
+	if n, ok := ctx.UserValue(userValueSourceNetwork).(*sourceNetwork); ok {
+		return n.tenant
+	}
+
+	return ""
+}
@@ -0,0 +1,490 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/grafana/loki/v3/pkg/logproto"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+const (
+	maxSyslogMessageSize = 64 * 1024
+	// Digits in the octet counting length prefix, enough for maxSyslogMessageSize
+	maxSyslogLengthDigits = 6
+	// Batches pushed concurrently, the messages are dropped when the queue fills up behind them
+	maxSyslogFlushes = 4
+)
+
+var (
+	metricSyslogMessagesReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cortex_tenant",
+		Name:      "syslog_messages_received",
+		Help:      "The total number of syslog messages received.",
+	}, []string{"transport"})
+	metricSyslogMessagesDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cortex_tenant",
+		Name:      "syslog_messages_dropped",
+		Help:      "The total number of syslog messages dropped, by reason.",
+	}, []string{"reason"})
+)
+
+type syslogListenerConfig struct {
+	ListenTCP     string `yaml:"listen_tcp"`
+	ListenUDP     string `yaml:"listen_udp"`
+	TLS           bool   `yaml:"tls"`
+	DefaultTenant string `yaml:"default_tenant"`
+}
+
+type syslogEntry struct {
+	tenants []string
+	labels  string
+	entry   logproto.Entry
+}
+
+type syslogListener struct {
+	cfg syslogListenerConfig
+	p   *processor
+
+	tcp net.Listener
+	udp net.PacketConn
+
+	mtx   sync.Mutex
+	conns map[net.Conn]struct{}
+	wg    sync.WaitGroup
+}
+
+// Collects the syslog messages from all listeners and pushes them to Loki
+// when the batch is full or the batch wait time has passed
+type syslogBatcher struct {
+	p       *processor
+	entries chan syslogEntry
+	done    chan struct{}
+
+	flushes chan struct{}
+	wg      sync.WaitGroup
+}
+
+func newSyslogListener(p *processor, cfg syslogListenerConfig) (*syslogListener, error) {
+	if cfg.ListenTCP == "" && cfg.ListenUDP == "" {
+		return nil, fmt.Errorf("syslog listener must have listen_tcp and/or listen_udp defined")
+	}
+
+	if cfg.TLS && p.srv.TLSConfig.GetCertificate == nil {
+		return nil, fmt.Errorf("syslog listener %s: TLS requires auth.ingress.tls_config to be configured", cfg.ListenTCP)
+	}
+
+	return &syslogListener{
+		cfg:   cfg,
+		p:     p,
+		conns: map[net.Conn]struct{}{},
+	}, nil
+}
+
+func (l *syslogListener) run() (err error) {
+	if l.cfg.ListenTCP != "" {
+		if l.tcp, err = net.Listen("tcp", l.cfg.ListenTCP); err != nil {
+			return
+		}
+
+		if l.cfg.TLS {
+			l.tcp = tls.NewListener(l.tcp, l.p.srv.TLSConfig)
+		}
+
+		l.wg.Add(1)
+		go l.serveTCP()
+	}
+
+	if l.cfg.ListenUDP != "" {
+		if l.udp, err = net.ListenPacket("udp", l.cfg.ListenUDP); err != nil {
+			return
+		}
+
+		l.wg.Add(1)
+		go l.serveUDP()
+	}
+
+	return
+}
+
+func (l *syslogListener) close() {
+	if l.tcp != nil {
+		l.tcp.Close()
+	}
+
+	if l.udp != nil {
+		l.udp.Close()
+	}
+
+	l.mtx.Lock()
+	for c := range l.conns {
+		c.Close()
+	}
+	l.mtx.Unlock()
+
+	l.wg.Wait()
+}
+
+func (l *syslogListener) serveTCP() {
+	defer l.wg.Done()
+
+	for {
+		c, err := l.tcp.Accept()
+		if err != nil {
+			return
+		}
+
+		network, ok := l.p.addrSourceNetwork(c.RemoteAddr())
+		if !ok {
+			c.Close()
+			continue
+		}
+
+		l.mtx.Lock()
+		l.conns[c] = struct{}{}
+		l.mtx.Unlock()
+
+		l.wg.Add(1)
+		go l.handleConn(c, network)
+	}
+}
+
+func (l *syslogListener) handleConn(c net.Conn, network string) {
+	defer func() {
+		l.mtx.Lock()
+		delete(l.conns, c)
+		l.mtx.Unlock()
+
+		c.Close()
+		l.wg.Done()
+	}()
+
+	// The handshake is done here and not in Accept, so that the slow clients don't block the others
+	if tc, ok := c.(*tls.Conn); ok {
+		c.SetDeadline(time.Now().Add(l.p.cfg.Timeout))
+		if err := tc.Handshake(); err != nil {
+			l.p.Errorf("syslog: src=%s TLS handshake failed: %s", c.RemoteAddr(), err)
+			return
+		}
+	}
+
+	r := newSyslogReader(c)
+	for {
+		// Idle connections are closed
+		c.SetReadDeadline(time.Now().Add(l.p.cfg.IdleTimeout))
+
+		msg, err := readSyslogFrame(r)
+		if err != nil {
+			switch {
+			case err == io.EOF, errors.Is(err, net.ErrClosed):
+			case errors.Is(err, os.ErrDeadlineExceeded):
+				l.p.Debugf("syslog: src=%s closing idle connection", c.RemoteAddr())
+			default:
+				l.p.Errorf("syslog: src=%s %s", c.RemoteAddr(), err)
+			}
+
+			return
+		}
+
+		l.handleMessage(msg, "tcp", network)
+	}
+}
+
+func (l *syslogListener) serveUDP() {
+	defer l.wg.Done()
+
+	buf := make([]byte, maxSyslogMessageSize)
+	for {
+		n, addr, err := l.udp.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		network, ok := l.p.addrSourceNetwork(addr)
+		if !ok {
+			metricSyslogMessagesDropped.WithLabelValues("source_network").Inc()
+			continue
+		}
+
+		l.handleMessage(buf[:n], "udp", network)
+	}
+}
+
+// The default tenant of the listener takes precedence over the one of the source network
+func (l *syslogListener) handleMessage(b []byte, transport, network string) {
+	metricSyslogMessagesReceived.WithLabelValues(transport).Inc()
+
+	now := time.Now()
+	msg, err := parseSyslog(b, now)
+	if err != nil {
+		metricSyslogMessagesDropped.WithLabelValues("parse").Inc()
+		l.p.Debugf("syslog: unable to parse message: %s", err)
+		return
+	}
+
+	e, keep, err := l.p.syslogEntry(msg, now, sourceTenant{tenant: l.cfg.DefaultTenant, network: network})
+	if err != nil {
+		metricSyslogMessagesDropped.WithLabelValues("tenant").Inc()
+		l.p.Debugf("syslog: %s", err)
+		return
+	}
+
+	if !keep {
+		metricSyslogMessagesDropped.WithLabelValues("relabel").Inc()
+		return
+	}
+
+	// The listeners are never blocked by a slow upstream
+	select {
+	case l.p.syslog.entries <- e:
+	default:
+		metricSyslogMessagesDropped.WithLabelValues("queue_full").Inc()
+	}
+}
+
+// The buffer must fit the whole message since the newline-terminated frames are read in place
+func newSyslogReader(r io.Reader) *bufio.Reader {
+	return bufio.NewReaderSize(r, maxSyslogMessageSize)
+}
+
+// Reads a single message from the TCP stream using either octet counting
+// (RFC6587 3.4.1) or newline-terminated (RFC6587 3.4.2) framing
+func readSyslogFrame(r *bufio.Reader) ([]byte, error) {
+	for {
+		first, err := r.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+
+		if first[0] < '0' || first[0] > '9' {
+			line, err := r.ReadSlice('\n')
+			if err == bufio.ErrBufferFull {
+				return nil, fmt.Errorf("message exceeds %d bytes", r.Size())
+			}
+
+			if err != nil && (err != io.EOF || len(line) == 0) {
+				return nil, err
+			}
+
+			if line = bytes.TrimRight(line, "\r\n"); len(line) == 0 {
+				continue
+			}
+
+			return bytes.Clone(line), nil
+		}
+
+		n, err := readSyslogLength(r)
+		if err != nil {
+			return nil, err
+		}
+
+		buf := make([]byte, n)
+		if _, err = io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+
+		return buf, nil
+	}
+}
+
+// Reads the octet counting length prefix along with the trailing space
+func readSyslogLength(r *bufio.Reader) (int, error) {
+	n := 0
+	for i := 0; ; i++ {
+		c, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+
+		if c == ' ' && i > 0 {
+			break
+		}
+
+		if c < '0' || c > '9' || i == maxSyslogLengthDigits {
+			return 0, fmt.Errorf("invalid message length prefix")
+		}
+
+		n = n*10 + int(c-'0')
+	}
+
+	if n <= 0 || n > maxSyslogMessageSize {
+		return 0, fmt.Errorf("invalid message length %d", n)
+	}
+
+	return n, nil
+}
+
+// Converts the message into a Loki entry and resolves its tenants.
+// Like for Loki push requests the relabeling rules and the routes are applied, returns false if the entry is dropped.
+func (p *processor) syslogEntry(msg syslogMessage, now time.Time, src sourceTenant) (e syslogEntry, keep bool, err error) {
+	b := labels.NewScratchBuilder(4)
+	for _, l := range []labels.Label{
+		{Name: "app", Value: msg.appName},
+		{Name: "facility", Value: msg.facilityName()},
+		{Name: "host", Value: msg.hostname},
+		{Name: "severity", Value: msg.severityName()},
+	} {
+		if l.Value != "" {
+			b.Add(l.Name, l.Value)
+		}
+	}
+
+	s := &logproto.Stream{Labels: b.Labels().String()}
+	if keep, err = relabelStream(s, p.relabel); err != nil || !keep {
+		return
+	}
+
+	e.labels = s.Labels
+	e.entry = logproto.Entry{Timestamp: msg.timestamp, Line: msg.message}
+	if e.entry.Timestamp.IsZero() {
+		e.entry.Timestamp = now
+	}
+
+	e.tenants, err = p.streamTenants(nil, s, src)
+	return
+}
+
+func newSyslogBatcher(p *processor) *syslogBatcher {
+	return &syslogBatcher{
+		p:       p,
+		entries: make(chan syslogEntry, p.cfg.Syslog.BatchSize),
+		done:    make(chan struct{}),
+		flushes: make(chan struct{}, maxSyslogFlushes),
+	}
+}
+
+func (b *syslogBatcher) run() {
+	defer close(b.done)
+
+	t := time.NewTicker(b.p.cfg.Syslog.BatchWait)
+	defer t.Stop()
+
+	var batch []syslogEntry
+	for {
+		select {
+		case e, ok := <-b.entries:
+			if !ok {
+				b.flushAsync(batch)
+				b.wg.Wait()
+				return
+			}
+
+			if batch = append(batch, e); len(batch) >= b.p.cfg.Syslog.BatchSize {
+				b.flushAsync(batch)
+				batch = nil
+			}
+
+		case <-t.C:
+			b.flushAsync(batch)
+			batch = nil
+		}
+	}
+}
+
+// Pushes the batch in the background, waits only if the max number of batches is being pushed already
+func (b *syslogBatcher) flushAsync(batch []syslogEntry) {
+	if len(batch) == 0 {
+		return
+	}
+
+	b.flushes <- struct{}{}
+	b.wg.Add(1)
+
+	go func() {
+		defer func() {
+			<-b.flushes
+			b.wg.Done()
+		}()
+
+		b.flush(batch)
+	}()
+}
+
+// Stops accepting new entries and waits until the remaining ones are pushed
+func (b *syslogBatcher) close() {
+	close(b.entries)
+	<-b.done
+}
+
+func (b *syslogBatcher) flush(batch []syslogEntry) {
+	if len(batch) == 0 {
+		return
+	}
+
+	// Group entries into per-tenant streams
+	m := map[string]*logproto.PushRequest{}
+	streams := map[string]map[string]int{}
+
+	for _, e := range batch {
+		for _, tenant := range e.tenants {
+			req, ok := m[tenant]
+			if !ok {
+				req = &logproto.PushRequest{}
+				m[tenant] = req
+				streams[tenant] = map[string]int{}
+			}
+
+			idx, ok := streams[tenant][e.labels]
+			if !ok {
+				idx = len(req.Streams)
+				streams[tenant][e.labels] = idx
+				req.Streams = append(req.Streams, logproto.Stream{Labels: e.labels})
+			}
+
+			req.Streams[idx].Entries = append(req.Streams[idx].Entries, e.entry)
+		}
+	}
+
+	resM := make(map[string]func() ([]byte, error), len(m))
+	for tenant, req := range m {
+		if b.p.cfg.MetricsIncludeTenant {
+			metricStreamsReceived.WithLabelValues(tenant).Add(float64(len(req.Streams)))
+		} else {
+			metricStreamsReceived.WithLabelValues("").Add(float64(len(req.Streams)))
+		}
+
+		if err := b.p.tenantRelabelPush(tenant, req); err != nil {
+			b.p.Errorf("Unable to relabel syslog streams for tenant %s: %s", tenant, err)
+			continue
+		}
+
+		if len(req.Streams) == 0 {
+			continue
+		}
+
+		resM[tenant] = func() ([]byte, error) {
+			return b.p.marshalLokiPush(req)
+		}
+	}
+
+	reqID, _ := uuid.NewRandom()
+	results := b.p.dispatch(b.p.cfg.TargetLoki, formatLokiPush, syslogClientAddr, reqID, b.p.cfg.Tenant.Prefix, resM)
+
+	b.p.recordResults(syslogClientAddr, reqID, "", results, streamsRequestMetrics)
+
+	for _, r := range results {
+		if r.err != nil || r.code < 200 || r.code >= 300 {
+			entries := 0
+			for _, s := range m[strings.TrimPrefix(r.tenant, b.p.cfg.Tenant.Prefix)].Streams {
+				entries += len(s.Entries)
+			}
+
+			metricSyslogMessagesDropped.WithLabelValues("send").Add(float64(entries))
+		}
+	}
+}
+
+// Syslog batches are not tied to a single client
+var syslogClientAddr = &net.TCPAddr{IP: net.IPv4zero}
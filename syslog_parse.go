@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var syslogFacilities = []string{
+	"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news",
+	"uucp", "cron", "authpriv", "ftp", "ntp", "security", "console", "solaris-cron",
+	"local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7",
+}
+
+var syslogSeverities = []string{
+	"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug",
+}
+
+type syslogMessage struct {
+	facility  int
+	severity  int
+	timestamp time.Time // Zero if not specified
+	hostname  string
+	appName   string
+	procID    string
+	msgID     string
+	message   string
+}
+
+func (m syslogMessage) facilityName() string {
+	return syslogFacilities[m.facility]
+}
+
+func (m syslogMessage) severityName() string {
+	return syslogSeverities[m.severity]
+}
+
+// Parses a syslog message in either RFC5424 or RFC3164 format.
+// The current time is used to fill in the year missing in RFC3164 timestamps.
+func parseSyslog(b []byte, now time.Time) (m syslogMessage, err error) {
+	b = bytes.TrimRight(b, "\r\n\x00")
+
+	if len(b) < 3 || b[0] != '<' {
+		return m, fmt.Errorf("missing priority")
+	}
+
+	end := bytes.IndexByte(b[:min(len(b), 5)], '>')
+	if end == -1 {
+		return m, fmt.Errorf("invalid priority")
+	}
+
+	pri, err := strconv.Atoi(string(b[1:end]))
+	if err != nil || pri < 0 || pri > 191 {
+		return m, fmt.Errorf("invalid priority %q", b[1:end])
+	}
+
+	m.facility, m.severity = pri/8, pri%8
+	b = b[end+1:]
+
+	if len(b) >= 2 && b[0] == '1' && b[1] == ' ' {
+		err = parseRFC5424(&m, string(b[2:]))
+	} else {
+		parseRFC3164(&m, string(b), now)
+	}
+
+	return
+}
+
+// Parses the part following the version:
+// TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA [MSG]
+func parseRFC5424(m *syslogMessage, s string) error {
+	fields := make([]string, 5)
+	for i := range fields {
+		var ok bool
+		if fields[i], s, ok = strings.Cut(s, " "); !ok && i < len(fields)-1 {
+			return fmt.Errorf("unexpected end of header")
+		}
+
+		if fields[i] == "-" {
+			fields[i] = ""
+		}
+	}
+
+	if fields[0] != "" {
+		ts, err := time.Parse(time.RFC3339Nano, fields[0])
+		if err != nil {
+			return fmt.Errorf("invalid timestamp %q", fields[0])
+		}
+
+		m.timestamp = ts
+	}
+
+	m.hostname, m.appName, m.procID, m.msgID = fields[1], fields[2], fields[3], fields[4]
+
+	// Skip the structured data
+	switch {
+	case s == "":
+	case s[0] == '-':
+		s = s[1:]
+	case s[0] == '[':
+		i, inQuote := 0, false
+
+	loop:
+		for ; i < len(s); i++ {
+			switch c := s[i]; {
+			case c == '\\' && inQuote:
+				i++
+			case c == '"':
+				inQuote = !inQuote
+			case c == ']' && !inQuote:
+				if i+1 == len(s) || s[i+1] != '[' {
+					break loop
+				}
+			}
+		}
+
+		if i >= len(s) {
+			return fmt.Errorf("unterminated structured data")
+		}
+
+		s = s[i+1:]
+	default:
+		return fmt.Errorf("invalid structured data")
+	}
+
+	s = strings.TrimPrefix(s, " ")
+	m.message = strings.TrimPrefix(s, "\ufeff")
+	return nil
+}
+
+// Parses the BSD syslog format which is loosely defined, so anything
+// that doesn't match the expected layout ends up in the message:
+// Mmm dd hh:mm:ss HOSTNAME TAG[PID]: MSG
+func parseRFC3164(m *syslogMessage, s string, now time.Time) {
+	const layout = time.Stamp
+
+	if len(s) >= len(layout) {
+		if ts, err := time.ParseInLocation(layout, s[:len(layout)], now.Location()); err == nil {
+			ts = ts.AddDate(now.Year(), 0, 0)
+
+			// Messages from the end of the previous year
+			if ts.After(now.Add(24 * time.Hour)) {
+				ts = ts.AddDate(-1, 0, 0)
+			}
+
+			m.timestamp = ts
+			s = strings.TrimPrefix(s[len(layout):], " ")
+
+			if host, rest, ok := strings.Cut(s, " "); ok {
+				m.hostname, s = host, rest
+			}
+		}
+	}
+
+	// The tag is limited to 32 alphanumeric characters
+	if i := strings.IndexAny(s, "[: "); i > 0 && i <= 32 {
+		tag, rest := s[:i], s[i:]
+
+		if rest[0] == '[' {
+			if j := strings.IndexByte(rest, ']'); j != -1 {
+				m.procID, rest = rest[1:j], rest[j+1:]
+			}
+		}
+
+		if strings.HasPrefix(rest, ":") {
+			m.appName = tag
+			s = strings.TrimPrefix(rest[1:], " ")
+		} else {
+			m.procID = ""
+		}
+	}
+
+	m.message = s
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"text/template"
+	"text/template/parse"
+
+	"github.com/pkg/errors"
+	fh "github.com/valyala/fasthttp"
+)
+
+// How the tenant supplied in the URL is used
+const (
+	// Used for all the timeseries and streams in the request
+	urlModeOverride = "override"
+	// Used only if the tenant can't be derived from the labels, instead of tenant.default
+	urlModeDefault = "default"
+
+	urlTenantParam  = "tenant"
+	userValueTenant = "tenant"
+)
+
+// Composes the tenant from one or more labels using tenant.template and/or tenant.regex,
+// without them the first label from the list which is found is used
+type tenantTemplate struct {
+	tmpl       *template.Template
+	tmplLabels []string // Labels referenced in the template
+	regex      map[string]*regexp.Regexp
+	labelList  []string
+	kind       string // What the labels are called in the errors
+	// Label which contains the Kubernetes namespace
+	namespaceLabel string
+}
+
+func newTenantTemplate(c config) (*tenantTemplate, error) {
+	t := &tenantTemplate{
+		regex:          map[string]*regexp.Regexp{},
+		labelList:      c.Tenant.LabelList,
+		kind:           "label",
+		namespaceLabel: c.Tenant.Kubernetes.NamespaceLabel,
+	}
+
+	for label, expr := range c.Tenant.Regex {
+		// Anchored the same way as in Prometheus
+		re, err := regexp.Compile("^(?:" + expr + ")$")
+		if err != nil {
+			return nil, errors.Wrapf(err, "Unable to compile tenant regex for label %s", label)
+		}
+
+		t.regex[label] = re
+	}
+
+	if c.Tenant.Template != "" {
+		tmpl, err := template.New("tenant").Option("missingkey=error").Parse(c.Tenant.Template)
+		if err != nil {
+			return nil, errors.Wrap(err, "Unable to parse tenant template")
+		}
+
+		t.tmpl = tmpl
+		t.tmplLabels = templateFields(tmpl.Tree.Root)
+
+		if len(t.tmplLabels) == 0 {
+			return nil, fmt.Errorf("tenant template must reference at least one label")
+		}
+	}
+
+	return t, nil
+}
+
+// Returns the tenant and the labels it was composed of.
+// Fails if any of the referenced labels is missing or doesn't match its regex.
+func (t *tenantTemplate) execute(lookup func(name string) string) (tenant string, used []string, err error) {
+	if t.tmpl == nil {
+		// Take the first label from the list which matches
+		for _, label := range t.labelList {
+			if v, ok := t.labelValue(label, lookup); ok {
+				return v, []string{label}, nil
+			}
+		}
+
+		if len(t.regex) == 0 {
+			return "", nil, fmt.Errorf("%s(s): {'%s'} not found", t.kind, strings.Join(t.labelList, "','"))
+		}
+
+		return "", nil, fmt.Errorf("%s(s): {'%s'} not found or not matching the regex", t.kind, strings.Join(t.labelList, "','"))
+	}
+
+	data := make(map[string]string, len(t.tmplLabels))
+	for _, label := range t.tmplLabels {
+		v, ok := t.labelValue(label, lookup)
+		if !ok {
+			return "", nil, fmt.Errorf("label '%s' referenced in the tenant template is not found or not matching the regex", label)
+		}
+
+		data[label] = v
+	}
+
+	var sb strings.Builder
+	if err = t.tmpl.Execute(&sb, data); err != nil {
+		return "", nil, errors.Wrap(err, "Unable to execute tenant template")
+	}
+
+	if sb.Len() == 0 {
+		return "", nil, fmt.Errorf("tenant template yielded an empty tenant")
+	}
+
+	return sb.String(), t.tmplLabels, nil
+}
+
+// Returns the label value or its first capture group if there's a regex for it
+func (t *tenantTemplate) labelValue(label string, lookup func(name string) string) (string, bool) {
+	v := lookup(label)
+	if v == "" {
+		return "", false
+	}
+
+	re, ok := t.regex[label]
+	if !ok {
+		return v, true
+	}
+
+	m := re.FindStringSubmatch(v)
+	switch {
+	case m == nil:
+		return "", false
+	case len(m) > 1:
+		return m[1], m[1] != ""
+	default:
+		return v, true
+	}
+}
+
+// Collects the names of the fields (like {{ .label }}) referenced in the template
+func templateFields(node parse.Node) (fields []string) {
+	var walk func(n parse.Node)
+	walk = func(n parse.Node) {
+		switch n := n.(type) {
+		case *parse.ListNode:
+			if n == nil {
+				return
+			}
+
+			for _, c := range n.Nodes {
+				walk(c)
+			}
+		case *parse.ActionNode:
+			walk(n.Pipe)
+		case *parse.PipeNode:
+			if n == nil {
+				return
+			}
+
+			for _, c := range n.Cmds {
+				walk(c)
+			}
+		case *parse.CommandNode:
+			for _, a := range n.Args {
+				walk(a)
+			}
+		case *parse.FieldNode:
+			if !slices.Contains(fields, n.Ident[0]) {
+				fields = append(fields, n.Ident[0])
+			}
+		case *parse.IfNode:
+			walk(n.Pipe)
+			walk(n.List)
+			walk(n.ElseList)
+		case *parse.RangeNode:
+			walk(n.Pipe)
+			walk(n.List)
+			walk(n.ElseList)
+		case *parse.WithNode:
+			walk(n.Pipe)
+			walk(n.List)
+			walk(n.ElseList)
+		}
+	}
+
+	walk(node)
+	return
+}
+
+// Resolves the tenant from the labels: using the template or the label list, then by the Kubernetes namespace
+// and falls back to the default tenant of the source. Returns the labels the tenant was composed of, if any.
+func (p *processor) resolveTenant(lookup func(name string) string, src sourceTenant) (tenant string, used []string, err error) {
+	return p.resolveTenantBy(p.tenantTemplate, lookup, src)
+}
+
+func (p *processor) resolveTenantBy(t *tenantTemplate, lookup func(name string) string, src sourceTenant) (tenant string, used []string, err error) {
+	defaultTenant := p.sourceDefaultTenant(src)
+
+	tenant, used, err = t.execute(lookup)
+	if err == nil {
+		if tenant, err = p.mapTenant(tenant, defaultTenant); err != nil {
+			return "", nil, err
+		}
+
+		return
+	}
+
+	if tenant = p.namespaceTenant(lookup, t.namespaceLabel); tenant != "" {
+		return tenant, nil, nil
+	}
+
+	if defaultTenant == "" {
+		return "", nil, err
+	}
+
+	return defaultTenant, nil, nil
+}
+
+// Returns the tenant supplied in the URL path (like /push/{tenant}) or in the query parameter
+func (p *processor) urlTenant(ctx *fh.RequestCtx) string {
+	if tenant, ok := ctx.UserValue(userValueTenant).(string); ok {
+		return tenant
+	}
+
+	return string(ctx.QueryArgs().Peek(urlTenantParam))
+}
+
+// Tenant supplied along with the request rather than derived from the labels:
+// in the URL, by the bearer token, as the client certificate identity or in the tenant header in the inject mode
+type sourceTenant struct {
+	tenant string
+	// Whether the tenant should be used instead of the one derived from the labels
+	override bool
+	// If not empty then only these tenants are accepted
+	allowed []string
+	// Default tenant of the client's source network
+	network string
+}
+
+func (p *processor) sourceTenant(ctx *fh.RequestCtx) (src sourceTenant) {
+	src.network = sourceNetworkTenant(ctx)
+
+	// The bearer token identity takes precedence over the client certificate
+	if id := requestIdentity(ctx); id != nil {
+		if id.tenant != "" {
+			// Authorized for the pinned tenant only
+			return sourceTenant{tenant: id.tenant, override: true, allowed: []string{id.tenant}, network: src.network}
+		}
+
+		src.allowed = id.allowed
+	}
+
+	ids := p.clientCertIdentities(ctx)
+
+	switch p.cfg.Auth.Ingress.ClientCert.TenantMode {
+	case identityTenantModeTenant:
+		if len(ids) > 0 {
+			// Authorized for the pinned tenant only
+			allowed := []string{ids[0]}
+			if !src.allows(ids[0]) {
+				// Denied by the bearer token identity, keep its restriction
+				allowed = src.allowed
+			}
+
+			return sourceTenant{tenant: ids[0], override: true, allowed: allowed, network: src.network}
+		}
+	case identityTenantModeAllowed:
+		if len(src.allowed) == 0 {
+			src.allowed = ids
+		}
+	}
+
+	// In the inject mode the tenant comes in the header, like the upstream would get it
+	if p.cfg.Tenant.InjectLabel != "" {
+		if tenant := ctx.Request.Header.Peek(p.cfg.Tenant.Header); len(tenant) > 0 {
+			return sourceTenant{tenant: string(tenant), override: true, allowed: src.allowed, network: src.network}
+		}
+	}
+
+	if urlTenant := p.urlTenant(ctx); urlTenant != "" {
+		src.tenant, src.override = urlTenant, p.cfg.Tenant.URLMode == urlModeOverride
+	} else if p.cfg.Auth.Ingress.ClientCert.TenantMode == identityTenantModeDefault && len(ids) > 0 {
+		src.tenant = ids[0]
+	}
+
+	return
+}
+
+// Returns the source tenant if it's set, the default tenant of the source network
+// or the global default tenant otherwise
+func (p *processor) sourceDefaultTenant(src sourceTenant) string {
+	if src.tenant != "" {
+		return src.tenant
+	}
+
+	if src.network != "" {
+		return src.network
+	}
+
+	return p.cfg.Tenant.Default
+}
+
+func (s sourceTenant) allows(tenant string) bool {
+	return len(s.allowed) == 0 || slices.Contains(s.allowed, tenant)
+}
+
+// Returns the tenant if the path consists of the prefix followed by the tenant
+func pathTenant(path []byte, prefix string) (string, bool) {
+	tenant, ok := bytes.CutPrefix(path, []byte(prefix))
+	if !ok || len(tenant) == 0 || bytes.IndexByte(tenant, '/') != -1 {
+		return "", false
+	}
+
+	return string(tenant), true
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"strings"
+
+	fh "github.com/valyala/fasthttp"
+)
+
+// How the client certificates are verified
+const (
+	clientAuthRequire       = "require"
+	clientAuthVerifyIfGiven = "verify_if_given"
+)
+
+// Which part of the client certificate is used as the identity
+const (
+	identityCN     = "cn"
+	identitySANURI = "san_uri"
+	identityOU     = "ou"
+)
+
+// How the client certificate identity is used
+const (
+	// Used for all the timeseries and streams in the request
+	identityTenantModeTenant = "tenant"
+	// Used only if the tenant can't be derived from the labels, instead of tenant.default
+	identityTenantModeDefault = "default"
+	// Used as the tenant prefix instead of tenant.prefix
+	identityTenantModePrefix = "prefix"
+	// Only the tenants matching one of the identities are accepted
+	identityTenantModeAllowed = "allowed"
+)
+
+func validateClientCertConfig(cfg *config) error {
+	tc, cc := &cfg.Auth.Ingress.TlsConfig, &cfg.Auth.Ingress.ClientCert
+
+	if tc.ClientCAFile != "" && (tc.CertFile == "" || tc.KeyFile == "") {
+		return fmt.Errorf("auth.ingress.tls_config.client_ca_file requires cert_file and key_file to be set")
+	}
+
+	switch tc.ClientAuth {
+	case "":
+		tc.ClientAuth = clientAuthRequire
+	case clientAuthRequire, clientAuthVerifyIfGiven:
+	default:
+		return fmt.Errorf("unknown auth.ingress.tls_config.client_auth value: %s", tc.ClientAuth)
+	}
+
+	switch cc.Identity {
+	case "":
+		return nil
+	case identityCN, identitySANURI, identityOU:
+	default:
+		return fmt.Errorf("unknown auth.ingress.client_cert.identity value: %s", cc.Identity)
+	}
+
+	if tc.ClientCAFile == "" {
+		return fmt.Errorf("auth.ingress.client_cert.identity requires auth.ingress.tls_config.client_ca_file to be set")
+	}
+
+	switch cc.TenantMode {
+	case "":
+		cc.TenantMode = identityTenantModeTenant
+	case identityTenantModeTenant, identityTenantModeDefault, identityTenantModePrefix, identityTenantModeAllowed:
+	default:
+		return fmt.Errorf("unknown auth.ingress.client_cert.tenant_mode value: %s", cc.TenantMode)
+	}
+
+	return nil
+}
+
+// Returns the identities of the verified client certificate, if there's one
+func (p *processor) clientCertIdentities(ctx *fh.RequestCtx) []string {
+	if p.cfg.Auth.Ingress.ClientCert.Identity == "" {
+		return nil
+	}
+
+	cs := ctx.TLSConnectionState()
+	if cs == nil || len(cs.VerifiedChains) == 0 || len(cs.VerifiedChains[0]) == 0 {
+		return nil
+	}
+
+	return certIdentities(cs.VerifiedChains[0][0], p.cfg.Auth.Ingress.ClientCert.Identity, p.cfg.Auth.Ingress.ClientCert.SANURIPrefix)
+}
+
+// Extracts the identities from the certificate.
+// SAN URIs not having the prefix are skipped, the prefix is removed from the rest.
+func certIdentities(cert *x509.Certificate, identity, sanURIPrefix string) (ids []string) {
+	switch identity {
+	case identityCN:
+		if cert.Subject.CommonName != "" {
+			ids = append(ids, cert.Subject.CommonName)
+		}
+	case identityOU:
+		for _, ou := range cert.Subject.OrganizationalUnit {
+			if ou != "" {
+				ids = append(ids, ou)
+			}
+		}
+	case identitySANURI:
+		for _, u := range cert.URIs {
+			if id, ok := strings.CutPrefix(u.String(), sanURIPrefix); ok && id != "" {
+				ids = append(ids, id)
+			}
+		}
+	}
+
+	return
+}
+
+// Returns the name of the authenticated client for the logs
+func (p *processor) identityName(ctx *fh.RequestCtx) string {
+	if id := requestIdentity(ctx); id != nil {
+		return id.name
+	}
+
+	if ids := p.clientCertIdentities(ctx); len(ids) > 0 {
+		return ids[0]
+	}
+
+	return ""
+}
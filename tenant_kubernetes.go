@@ -0,0 +1,142 @@
+package main
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corev1 "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+var (
+	metricNamespaceLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cortex_tenant",
+		Name:      "namespace_lookups",
+		Help:      "The total number of tenant lookups by Kubernetes namespace, by result.",
+	}, []string{"result"})
+)
+
+// Resolves the tenant from the annotation or label of the Kubernetes namespace
+// the series or stream belongs to. Namespaces are watched using an informer.
+type namespaceResolver struct {
+	annotation string
+	label      string
+
+	factory informers.SharedInformerFactory
+	lister  corev1.NamespaceLister
+	synced  cache.InformerSynced
+	stop    chan struct{}
+}
+
+func newNamespaceResolver(c config) (*namespaceResolver, error) {
+	k := c.Tenant.Kubernetes
+	if k.Annotation == "" && k.Label == "" {
+		return nil, nil
+	}
+
+	var (
+		rc  *rest.Config
+		err error
+	)
+
+	if k.Kubeconfig != "" {
+		rc, err = clientcmd.BuildConfigFromFlags("", k.Kubeconfig)
+	} else {
+		rc, err = rest.InClusterConfig()
+	}
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to load Kubernetes client config")
+	}
+
+	cs, err := kubernetes.NewForConfig(rc)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to create Kubernetes client")
+	}
+
+	return newNamespaceResolverWithClient(c, cs), nil
+}
+
+func newNamespaceResolverWithClient(c config, cs kubernetes.Interface) *namespaceResolver {
+	k := c.Tenant.Kubernetes
+
+	r := &namespaceResolver{
+		annotation: k.Annotation,
+		label:      k.Label,
+		factory:    informers.NewSharedInformerFactory(cs, k.ResyncPeriod),
+		stop:       make(chan struct{}),
+	}
+
+	inf := r.factory.Core().V1().Namespaces()
+	r.lister = inf.Lister()
+	r.synced = inf.Informer().HasSynced
+
+	return r
+}
+
+// Starts the informer without waiting for the sync,
+// the lookups yield nothing until it's synced
+func (r *namespaceResolver) start() {
+	r.factory.Start(r.stop)
+}
+
+// Waits for the informer to sync, for testing
+func (r *namespaceResolver) waitForSync(timeout time.Duration) bool {
+	stop := make(chan struct{})
+	t := time.AfterFunc(timeout, func() { close(stop) })
+	defer t.Stop()
+
+	return cache.WaitForCacheSync(stop, r.synced)
+}
+
+func (r *namespaceResolver) close() {
+	close(r.stop)
+	r.factory.Shutdown()
+}
+
+// Returns the tenant of the namespace or an empty string
+func (r *namespaceResolver) tenant(namespace string) string {
+	if namespace == "" {
+		return ""
+	}
+
+	if !r.synced() {
+		metricNamespaceLookups.WithLabelValues("not_synced").Inc()
+		return ""
+	}
+
+	ns, err := r.lister.Get(namespace)
+	if err != nil {
+		metricNamespaceLookups.WithLabelValues("not_found").Inc()
+		return ""
+	}
+
+	// Annotation is preferred over the label
+	tenant := ns.Annotations[r.annotation]
+	if tenant == "" {
+		tenant = ns.Labels[r.label]
+	}
+
+	if tenant == "" {
+		metricNamespaceLookups.WithLabelValues("miss").Inc()
+		return ""
+	}
+
+	metricNamespaceLookups.WithLabelValues("hit").Inc()
+	return tenant
+}
+
+// Resolves the tenant by the namespace from the given label if it's configured
+func (p *processor) namespaceTenant(lookup func(name string) string, label string) string {
+	if p.namespaceResolver == nil {
+		return ""
+	}
+
+	return p.namespaceResolver.tenant(lookup(label))
+}
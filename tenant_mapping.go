@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/blind-oracle/go-common/logger"
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	fh "github.com/valyala/fasthttp"
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	metricMappingLastSuccess = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "cortex_tenant",
+		Name:      "mapping_last_success_timestamp_seconds",
+		Help:      "Unix timestamp of the last successful tenant mapping load.",
+	}, []string{"source"})
+	metricMappingReloadErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cortex_tenant",
+		Name:      "mapping_reload_errors",
+		Help:      "The total number of failed tenant mapping loads.",
+	}, []string{"source"})
+)
+
+const (
+	mappingSourceFile   = "file"
+	mappingSourceRemote = "remote"
+)
+
+// What to do with the values which are not found in the mapping table
+const (
+	mappingUnmappedPassthrough = "passthrough"
+	mappingUnmappedDefault     = "default"
+	mappingUnmappedReject      = "reject"
+)
+
+// Maps the extracted label values to tenants. Exact matches take precedence,
+// then the wildcard patterns are checked in the order they're defined
+// and then the catch-all (`*`) entry.
+type tenantMappingTable struct {
+	exact     map[string]string
+	wildcards []tenantMappingWildcard
+	catchAll  string
+}
+
+type tenantMappingWildcard struct {
+	re     *regexp.Regexp
+	tenant string
+}
+
+func newTenantMappingTable(entries yaml.MapSlice) (*tenantMappingTable, error) {
+	t := &tenantMappingTable{exact: map[string]string{}}
+
+	for _, e := range entries {
+		key, tenant := fmt.Sprint(e.Key), fmt.Sprint(e.Value)
+		if tenant == "" {
+			return nil, fmt.Errorf("empty tenant for key '%s'", key)
+		}
+
+		switch {
+		case key == "*":
+			t.catchAll = tenant
+		case strings.ContainsAny(key, "*?"):
+			t.wildcards = append(t.wildcards, tenantMappingWildcard{
+				re:     globRegexp(key),
+				tenant: tenant,
+			})
+		default:
+			t.exact[key] = tenant
+		}
+	}
+
+	return t, nil
+}
+
+// Converts the glob with `*` and `?` wildcards into an anchored regexp
+func globRegexp(glob string) *regexp.Regexp {
+	expr := regexp.QuoteMeta(glob)
+	expr = strings.ReplaceAll(expr, `\*`, ".*")
+	expr = strings.ReplaceAll(expr, `\?`, ".")
+
+	return regexp.MustCompile("^" + expr + "$")
+}
+
+// Parses the table in YAML (`key: tenant` map) or CSV (`key,tenant` lines) format
+func parseTenantMappingTable(b []byte, isCSV bool) (*tenantMappingTable, error) {
+	var entries yaml.MapSlice
+
+	if !isCSV {
+		if err := yaml.UnmarshalStrict(b, &entries); err != nil {
+			return nil, errors.Wrap(err, "Unable to parse YAML")
+		}
+
+		return newTenantMappingTable(entries)
+	}
+
+	r := csv.NewReader(bytes.NewReader(b))
+	r.Comment = '#'
+	r.FieldsPerRecord = 2
+	r.TrimLeadingSpace = true
+
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to parse CSV")
+	}
+
+	for _, rec := range records {
+		entries = append(entries, yaml.MapItem{Key: rec[0], Value: rec[1]})
+	}
+
+	return newTenantMappingTable(entries)
+}
+
+func (t *tenantMappingTable) lookup(key string) (string, bool) {
+	if tenant, ok := t.exact[key]; ok {
+		return tenant, true
+	}
+
+	for _, w := range t.wildcards {
+		if w.re.MatchString(key) {
+			return w.tenant, true
+		}
+	}
+
+	if t.catchAll != "" {
+		return t.catchAll, true
+	}
+
+	return "", false
+}
+
+// Holds the current mapping table and keeps it up to date
+type tenantMapper struct {
+	table    atomic.Pointer[tenantMappingTable]
+	unmapped string
+
+	file    string
+	watcher *fsnotify.Watcher
+
+	remote tenantMappingRemote
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+
+	logger.Logger
+}
+
+func newTenantMapper(c config, tlsConfig *tls.Config) (*tenantMapper, error) {
+	if c.Tenant.MappingFile == "" && c.Tenant.MappingRemote.URL == "" {
+		return nil, nil
+	}
+
+	m := &tenantMapper{
+		unmapped: c.Tenant.MappingUnmapped,
+		file:     c.Tenant.MappingFile,
+		stop:     make(chan struct{}),
+		Logger:   logger.NewSimpleLogger("mapping"),
+	}
+
+	switch m.unmapped {
+	case mappingUnmappedPassthrough, mappingUnmappedDefault, mappingUnmappedReject:
+	default:
+		return nil, fmt.Errorf("unknown tenant.mapping_unmapped value: %s", m.unmapped)
+	}
+
+	if m.file == "" {
+		m.remote = newTenantMappingRemote(c, tlsConfig)
+		return m, nil
+	}
+
+	if err := m.load(); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func (m *tenantMapper) load() error {
+	b, err := os.ReadFile(m.file)
+	if err != nil {
+		return errors.Wrap(err, "Unable to read tenant mapping file")
+	}
+
+	// Non-atomic writes truncate the file first, don't pick up the empty table
+	if len(bytes.TrimSpace(b)) == 0 {
+		return fmt.Errorf("tenant mapping file %s is empty", m.file)
+	}
+
+	t, err := parseTenantMappingTable(b, strings.EqualFold(filepath.Ext(m.file), ".csv"))
+	if err != nil {
+		return errors.Wrapf(err, "Unable to load tenant mapping file %s", m.file)
+	}
+
+	m.table.Store(t)
+	return nil
+}
+
+// Updates the table and the freshness metrics
+func (m *tenantMapper) reload(source string, fn func() error) {
+	if err := fn(); err != nil {
+		metricMappingReloadErrors.WithLabelValues(source).Inc()
+		m.Errorf("%s, keeping the previous mapping", err)
+		return
+	}
+
+	metricMappingLastSuccess.WithLabelValues(source).SetToCurrentTime()
+}
+
+// Starts watching the file or polling the remote source
+func (m *tenantMapper) start() error {
+	if m.file == "" {
+		// Don't fail if the remote is unavailable on startup,
+		// all the values are rejected until the first successful fetch
+		m.reload(mappingSourceRemote, m.fetch)
+
+		m.wg.Add(1)
+		go m.poll()
+		return nil
+	}
+
+	metricMappingLastSuccess.WithLabelValues(mappingSourceFile).SetToCurrentTime()
+	return m.watch()
+}
+
+// Reloads the table when the file changes. The directory is watched
+// instead of the file itself to catch the atomic renames done by editors and
+// Kubernetes ConfigMap updates.
+func (m *tenantMapper) watch() (err error) {
+	if m.watcher, err = fsnotify.NewWatcher(); err != nil {
+		return errors.Wrap(err, "Unable to create file watcher")
+	}
+
+	if err = m.watcher.Add(filepath.Dir(m.file)); err != nil {
+		return errors.Wrap(err, "Unable to watch tenant mapping file")
+	}
+
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+
+		for {
+			select {
+			case ev, ok := <-m.watcher.Events:
+				if !ok {
+					return
+				}
+
+				if ev.Has(fsnotify.Chmod) {
+					continue
+				}
+
+				// Events for other files in the directory trigger a reload too, it is cheap
+				m.reload(mappingSourceFile, m.load)
+
+			case err, ok := <-m.watcher.Errors:
+				if !ok {
+					return
+				}
+
+				m.Errorf("File watcher error: %s", err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (m *tenantMapper) close() {
+	close(m.stop)
+
+	if m.watcher != nil {
+		m.watcher.Close()
+	}
+
+	m.wg.Wait()
+}
+
+// The remote source wasn't fetched yet, the senders should retry later
+var errMappingNotLoaded = errors.New("tenant mapping is not loaded yet")
+
+// Returns the HTTP status code for the tenant resolution error
+func tenantErrorCode(err error) int {
+	if errors.Is(err, errMappingNotLoaded) {
+		return fh.StatusServiceUnavailable
+	}
+
+	return fh.StatusBadRequest
+}
+
+// Maps the extracted value to a tenant according to the table and the unmapped policy
+func (m *tenantMapper) mapTenant(value, defaultTenant string) (string, error) {
+	t := m.table.Load()
+	if t == nil {
+		// Don't let everything through unmapped
+		return "", errMappingNotLoaded
+	}
+
+	if tenant, ok := t.lookup(value); ok {
+		return tenant, nil
+	}
+
+	switch m.unmapped {
+	case mappingUnmappedPassthrough:
+		return value, nil
+	case mappingUnmappedDefault:
+		if defaultTenant != "" {
+			return defaultTenant, nil
+		}
+	}
+
+	return "", fmt.Errorf("tenant '%s' is not mapped", value)
+}
+
+// Maps the extracted value to a tenant if the mapping is configured
+func (p *processor) mapTenant(value, defaultTenant string) (string, error) {
+	if p.tenantMapper == nil {
+		return value, nil
+	}
+
+	return p.tenantMapper.mapTenant(value, defaultTenant)
+}
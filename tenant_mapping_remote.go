@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	fh "github.com/valyala/fasthttp"
+	"gopkg.in/yaml.v2"
+)
+
+// Fetches the mapping table as a JSON object from a remote HTTP endpoint (e.g. CMDB)
+type tenantMappingRemote struct {
+	url      string
+	auth     string
+	interval time.Duration
+	timeout  time.Duration
+	etag     string
+
+	cli *fh.Client
+}
+
+// The TLS config is shared with the egress client to trust the same CA bundle
+func newTenantMappingRemote(c config, tlsConfig *tls.Config) tenantMappingRemote {
+	r := tenantMappingRemote{
+		url:      c.Tenant.MappingRemote.URL,
+		interval: c.Tenant.MappingRemote.Interval,
+		timeout:  c.Tenant.MappingRemote.Timeout,
+		cli: &fh.Client{
+			Name:          "cortex-tenant",
+			DialDualStack: c.EnableIPv6,
+			TLSConfig:     tlsConfig,
+		},
+	}
+
+	switch {
+	case c.Tenant.MappingRemote.BearerToken != "":
+		r.auth = "Bearer " + c.Tenant.MappingRemote.BearerToken
+	case c.Tenant.MappingRemote.Username != "":
+		authString := []byte(fmt.Sprintf("%s:%s", c.Tenant.MappingRemote.Username, c.Tenant.MappingRemote.Password))
+		r.auth = "Basic " + base64.StdEncoding.EncodeToString(authString)
+	}
+
+	return r
+}
+
+func (m *tenantMapper) poll() {
+	defer m.wg.Done()
+
+	t := time.NewTicker(m.remote.interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			m.reload(mappingSourceRemote, m.fetch)
+		case <-m.stop:
+			return
+		}
+	}
+}
+
+// Fetches the table, the ETag is used to skip the unchanged ones
+func (m *tenantMapper) fetch() error {
+	req := fh.AcquireRequest()
+	resp := fh.AcquireResponse()
+	defer func() {
+		fh.ReleaseRequest(req)
+		fh.ReleaseResponse(resp)
+	}()
+
+	req.SetRequestURI(m.remote.url)
+	req.Header.Set("Accept", "application/json")
+
+	if m.remote.auth != "" {
+		req.Header.Set("Authorization", m.remote.auth)
+	}
+
+	if m.remote.etag != "" {
+		req.Header.Set("If-None-Match", m.remote.etag)
+	}
+
+	if err := m.remote.cli.DoTimeout(req, resp, m.remote.timeout); err != nil {
+		return errors.Wrap(err, "Unable to fetch tenant mapping")
+	}
+
+	switch resp.StatusCode() {
+	case fh.StatusOK:
+	case fh.StatusNotModified:
+		return nil
+	default:
+		return fmt.Errorf("unexpected HTTP code %d while fetching tenant mapping", resp.StatusCode())
+	}
+
+	t, err := parseTenantMappingJSON(resp.Body())
+	if err != nil {
+		return errors.Wrap(err, "Unable to load tenant mapping")
+	}
+
+	m.table.Store(t)
+	m.remote.etag = string(resp.Header.Peek(fh.HeaderETag))
+	return nil
+}
+
+// Parses the table from a JSON object (`{"key": "tenant"}`) keeping the order of the keys
+func parseTenantMappingJSON(b []byte) (*tenantMappingTable, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return nil, fmt.Errorf("mapping must be a JSON object")
+	}
+
+	var entries yaml.MapSlice
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, errors.Wrap(err, "Unable to parse JSON")
+		}
+
+		var tenant string
+		if err = dec.Decode(&tenant); err != nil {
+			return nil, errors.Wrapf(err, "Unable to parse tenant for key '%s'", tok)
+		}
+
+		entries = append(entries, yaml.MapItem{Key: tok, Value: tenant})
+	}
+
+	if _, err := dec.Token(); err != nil {
+		return nil, errors.Wrap(err, "Unable to parse JSON")
+	}
+
+	return newTenantMappingTable(entries)
+}